@@ -1,9 +1,11 @@
 package config
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -34,6 +36,7 @@ type UserHandlerConfig struct {
 	MaxTotalBytes         int `envconfig:"default=20971520"`
 	MaxBatchTTL           int `envconfig:"default=7200"`    // 2 hours
 	MaxRecordPayloadBytes int `envconfig:"default=2097152"` // 2MB
+	QuotaBytes            int `envconfig:"default=0"`       // disabled
 }
 
 type PoolConfig struct {
@@ -42,6 +45,78 @@ type PoolConfig struct {
 	PurgeMinHours int `envconfig:"default=168"`
 	PurgeMaxHours int `envconfig:"default=336"`
 	VacuumKB      int `envconfig:"default=0"`
+	TTL           int `envconfig:"default=300"` // seconds
+
+	MaintenanceWorkers    int `envconfig:"default=1"`
+	MaintenanceQueueSize  int `envconfig:"default=1000"`
+	MaintenanceIOBudgetKB int `envconfig:"default=0"` // unlimited
+}
+
+// configures pushing metrics to statsd, disabled when Addr is empty
+type StatsdConfig struct {
+	Addr          string   `envconfig:"optional"`
+	Prefix        string   `envconfig:"optional"`
+	Tags          []string `envconfig:"optional"`
+	Dogstatsd     bool     `envconfig:"default=true"`
+	FlushInterval int      `envconfig:"default=10"` // seconds
+	SampleRate    float64  `envconfig:"default=1"`
+}
+
+// configures the checks done by /__heartbeat__
+type HeartbeatConfig struct {
+	MinFreeKB       int     `envconfig:"default=102400"` // 100MB
+	MaxConflictRate float64 `envconfig:"default=0.1"`
+}
+
+// configures the DATA_DIR free space watchdog, 0 disables a limit
+type DiskConfig struct {
+	Interval   int `envconfig:"default=10"` // seconds
+	SoftKB     int `envconfig:"default=1048576"`
+	HardKB     int `envconfig:"default=102400"`
+	SoftInodes int `envconfig:"default=100000"`
+	HardInodes int `envconfig:"default=10000"`
+	Backoff    int `envconfig:"default=1800"` // seconds
+}
+
+// configures the LoadGovernor, 0 disables a limit
+type LoadConfig struct {
+	SoftInFlight    int `envconfig:"default=500"`
+	HardInFlight    int `envconfig:"default=2000"`
+	SoftPoolWaitMS  int `envconfig:"default=100"`
+	HardPoolWaitMS  int `envconfig:"default=1000"`
+	SoftDBLatencyMS int `envconfig:"default=250"`
+	HardDBLatencyMS int `envconfig:"default=2000"`
+	Window          int `envconfig:"default=10"`  // seconds
+	Backoff         int `envconfig:"default=300"` // seconds
+	RetryAfter      int `envconfig:"default=30"`  // seconds
+}
+
+// configures per-user and per-IP rate limits, a 0 rate disables a limit.
+// All limits are off by default
+type RateLimitConfig struct {
+	UserReadRate        float64 `envconfig:"default=0"` // requests per second
+	UserReadBurst       int     `envconfig:"default=100"`
+	UserWriteRate       float64 `envconfig:"default=0"`
+	UserWriteBurst      int     `envconfig:"default=50"`
+	IPRate              float64 `envconfig:"default=0"`
+	IPBurst             int     `envconfig:"default=100"`
+	IPTrustForwardedFor bool    `envconfig:"default=false"`
+}
+
+// configures the background sweeper of idle user DBs, a 0 rate disables it
+type SweepConfig struct {
+	Rate         float64 `envconfig:"default=0"` // DBs per second
+	IOBudgetKB   int     `envconfig:"default=0"` // unlimited
+	VacuumKB     int     `envconfig:"default=1024"`
+	PassInterval int     `envconfig:"default=86400"` // seconds
+}
+
+// configures removing users that stopped syncing, done by the sweeper.
+// 0 days keeps everyone
+type RetentionConfig struct {
+	Days       int    `envconfig:"default=0"`
+	DryRun     bool   `envconfig:"default=false"`
+	ArchiveDir string `envconfig:"optional"`
 }
 
 type SqliteConfig struct {
@@ -53,14 +128,40 @@ var Config struct {
 	Hostname string `envconfig:"optional"`
 	Host     string `envconfig:"default=0.0.0.0"`
 	Port     int
-	Secrets  []string
+	Secrets  []string `envconfig:"optional"`
 	DataDir  string
 	Pool     *PoolConfig
 	Sqlite   *SqliteConfig
+	Statsd   *StatsdConfig
+
+	Heartbeat *HeartbeatConfig
+	Disk      *DiskConfig
+	Load      *LoadConfig
+	RateLimit *RateLimitConfig
+	Sweep     *SweepConfig
+	Retention *RetentionConfig
 
-	// Enable the pprof web endpoint /debug/pprof/
+	// secrets, with optional validity times, from a file that is
+	// reloaded when it changes or on SIGHUP. Replaces SECRETS
+	SecretsFile         string `envconfig:"optional"`
+	SecretsFileInterval int    `envconfig:"default=10"` // seconds
+
+	// URLs of this node, tokens for other nodes are logged or rejected
+	PublicURL        []string `envconfig:"optional"`
+	PublicURLEnforce bool     `envconfig:"default=false"`
+
+	// Enable the pprof web endpoint /debug/pprof/ on the admin listener
 	EnablePprof bool `envconfig:"default=false"`
 
+	// listener for metrics, pprof and operator endpoints. 0 disables it
+	AdminHost  string `envconfig:"default=127.0.0.1"`
+	AdminPort  int    `envconfig:"default=0"`
+	AdminToken string `envconfig:"optional"`
+
+	// file for the audit log of admin user actions, the
+	// standard log is used when empty
+	AdminAuditLog string `envconfig:"optional"`
+
 	// SyncUserHandler limits / configuration
 	// available as LIMIT_x
 	Limit *UserHandlerConfig
@@ -70,6 +171,20 @@ var Config struct {
 
 	// max skew for hawk timestamps in seconds
 	HawkTimestampMaxSkew int `envconfig:"default=60"`
+
+	// seconds an expired token is still accepted
+	HawkTokenExpiryGrace int `envconfig:"default=60"`
+
+	// sign responses with a Server-Authorization header
+	HawkServerAuthorization bool `envconfig:"default=false"`
+
+	// replay cache size and saving it to DATA_DIR across restarts
+	HawkNonceMaxEntries   int  `envconfig:"default=500000"`
+	HawkNoncePersist      bool `envconfig:"default=false"`
+	HawkNonceSaveInterval int  `envconfig:"default=60"` // seconds
+
+	// number of parsed tokens to cache, 0 disables
+	HawkTokenCacheSize int `envconfig:"default=10000"`
 }
 
 // so we can use config.Port and not config.Config.Port
@@ -80,14 +195,39 @@ var (
 	Port        int
 	DataDir     string
 	Secrets     []string
+	SecretsFile string
 	Pool        *PoolConfig
 	Sqlite      *SqliteConfig
+	Statsd      *StatsdConfig
+	Heartbeat   *HeartbeatConfig
+	Disk        *DiskConfig
+	Load        *LoadConfig
+	RateLimit   *RateLimitConfig
+	Sweep       *SweepConfig
+	Retention   *RetentionConfig
 	EnablePprof bool
 
+	AdminHost     string
+	AdminPort     int
+	AdminToken    string
+	AdminAuditLog string
+
 	Limit *UserHandlerConfig
 
 	InfoCacheSize        int
 	HawkTimestampMaxSkew int
+	HawkTokenExpiryGrace int
+
+	HawkServerAuthorization bool
+	HawkNonceMaxEntries     int
+	HawkNoncePersist        bool
+	HawkNonceSaveInterval   int
+	HawkTokenCacheSize      int
+
+	SecretsFileInterval int
+
+	PublicURL        []string
+	PublicURLEnforce bool
 )
 
 func init() {
@@ -99,6 +239,13 @@ func init() {
 		log.Fatal("Config.Error: PORT invalid")
 	}
 
+	if Config.AdminPort < 0 || Config.AdminPort > 65535 {
+		log.Fatal("Config.Error: ADMIN_PORT invalid")
+	}
+	if Config.AdminPort == Config.Port {
+		log.Fatal("Config.Error: ADMIN_PORT must be different from PORT")
+	}
+
 	if Config.DataDir != ":memory:" {
 		if _, err := os.Stat(Config.DataDir); os.IsNotExist(err) {
 			log.Fatal("Config Error: DATA_DIR does not exist")
@@ -123,6 +270,24 @@ func init() {
 		}
 	}
 
+	if len(Config.Secrets) == 0 && Config.SecretsFile == "" {
+		log.Fatal("Config Error: SECRETS or SECRETS_FILE is required")
+	}
+	if Config.SecretsFile != "" {
+		if _, err := os.Stat(Config.SecretsFile); err != nil {
+			log.Fatal("Config Error: SECRETS_FILE can not be read")
+		}
+	}
+	if Config.SecretsFileInterval < 1 {
+		log.Fatal("SECRETS_FILE_INTERVAL must be >= 1")
+	}
+
+	for _, publicURL := range Config.PublicURL {
+		if u, err := url.Parse(publicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Config Error: PUBLIC_URL %s is not a valid URL", publicURL)
+		}
+	}
+
 	switch Config.Log.Level {
 	case "panic", "fatal", "error", "warn", "info", "debug":
 	default:
@@ -137,6 +302,9 @@ func init() {
 		Config.Pool.Num = runtime.NumCPU()
 	}
 
+	if Config.Limit.MaxRequestBytes < 1 {
+		log.Fatal("LIMIT_MAX_REQUEST_BYTES must be >= 1")
+	}
 	if Config.Limit.MaxPOSTRecords < 1 {
 		log.Fatal("LIMIT_MAX_POST_RECORDS must be >= 1")
 	}
@@ -156,6 +324,10 @@ func init() {
 		log.Fatal("LIMIT_MAX_RECORD_PAYLOAD_BYTES must be >= 1")
 	}
 
+	if Config.Limit.QuotaBytes < 0 {
+		log.Fatal("LIMIT_QUOTA_BYTES must be >= 0")
+	}
+
 	if Config.InfoCacheSize < 0 {
 		log.Fatal("INFO_CACHE_SIZE must be >= 0")
 	}
@@ -172,21 +344,150 @@ func init() {
 	if Config.Pool.PurgeMaxHours < Config.Pool.PurgeMinHours {
 		log.Fatal("POOL_MAX_HOURS must be > POOL_MIN_HOURS")
 	}
+	if Config.Pool.TTL < 0 {
+		log.Fatal("POOL_TTL must be >= 0")
+	}
+	if Config.Pool.MaintenanceWorkers < 1 {
+		log.Fatal("POOL_MAINTENANCE_WORKERS must be >= 1")
+	}
+	if Config.Pool.MaintenanceQueueSize < 1 {
+		log.Fatal("POOL_MAINTENANCE_QUEUE_SIZE must be >= 1")
+	}
+	if Config.Pool.MaintenanceIOBudgetKB < 0 {
+		log.Fatal("POOL_MAINTENANCE_IO_BUDGET_KB must be >= 0")
+	}
+
+	if Config.Statsd.FlushInterval < 1 {
+		log.Fatal("STATSD_FLUSH_INTERVAL must be >= 1")
+	}
+	if Config.Statsd.SampleRate <= 0 || Config.Statsd.SampleRate > 1 {
+		log.Fatal("STATSD_SAMPLE_RATE must be > 0 and <= 1")
+	}
+
+	if Config.Heartbeat.MinFreeKB < 0 {
+		log.Fatal("HEARTBEAT_MIN_FREE_KB must be >= 0")
+	}
+	if Config.Heartbeat.MaxConflictRate < 0 || Config.Heartbeat.MaxConflictRate > 1 {
+		log.Fatal("HEARTBEAT_MAX_CONFLICT_RATE must be between 0 and 1")
+	}
+
+	if Config.Disk.Interval < 1 {
+		log.Fatal("DISK_INTERVAL must be >= 1")
+	}
+	if Config.Disk.SoftKB < 0 || Config.Disk.HardKB < 0 {
+		log.Fatal("DISK_SOFT_KB and DISK_HARD_KB must be >= 0")
+	}
+	if Config.Disk.SoftInodes < 0 || Config.Disk.HardInodes < 0 {
+		log.Fatal("DISK_SOFT_INODES and DISK_HARD_INODES must be >= 0")
+	}
+	if Config.Disk.HardKB > Config.Disk.SoftKB && Config.Disk.SoftKB > 0 {
+		log.Fatal("DISK_HARD_KB must be <= DISK_SOFT_KB")
+	}
+	if Config.Disk.HardInodes > Config.Disk.SoftInodes && Config.Disk.SoftInodes > 0 {
+		log.Fatal("DISK_HARD_INODES must be <= DISK_SOFT_INODES")
+	}
+	if Config.Disk.Backoff < 0 {
+		log.Fatal("DISK_BACKOFF must be >= 0")
+	}
+
+	for name, value := range map[string]int{
+		"LOAD_SOFT_IN_FLIGHT":     Config.Load.SoftInFlight,
+		"LOAD_HARD_IN_FLIGHT":     Config.Load.HardInFlight,
+		"LOAD_SOFT_POOL_WAIT_MS":  Config.Load.SoftPoolWaitMS,
+		"LOAD_HARD_POOL_WAIT_MS":  Config.Load.HardPoolWaitMS,
+		"LOAD_SOFT_DB_LATENCY_MS": Config.Load.SoftDBLatencyMS,
+		"LOAD_HARD_DB_LATENCY_MS": Config.Load.HardDBLatencyMS,
+		"LOAD_BACKOFF":            Config.Load.Backoff,
+		"LOAD_RETRY_AFTER":        Config.Load.RetryAfter,
+	} {
+		if value < 0 {
+			log.Fatalf("%s must be >= 0", name)
+		}
+	}
+	if Config.Load.Window < 1 {
+		log.Fatal("LOAD_WINDOW must be >= 1")
+	}
+
+	if Config.RateLimit.UserReadRate < 0 || Config.RateLimit.UserWriteRate < 0 || Config.RateLimit.IPRate < 0 {
+		log.Fatal("RATE_LIMIT_USER_READ_RATE, RATE_LIMIT_USER_WRITE_RATE and RATE_LIMIT_IP_RATE must be >= 0")
+	}
+	if Config.RateLimit.UserReadBurst < 1 || Config.RateLimit.UserWriteBurst < 1 || Config.RateLimit.IPBurst < 1 {
+		log.Fatal("RATE_LIMIT_USER_READ_BURST, RATE_LIMIT_USER_WRITE_BURST and RATE_LIMIT_IP_BURST must be >= 1")
+	}
+
+	if Config.Sweep.Rate < 0 {
+		log.Fatal("SWEEP_RATE must be >= 0")
+	}
+	if Config.Sweep.IOBudgetKB < 0 || Config.Sweep.VacuumKB < 0 {
+		log.Fatal("SWEEP_IO_BUDGET_KB and SWEEP_VACUUM_KB must be >= 0")
+	}
+	if Config.Sweep.PassInterval < 1 {
+		log.Fatal("SWEEP_PASS_INTERVAL must be >= 1")
+	}
+
+	if Config.Retention.Days < 0 {
+		log.Fatal("RETENTION_DAYS must be >= 0")
+	}
+	if Config.Retention.Days > 0 && (Config.Sweep.Rate == 0 || Config.DataDir == ":memory:") {
+		log.Fatal("RETENTION_DAYS needs SWEEP_RATE > 0 and a DATA_DIR on disk")
+	}
+	if Config.Retention.ArchiveDir != "" && Config.DataDir != ":memory:" {
+		archiveDir, _ := filepath.Abs(Config.Retention.ArchiveDir)
+		dataDir, _ := filepath.Abs(Config.DataDir)
+		if archiveDir == dataDir || strings.HasPrefix(archiveDir, dataDir+string(filepath.Separator)) {
+			log.Fatal("RETENTION_ARCHIVE_DIR must be outside of DATA_DIR")
+		}
+	}
 
 	if Config.HawkTimestampMaxSkew < 60 {
 		log.Fatal("HAWK_TIMESTAMP_MAX_SKEW must be >= 60")
 	}
 
+	if Config.HawkTokenExpiryGrace < 0 {
+		log.Fatal("HAWK_TOKEN_EXPIRY_GRACE must be >= 0")
+	}
+
+	if Config.HawkNonceMaxEntries < 1 {
+		log.Fatal("HAWK_NONCE_MAX_ENTRIES must be >= 1")
+	}
+	if Config.HawkNonceSaveInterval < 1 {
+		log.Fatal("HAWK_NONCE_SAVE_INTERVAL must be >= 1")
+	}
+	if Config.HawkTokenCacheSize < 0 {
+		log.Fatal("HAWK_TOKEN_CACHE_SIZE must be >= 0")
+	}
+
 	Hostname = Config.Hostname
 	Log = Config.Log
 	Host = Config.Host
 	Port = Config.Port
 	Secrets = Config.Secrets
+	SecretsFile = Config.SecretsFile
+	SecretsFileInterval = Config.SecretsFileInterval
+	PublicURL = Config.PublicURL
+	PublicURLEnforce = Config.PublicURLEnforce
 	DataDir = Config.DataDir
 	Pool = Config.Pool
 	EnablePprof = Config.EnablePprof
+	AdminHost = Config.AdminHost
+	AdminPort = Config.AdminPort
+	AdminToken = Config.AdminToken
+	AdminAuditLog = Config.AdminAuditLog
 	Limit = Config.Limit
 	Sqlite = Config.Sqlite
+	Statsd = Config.Statsd
+	Heartbeat = Config.Heartbeat
+	Disk = Config.Disk
+	Load = Config.Load
+	RateLimit = Config.RateLimit
+	Sweep = Config.Sweep
+	Retention = Config.Retention
 	InfoCacheSize = Config.InfoCacheSize
 	HawkTimestampMaxSkew = Config.HawkTimestampMaxSkew
+	HawkTokenExpiryGrace = Config.HawkTokenExpiryGrace
+	HawkServerAuthorization = Config.HawkServerAuthorization
+	HawkNonceMaxEntries = Config.HawkNonceMaxEntries
+	HawkNoncePersist = Config.HawkNoncePersist
+	HawkNonceSaveInterval = Config.HawkNonceSaveInterval
+	HawkTokenCacheSize = Config.HawkTokenCacheSize
 }
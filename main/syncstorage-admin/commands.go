@@ -0,0 +1,380 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/mozilla-services/go-syncstorage/web"
+)
+
+var errSchemaBehind = errors.New("Schema is behind, run migrate first")
+
+// openDB opens an existing DB. Unlike syncstorage.NewDB it does not
+// create missing DBs or apply migrations, that is left to migrate
+func openDB(target target) (*syncstorage.DB, error) {
+	status, err := syncstorage.CheckMigrations(target.Path)
+	if os.IsNotExist(err) {
+		return nil, errors.New("DB not found")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if status.Behind() {
+		return nil, errSchemaBehind
+	}
+
+	return syncstorage.NewDB(target.Path, nil)
+}
+
+// parseFlags parses a command's flags and returns the args after them
+func parseFlags(flags *flag.FlagSet, args []string) []string {
+	flags.Parse(args)
+	return flags.Args()
+}
+
+type inspectResult struct {
+	Uid           string `json:"uid"`
+	Path          string `json:"path"`
+	SchemaVersion int    `json:"schema_version"`
+	LastModified  int    `json:"last_modified"`
+
+	web.UserInfo
+	Batches []syncstorage.BatchInfo `json:"batches"`
+}
+
+func cmdInspect(t *tool, args []string) error {
+	if len(args) == 0 {
+		return errors.New("inspect needs a uid")
+	}
+
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		db, err := openDB(target)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		result := &inspectResult{Uid: target.Uid, Path: target.Path}
+		if result.SchemaVersion, err = db.SchemaVersion(); err != nil {
+			return nil, err
+		}
+		if result.LastModified, err = db.LastModified(); err != nil {
+			return nil, err
+		}
+
+		// the same info the admin listener serves
+		handler := web.NewSyncUserHandler(target.Uid, db, nil)
+		info, err := handler.Info()
+		if err != nil {
+			return nil, err
+		}
+		result.UserInfo = *info
+
+		if result.Batches, err = handler.Batches(); err != nil {
+			return nil, err
+		}
+
+		return result, nil
+	})
+
+	return nil
+}
+
+type purgeResult struct {
+	Uid     string `json:"uid"`
+	BSOs    int    `json:"bsos"`
+	Batches int    `json:"batches"`
+	T       int64  `json:"t"`
+}
+
+func cmdPurge(t *tool, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	batchTTL := flags.Int("batch-ttl", 7200, "seconds until an uncommitted batch is purged")
+	args = parseFlags(flags, args)
+
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		start := time.Now()
+
+		db, err := openDB(target)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		result := &purgeResult{Uid: target.Uid}
+		if result.BSOs, err = db.PurgeExpired(); err != nil {
+			return nil, errors.Wrap(err, "Could not purge BSOs")
+		}
+		if result.Batches, err = db.BatchPurge(*batchTTL * 1000); err != nil {
+			return nil, errors.Wrap(err, "Could not purge batches")
+		}
+
+		result.T = int64(time.Since(start) / time.Millisecond)
+		return result, nil
+	})
+
+	return nil
+}
+
+type vacuumResult struct {
+	Uid      string `json:"uid"`
+	FreeKB   int    `json:"free_kb"`
+	Vacuumed bool   `json:"vacuumed"`
+	BeforeKB int    `json:"before_kb"`
+	AfterKB  int    `json:"after_kb"`
+	T        int64  `json:"t"`
+}
+
+func cmdVacuum(t *tool, args []string) error {
+	flags := flag.NewFlagSet("vacuum", flag.ExitOnError)
+	minFreeKB := flags.Int("min-free-kb", 0, "only vacuum DBs with at least this much free")
+	args = parseFlags(flags, args)
+
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		start := time.Now()
+
+		db, err := openDB(target)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		before, err := db.Usage()
+		if err != nil {
+			return nil, err
+		}
+
+		result := &vacuumResult{
+			Uid:      target.Uid,
+			FreeKB:   before.Free * before.Size / 1024,
+			BeforeKB: before.Total * before.Size / 1024,
+		}
+		result.AfterKB = result.BeforeKB
+
+		if result.FreeKB > 0 && result.FreeKB >= *minFreeKB {
+			if err := db.Vacuum(); err != nil {
+				return nil, errors.Wrap(err, "Could not vacuum")
+			}
+
+			after, err := db.Usage()
+			if err != nil {
+				return nil, err
+			}
+
+			result.Vacuumed = true
+			result.AfterKB = after.Total * after.Size / 1024
+		}
+
+		result.T = int64(time.Since(start) / time.Millisecond)
+		return result, nil
+	})
+
+	return nil
+}
+
+type verifyResult struct {
+	Uid      string   `json:"uid"`
+	OK       bool     `json:"ok"`
+	Version  int      `json:"version"`
+	Latest   int      `json:"latest"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+func cmdVerify(t *tool, args []string) error {
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		status, err := syncstorage.CheckMigrations(target.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		problems, err := syncstorage.IntegrityCheck(target.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &verifyResult{
+			Uid:      target.Uid,
+			Version:  status.Version,
+			Latest:   status.Latest,
+			Problems: problems,
+		}
+
+		if status.Behind() {
+			result.Problems = append(result.Problems, errSchemaBehind.Error())
+		}
+
+		result.OK = len(result.Problems) == 0
+		if !result.OK {
+			t.fail()
+		}
+
+		return result, nil
+	})
+
+	return nil
+}
+
+type migrateResult struct {
+	Uid     string   `json:"uid"`
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Pending []string `json:"pending"`
+	DryRun  bool     `json:"dry_run,omitempty"`
+}
+
+func cmdMigrate(t *tool, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the migrations that would be applied")
+	args = parseFlags(flags, args)
+
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		status, err := syncstorage.CheckMigrations(target.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &migrateResult{
+			Uid:     target.Uid,
+			From:    status.Version,
+			To:      status.Version,
+			Pending: status.Pending,
+			DryRun:  *dryRun,
+		}
+
+		if !status.Behind() || *dryRun {
+			return result, nil
+		}
+
+		// opening a DB applies its pending migrations
+		db, err := syncstorage.NewDB(target.Path, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		if result.To, err = db.SchemaVersion(); err != nil {
+			return nil, err
+		}
+
+		return result, nil
+	})
+
+	return nil
+}
+
+type duResult struct {
+	Uid string `json:"uid"`
+	KB  int64  `json:"kb"` // DB and its write-ahead log
+}
+
+func cmdDu(t *tool, args []string) error {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	top := flags.Int("top", 20, "how many users to show")
+	parseFlags(flags, args)
+
+	targets, err := t.findAll()
+	if err != nil {
+		return err
+	}
+
+	var (
+		lock    sync.Mutex
+		results []duResult
+	)
+
+	// sizes are printed sorted once they are all known
+	t.each(targets, func(target target) (interface{}, error) {
+		var bytes int64
+		for _, f := range []string{target.Path, target.Path + "-wal"} {
+			info, err := os.Stat(f)
+			if err == nil {
+				bytes += info.Size()
+			} else if f == target.Path {
+				return nil, err
+			}
+		}
+
+		lock.Lock()
+		results = append(results, duResult{Uid: target.Uid, KB: bytes / 1024})
+		lock.Unlock()
+		return nil, nil
+	})
+
+	sort.Slice(results, func(i, j int) bool { return results[i].KB > results[j].KB })
+	if *top > 0 && len(results) > *top {
+		results = results[:*top]
+	}
+
+	for _, result := range results {
+		t.print(result)
+	}
+
+	return nil
+}
+
+type rmResult struct {
+	Uid     string   `json:"uid"`
+	Removed []string `json:"removed"`
+}
+
+func cmdRm(t *tool, args []string) error {
+	if len(args) == 0 {
+		return errors.New("rm needs a uid")
+	}
+
+	targets, err := t.targets(args)
+	if err != nil {
+		return err
+	}
+
+	t.each(targets, func(target target) (interface{}, error) {
+		if _, err := os.Stat(target.Path); os.IsNotExist(err) {
+			return nil, errors.New("DB not found")
+		}
+
+		result := &rmResult{Uid: target.Uid, Removed: []string{}}
+		for _, f := range []string{target.Path, target.Path + "-wal", target.Path + "-shm"} {
+			err := os.Remove(f)
+			if err == nil {
+				result.Removed = append(result.Removed, f)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		return result, nil
+	})
+
+	return nil
+}
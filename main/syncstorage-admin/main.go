@@ -0,0 +1,259 @@
+package main
+
+// syncstorage-admin does maintenance directly on the user databases in
+// DATA_DIR so it does not need the server running. Results are printed
+// as one JSON object per line
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"github.com/mozilla-services/go-syncstorage/web"
+)
+
+var uidRegex = regexp.MustCompile(`^[0-9]+$`)
+
+type command struct {
+	run   func(t *tool, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"inspect": {cmdInspect, "inspect <uid>                     collections, counts, usage and DB size"},
+	"purge":   {cmdPurge, "purge [-batch-ttl s] [uid...]     remove expired BSOs and batches"},
+	"vacuum":  {cmdVacuum, "vacuum [-min-free-kb n] [uid...]  vacuum DBs with at least n KB free"},
+	"verify":  {cmdVerify, "verify [uid...]                   integrity check and schema version"},
+	"migrate": {cmdMigrate, "migrate [-dry-run] [uid...]       apply schema upgrades"},
+	"du":      {cmdDu, "du [-top n]                       the largest users"},
+	"rm":      {cmdRm, "rm <uid>...                       remove users' DB files"},
+}
+
+func usage() {
+	name := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [-data-dir dir] [-workers n] <command> [args]\n\n", name)
+	fmt.Fprintln(os.Stderr, "Commands, without uids they work on every DB in the data dir:")
+	for _, name := range []string{"inspect", "purge", "vacuum", "verify", "migrate", "du", "rm"} {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nThe server should not be running while DBs are changed")
+	os.Exit(2)
+}
+
+func main() {
+	flags := flag.NewFlagSet("syncstorage-admin", flag.ExitOnError)
+	flags.Usage = usage
+	dataDir := flags.String("data-dir", os.Getenv("DATA_DIR"), "the server's DATA_DIR")
+	workers := flags.Int("workers", runtime.NumCPU(), "DBs worked on at the same time")
+	flags.Parse(os.Args[1:])
+
+	// the syncstorage package only logs what we report anyways
+	log.SetLevel(log.ErrorLevel)
+
+	args := flags.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+	}
+
+	if *dataDir == "" {
+		errorAndExit("-data-dir or DATA_DIR is required")
+	}
+
+	t := newTool(args[0], *dataDir, *workers, os.Stdout)
+	if err := cmd.run(t, args[1:]); err != nil {
+		errorAndExit("%s", err.Error())
+	}
+	t.printSummary()
+
+	if t.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func errorAndExit(format string, vals ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, vals...)
+	fmt.Fprintln(os.Stderr)
+	os.Exit(1)
+}
+
+// target is a user's DB
+type target struct {
+	Uid  string
+	Path string
+}
+
+// errorResult is printed for a DB the command failed on
+type errorResult struct {
+	Uid string `json:"uid"`
+	Err string `json:"err"`
+}
+
+type summary struct {
+	Command string `json:"command"`
+	DBs     int    `json:"dbs"`
+	Errors  int    `json:"errors"`
+	T       int64  `json:"t"` // milliseconds
+}
+
+type tool struct {
+	command string
+	dataDir string
+	workers int
+	start   time.Time
+
+	sync.Mutex
+	out    *json.Encoder
+	dbs    int
+	failed int
+}
+
+func newTool(command, dataDir string, workers int, out io.Writer) *tool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &tool{
+		command: command,
+		dataDir: dataDir,
+		workers: workers,
+		start:   time.Now(),
+		out:     json.NewEncoder(out),
+	}
+}
+
+// print writes a result as a line of JSON
+func (t *tool) print(v interface{}) {
+	t.Lock()
+	defer t.Unlock()
+	t.out.Encode(v)
+}
+
+// dbPath is where the server keeps uid's DB, see web.TwoLevelPath
+func (t *tool) dbPath(uid string) string {
+	parts := append([]string{t.dataDir}, web.TwoLevelPath(uid)...)
+	return filepath.Join(append(parts, uid+".db")...)
+}
+
+// targets returns the DBs for uids, or every DB in the data dir when
+// there are none
+func (t *tool) targets(uids []string) ([]target, error) {
+	if len(uids) == 0 {
+		return t.findAll()
+	}
+
+	targets := make([]target, 0, len(uids))
+	for _, uid := range uids {
+		if !uidRegex.MatchString(uid) {
+			return nil, errors.Errorf("Invalid uid: %s", uid)
+		}
+		targets = append(targets, target{Uid: uid, Path: t.dbPath(uid)})
+	}
+
+	return targets, nil
+}
+
+// findAll walks the data dir for user DBs
+func (t *tool) findAll() ([]target, error) {
+	var targets []target
+
+	err := filepath.Walk(t.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, ".db") {
+			return nil
+		}
+
+		uid := strings.TrimSuffix(filepath.Base(path), ".db")
+		if uidRegex.MatchString(uid) {
+			targets = append(targets, target{Uid: uid, Path: path})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not find DBs")
+	}
+
+	return targets, nil
+}
+
+// each runs fn on the targets with t.workers at the same time. What fn
+// returns is printed unless it is nil
+func (t *tool) each(targets []target, fn func(target) (interface{}, error)) {
+	work := make(chan target)
+	var wg sync.WaitGroup
+	for i := 0; i < t.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range work {
+				t.do(target, fn)
+			}
+		}()
+	}
+
+	for _, target := range targets {
+		work <- target
+	}
+	close(work)
+	wg.Wait()
+
+	t.Lock()
+	t.dbs += len(targets)
+	t.Unlock()
+}
+
+// do runs fn on a single target and prints the result
+func (t *tool) do(target target, fn func(target) (interface{}, error)) {
+	result, err := fn(target)
+	if err != nil {
+		t.fail()
+		t.print(errorResult{Uid: target.Uid, Err: err.Error()})
+		return
+	}
+
+	if result != nil {
+		t.print(result)
+	}
+}
+
+// fail counts a DB the command failed on
+func (t *tool) fail() {
+	t.Lock()
+	defer t.Unlock()
+	t.failed++
+}
+
+// printSummary prints the totals, it is the last line of output
+func (t *tool) printSummary() {
+	t.Lock()
+	s := summary{
+		Command: t.command,
+		DBs:     t.dbs,
+		Errors:  t.failed,
+		T:       int64(time.Since(t.start) / time.Millisecond),
+	}
+	t.Unlock()
+
+	t.print(s)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDataDir makes a DATA_DIR with a DB for each uid
+func testDataDir(t *testing.T, uids ...string) string {
+	dir, err := ioutil.TempDir("", "syncstorage-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tool := newTool("test", dir, 1, ioutil.Discard)
+	for _, uid := range uids {
+		path := tool.dbPath(uid)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := syncstorage.NewDB(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.PutBSO(7, "b0", syncstorage.String("hello"), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	return dir
+}
+
+// run runs a command and returns its output, one map per line
+func run(t *testing.T, dir string, cmd func(*tool, []string) error, args ...string) ([]map[string]interface{}, error) {
+	out := new(bytes.Buffer)
+	tool := newTool("test", dir, 2, out)
+	if err := cmd(tool, args); err != nil {
+		return nil, err
+	}
+	tool.printSummary()
+
+	var results []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func TestFindAll(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := testDataDir(t, "1234", "5678", "9")
+	defer os.RemoveAll(dir)
+
+	// not user DBs
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "hawk_nonces.cache"), nil, 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "other.db"), nil, 0644))
+
+	targets, err := newTool("test", dir, 1, ioutil.Discard).findAll()
+	if !assert.NoError(err) || !assert.Len(targets, 3) {
+		return
+	}
+
+	for _, target := range targets {
+		assert.Equal(newTool("test", dir, 1, nil).dbPath(target.Uid), target.Path)
+	}
+
+	_, err = newTool("test", dir, 1, nil).targets([]string{"../1234"})
+	assert.Error(err)
+}
+
+func TestInspect(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := testDataDir(t, "1234")
+	defer os.RemoveAll(dir)
+
+	results, err := run(t, dir, cmdInspect, "1234", "4321")
+	if !assert.NoError(err) || !assert.Len(results, 3) {
+		return
+	}
+
+	for _, result := range results[:2] {
+		if result["uid"] == "1234" {
+			assert.Equal(map[string]interface{}{"bookmarks": float64(1)}, result["counts"])
+			assert.Equal(float64(syncstorage.LatestSchemaVersion()), result["schema_version"])
+		} else {
+			assert.Equal("DB not found", result["err"])
+		}
+	}
+
+	assert.Equal(float64(2), results[2]["dbs"])
+	assert.Equal(float64(1), results[2]["errors"])
+
+	// nothing is created for missing users
+	_, err = os.Stat(newTool("test", dir, 1, nil).dbPath("4321"))
+	assert.True(os.IsNotExist(err))
+
+	_, err = run(t, dir, cmdInspect)
+	assert.Error(err)
+}
+
+func TestPurgeAndVacuum(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := testDataDir(t, "1234", "5678")
+	defer os.RemoveAll(dir)
+
+	path := newTool("test", dir, 1, nil).dbPath("1234")
+	db, err := syncstorage.NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	payload := strings.Repeat("x", 100000)
+	for _, id := range []string{"e0", "e1", "e2"} {
+		_, err = db.PutBSO(4, id, &payload, nil, syncstorage.Int(1))
+		assert.NoError(err)
+	}
+	db.Checkpoint()
+	db.Close()
+
+	// TTLs are in milliseconds, and each change gets a timestamp
+	// at least 10ms after the last
+	time.Sleep(100 * time.Millisecond)
+	results, err := run(t, dir, cmdPurge, "-batch-ttl", "0", "1234")
+	if !assert.NoError(err) || !assert.Len(results, 2) {
+		return
+	}
+	assert.Equal(float64(3), results[0]["bsos"])
+
+	results, err = run(t, dir, cmdVacuum, "-min-free-kb", "1")
+	if !assert.NoError(err) || !assert.Len(results, 3) {
+		return
+	}
+
+	for _, result := range results[:2] {
+		if result["uid"] == "1234" {
+			assert.Equal(true, result["vacuumed"])
+			assert.True(result["after_kb"].(float64) < result["before_kb"].(float64))
+		} else {
+			assert.Equal(false, result["vacuumed"])
+		}
+	}
+}
+
+func TestVerifyAndMigrate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := testDataDir(t, "1234")
+	defer os.RemoveAll(dir)
+
+	results, err := run(t, dir, cmdVerify)
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(true, results[0]["ok"])
+		assert.Equal(float64(0), results[1]["errors"])
+	}
+
+	// a DB that no migrations have been applied to
+	path := newTool("test", dir, 1, nil).dbPath("5678")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	assert.NoError(ioutil.WriteFile(path, nil, 0644))
+
+	results, err = run(t, dir, cmdMigrate, "-dry-run", "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(float64(0), results[0]["from"])
+		assert.Equal(float64(0), results[0]["to"])
+		assert.Len(results[0]["pending"], syncstorage.LatestSchemaVersion())
+	}
+
+	results, err = run(t, dir, cmdVerify, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(false, results[0]["ok"])
+		assert.Equal(float64(1), results[1]["errors"])
+	}
+
+	// refuses to work on it until migrated
+	results, err = run(t, dir, cmdPurge, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(errSchemaBehind.Error(), results[0]["err"])
+	}
+
+	results, err = run(t, dir, cmdMigrate, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(float64(syncstorage.LatestSchemaVersion()), results[0]["to"])
+	}
+
+	results, err = run(t, dir, cmdVerify, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal(true, results[0]["ok"])
+	}
+}
+
+func TestDuAndRm(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := testDataDir(t, "1234", "5678", "9999")
+	defer os.RemoveAll(dir)
+
+	path := newTool("test", dir, 1, nil).dbPath("5678")
+	db, err := syncstorage.NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	payload := strings.Repeat("x", 500000)
+	_, err = db.PutBSO(4, "big", &payload, nil, nil)
+	assert.NoError(err)
+	db.Close()
+
+	results, err := run(t, dir, cmdDu, "-top", "2")
+	if assert.NoError(err) && assert.Len(results, 3) {
+		assert.Equal("5678", results[0]["uid"])
+		assert.True(results[0]["kb"].(float64) > 500)
+		assert.Equal(float64(3), results[2]["dbs"])
+	}
+
+	results, err = run(t, dir, cmdRm, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Contains(results[0]["removed"], path)
+	}
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	results, err = run(t, dir, cmdRm, "5678")
+	if assert.NoError(err) && assert.Len(results, 2) {
+		assert.Equal("DB not found", results[0]["err"])
+	}
+
+	_, err = run(t, dir, cmdRm)
+	assert.Error(err)
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
 	"go.mozilla.org/hawk"
@@ -45,32 +48,164 @@ func main() {
 	syncLimitConfig.MaxBatchTTL = config.Limit.MaxBatchTTL * 1000
 	syncLimitConfig.MaxRecordPayloadBytes = config.Limit.MaxRecordPayloadBytes
 
+	dbConfig := &syncstorage.Config{
+		CacheSize:  config.Sqlite.CacheSize,
+		QuotaBytes: config.Limit.QuotaBytes,
+	}
+
 	// The base functionality is the sync 1.5 api
 	poolHandler := web.NewSyncPoolHandler(&web.SyncPoolConfig{
 		Basepath:      config.DataDir,
 		NumPools:      config.Pool.Num,
+		TTL:           time.Duration(config.Pool.TTL) * time.Second,
 		MaxPoolSize:   config.Pool.MaxSize,
 		VacuumKB:      config.Pool.VacuumKB,
-		DBConfig:      &syncstorage.Config{config.Sqlite.CacheSize},
+		DBConfig:      dbConfig,
 		PurgeMinHours: config.Pool.PurgeMinHours,
 		PurgeMaxHours: config.Pool.PurgeMaxHours,
+
+		MaintenanceWorkers:    config.Pool.MaintenanceWorkers,
+		MaintenanceQueueSize:  config.Pool.MaintenanceQueueSize,
+		MaintenanceIOBudgetKB: config.Pool.MaintenanceIOBudgetKB,
 	}, syncLimitConfig)
 
 	var router http.Handler
 	router = poolHandler
 
 	if config.InfoCacheSize > 0 {
-		router = web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		cacheHandler := web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		poolHandler.Cache = cacheHandler
+		router = cacheHandler
+	}
+
+	// Tidy up users that do not make requests anymore
+	var sweeper *web.Sweeper
+	if config.Sweep.Rate > 0 && config.DataDir != ":memory:" {
+		var err error
+		sweeper, err = web.NewSweeper(poolHandler, web.SweeperConfig{
+			Rate:         config.Sweep.Rate,
+			IOBudgetKB:   config.Sweep.IOBudgetKB,
+			VacuumKB:     config.Sweep.VacuumKB,
+			CursorFile:   filepath.Join(config.DataDir, "sweeper.cursor"),
+			PassInterval: time.Duration(config.Sweep.PassInterval) * time.Second,
+			RetainFor:    time.Duration(config.Retention.Days) * 24 * time.Hour,
+			RetainDryRun: config.Retention.DryRun,
+			ArchiveDir:   config.Retention.ArchiveDir,
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		sweeper.Start()
+	}
+
+	// Stop accepting writes before DATA_DIR is full
+	if config.DataDir != ":memory:" {
+		diskWatchdog := web.NewDiskWatchdogHandler(router, web.DiskWatchdogConfig{
+			Dir:            config.DataDir,
+			Interval:       time.Duration(config.Disk.Interval) * time.Second,
+			SoftKB:         config.Disk.SoftKB,
+			HardKB:         config.Disk.HardKB,
+			SoftInodes:     config.Disk.SoftInodes,
+			HardInodes:     config.Disk.HardInodes,
+			BackoffSeconds: config.Disk.Backoff,
+		})
+		defer diskWatchdog.Stop()
+		router = diskWatchdog
 	}
 
 	// legacy weave hacks
 	router = web.NewWeaveHandler(router)
 
+	// Keep one user's clients from starving the others
+	if config.RateLimit.UserReadRate > 0 || config.RateLimit.UserWriteRate > 0 {
+		router = web.NewUserRateLimitHandler(router, web.UserRateLimitConfig{
+			ReadRate:   config.RateLimit.UserReadRate,
+			ReadBurst:  config.RateLimit.UserReadBurst,
+			WriteRate:  config.RateLimit.UserWriteRate,
+			WriteBurst: config.RateLimit.UserWriteBurst,
+		})
+	}
+
 	// All sync 1.5 access requires Hawk Authorization
-	router = web.NewHawkHandler(router, config.Secrets)
+	hawkHandler := web.NewHawkHandler(router, config.Secrets)
+
+	// Rotate secrets without a restart
+	if config.SecretsFile != "" {
+		secrets, err := web.LoadSecretsFile(config.SecretsFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		hawkHandler.SetSecrets(secrets)
+
+		secretsWatcher := web.NewSecretsWatcher(config.SecretsFile,
+			time.Duration(config.SecretsFileInterval)*time.Second, hawkHandler.SetSecrets)
+		defer secretsWatcher.Stop()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				secretsWatcher.Reload()
+			}
+		}()
+	}
+	hawkHandler.ExpiryGrace = time.Second * time.Duration(config.HawkTokenExpiryGrace)
+	hawkHandler.ServerAuthorization = config.HawkServerAuthorization
+	hawkHandler.PublicURLs = config.PublicURL
+	hawkHandler.EnforcePublicURL = config.PublicURLEnforce
+
+	nonceConfig := web.NonceCacheConfig{MaxEntries: config.HawkNonceMaxEntries}
+	if config.HawkNoncePersist && config.DataDir != ":memory:" {
+		nonceConfig.File = filepath.Join(config.DataDir, "hawk_nonces.cache")
+		nonceConfig.SaveInterval = time.Duration(config.HawkNonceSaveInterval) * time.Second
+	}
+	hawkHandler.Nonces = web.NewNonceCache(nonceConfig)
+	defer hawkHandler.Nonces.Close()
+
+	if config.HawkTokenCacheSize > 0 {
+		hawkHandler.Tokens = web.NewTokenCache(config.HawkTokenCacheSize)
+	} else {
+		hawkHandler.Tokens = nil
+	}
+	router = hawkHandler
+
+	// Shed load before doing any work on a request
+	loadGovernor := web.NewLoadGovernor(router, web.LoadGovernorConfig{
+		SoftInFlight:      config.Load.SoftInFlight,
+		HardInFlight:      config.Load.HardInFlight,
+		SoftPoolWait:      time.Duration(config.Load.SoftPoolWaitMS) * time.Millisecond,
+		HardPoolWait:      time.Duration(config.Load.HardPoolWaitMS) * time.Millisecond,
+		SoftDB:            time.Duration(config.Load.SoftDBLatencyMS) * time.Millisecond,
+		HardDB:            time.Duration(config.Load.HardDBLatencyMS) * time.Millisecond,
+		Window:            time.Duration(config.Load.Window) * time.Second,
+		BackoffSeconds:    config.Load.Backoff,
+		RetryAfterSeconds: config.Load.RetryAfter,
+	})
+	poolHandler.Load = loadGovernor
+	router = loadGovernor
+
+	// Turn away floods from a single address before they cost anything
+	if config.RateLimit.IPRate > 0 {
+		router = web.NewIPRateLimitHandler(router, web.IPRateLimitConfig{
+			Rate:              config.RateLimit.IPRate,
+			Burst:             config.RateLimit.IPBurst,
+			TrustForwardedFor: config.RateLimit.IPTrustForwardedFor,
+		})
+	}
+
+	// Reject large request bodies before anything buffers them
+	router = web.NewRequestLimitHandler(router, syncLimitConfig.MaxRequestBytes)
 
 	// Serve non sync 1.5 endpoints
-	router = web.NewInfoHandler(router)
+	infoHandler := web.NewInfoHandler(router)
+	infoHandler.DataDir = config.DataDir
+	infoHandler.MinFreeKB = config.Heartbeat.MinFreeKB
+	infoHandler.PoolStats = poolHandler.Stats
+	infoHandler.MaxConflictRate = config.Heartbeat.MaxConflictRate
+	router = infoHandler
+
+	// Count and time all requests, see /__metrics__
+	router = web.NewMetricsHandler(router)
 
 	// Log all the things
 	if config.Log.DisableHTTP != true {
@@ -84,9 +219,71 @@ func main() {
 		router = logHandler
 	}
 
-	if config.EnablePprof {
-		log.Info("Enabling pprof profile at /debug/pprof/")
-		router = web.NewPprofHandler(router)
+	// Operator endpoints get their own listener so they are not
+	// reachable by sync clients
+	var adminServer *http.Server
+	if config.AdminPort > 0 {
+		var auditLog *log.Logger
+		if config.AdminAuditLog != "" {
+			f, err := os.OpenFile(config.AdminAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			defer f.Close()
+
+			auditLog = log.New()
+			auditLog.Out = f
+			auditLog.Formatter = &log.JSONFormatter{}
+		}
+
+		adminHandler := web.NewAdminHandler(web.AdminConfig{
+			Token:     config.AdminToken,
+			Pprof:     config.EnablePprof,
+			PoolStats: poolHandler.Stats,
+			Users:     poolHandler,
+			AuditLog:  auditLog,
+		})
+
+		var adminRouter http.Handler = adminHandler
+		if config.Log.DisableHTTP != true {
+			adminRouter = web.NewLogHandler(log.StandardLogger(), adminRouter)
+		}
+
+		adminServer = &http.Server{
+			Addr:    config.AdminHost + ":" + strconv.Itoa(config.AdminPort),
+			Handler: adminRouter,
+		}
+
+		go func() {
+			log.WithField("addr", adminServer.Addr).Info("Admin HTTP Listening at " + adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+
+		if config.EnablePprof {
+			log.Info("Enabling pprof profile at /debug/pprof/ on the admin listener")
+		}
+	} else if config.EnablePprof {
+		log.Warn("ENABLE_PPROF needs ADMIN_PORT, pprof is not enabled")
+	}
+
+	// Push metrics to statsd as well as serving them
+	if config.Statsd.Addr != "" {
+		statsd, err := web.NewStatsd(web.StatsdConfig{
+			Addr:          config.Statsd.Addr,
+			Prefix:        config.Statsd.Prefix,
+			Tags:          config.Statsd.Tags,
+			DogStatsD:     config.Statsd.Dogstatsd,
+			FlushInterval: time.Duration(config.Statsd.FlushInterval) * time.Second,
+			SampleRate:    config.Statsd.SampleRate,
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		web.DefaultMetrics.SetSink(statsd)
+		defer statsd.Close()
 	}
 
 	listenOn := config.Host + ":" + strconv.Itoa(config.Port)
@@ -120,6 +317,10 @@ func main() {
 		"POOL_VACUUM_KB":                 config.Pool.VacuumKB,
 		"POOL_PURGE_MIN_HOURS":           config.Pool.PurgeMinHours,
 		"POOL_PURGE_MAX_HOURS":           config.Pool.PurgeMaxHours,
+		"POOL_TTL":                       config.Pool.TTL,
+		"POOL_MAINTENANCE_WORKERS":       config.Pool.MaintenanceWorkers,
+		"POOL_MAINTENANCE_QUEUE_SIZE":    config.Pool.MaintenanceQueueSize,
+		"POOL_MAINTENANCE_IO_BUDGET_KB":  config.Pool.MaintenanceIOBudgetKB,
 		"LIMIT_MAX_POST_RECORDS":         syncLimitConfig.MaxPOSTRecords,
 		"LIMIT_MAX_POST_BYTES":           syncLimitConfig.MaxPOSTBytes,
 		"LIMIT_MAX_TOTAL_RECORDS":        syncLimitConfig.MaxTotalRecords,
@@ -127,9 +328,36 @@ func main() {
 		"LIMIT_MAX_REQUEST_BYTES":        syncLimitConfig.MaxRequestBytes,
 		"LIMIT_MAX_BATCH_TTL":            fmt.Sprintf("%d seconds", syncLimitConfig.MaxBatchTTL/1000),
 		"LIMIT_MAX_RECORD_PAYLOAD_BYTES": syncLimitConfig.MaxRecordPayloadBytes,
+		"LIMIT_QUOTA_BYTES":              config.Limit.QuotaBytes,
 		"SQLITE3_CACHE_SIZE":             config.Sqlite.CacheSize,
 		"INFO_CACHE_SIZE":                config.InfoCacheSize,
 		"HAWK_TIMESTAMP_MAX_SKEW":        hawk.MaxTimestampSkew.Seconds(),
+		"HAWK_TOKEN_EXPIRY_GRACE":        config.HawkTokenExpiryGrace,
+		"HAWK_SERVER_AUTHORIZATION":      config.HawkServerAuthorization,
+		"HAWK_NONCE_MAX_ENTRIES":         config.HawkNonceMaxEntries,
+		"HAWK_NONCE_PERSIST":             config.HawkNoncePersist,
+		"HAWK_TOKEN_CACHE_SIZE":          config.HawkTokenCacheSize,
+		"SECRETS_FILE":                   config.SecretsFile,
+		"PUBLIC_URL":                     config.PublicURL,
+		"PUBLIC_URL_ENFORCE":             config.PublicURLEnforce,
+		"ADMIN_HOST":                     config.AdminHost,
+		"ADMIN_PORT":                     config.AdminPort,
+		"ADMIN_AUDIT_LOG":                config.AdminAuditLog,
+		"HEARTBEAT_MIN_FREE_KB":          config.Heartbeat.MinFreeKB,
+		"LOAD_SOFT_IN_FLIGHT":            config.Load.SoftInFlight,
+		"LOAD_HARD_IN_FLIGHT":            config.Load.HardInFlight,
+		"DISK_SOFT_KB":                   config.Disk.SoftKB,
+		"DISK_HARD_KB":                   config.Disk.HardKB,
+		"RATE_LIMIT_USER_READ_RATE":      config.RateLimit.UserReadRate,
+		"RATE_LIMIT_USER_WRITE_RATE":     config.RateLimit.UserWriteRate,
+		"RATE_LIMIT_IP_RATE":             config.RateLimit.IPRate,
+		"SWEEP_RATE":                     config.Sweep.Rate,
+		"SWEEP_IO_BUDGET_KB":             config.Sweep.IOBudgetKB,
+		"RETENTION_DAYS":                 config.Retention.Days,
+		"RETENTION_DRY_RUN":              config.Retention.DryRun,
+		"RETENTION_ARCHIVE_DIR":          config.Retention.ArchiveDir,
+		"STATSD_ADDR":                    config.Statsd.Addr,
+		"STATSD_SAMPLE_RATE":             config.Statsd.SampleRate,
 	}).Info("HTTP Listening at " + listenOn)
 
 	err := httpdown.ListenAndServe(server, hd)
@@ -137,5 +365,13 @@ func main() {
 		log.Error(err.Error())
 	}
 
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+
 	poolHandler.StopHTTP()
 }
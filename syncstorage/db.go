@@ -3,6 +3,8 @@ package syncstorage
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +23,7 @@ var (
 	ErrNotFound       = errors.New("Not Found")
 	ErrNotImplemented = errors.New("Not Implemented")
 	ErrNothingToDo    = errors.New("Nothing to do")
+	ErrOverQuota      = errors.New("Over Quota")
 
 	ErrInvalidBSOId          = errors.New("Invalid BSO Id")
 	ErrInvalidCollectionId   = errors.New("Invalid Collection Id")
@@ -54,6 +57,18 @@ const (
 	DEFAULT_BSO_TTL = 100 * 365 * 24 * 60 * 60 * 1000
 
 	STORAGE_LAST_MODIFIED = "Storage Last Modified"
+
+	// read only connections kept open per DB
+	maxReadConns = 4
+
+	// per user override of Config.QuotaBytes
+	STORAGE_QUOTA = "Storage Quota"
+
+	// sum of BSO payload sizes, kept up to date by triggers
+	STORAGE_USED = "Storage Used"
+
+	// the last modified timestamp handed out by nextModified
+	STORAGE_CLOCK = "Storage Clock"
 )
 
 type CollectionInfo struct {
@@ -126,11 +141,25 @@ type DB struct {
 	// sqlite database path
 	Path string
 
-	db *sql.DB
+	// db is for writes. rdb is a read only connection pool so reads
+	// can happen at the same time. For :memory: databases they are the
+	// same as a new connection would see a different database
+	db  *sql.DB
+	rdb *sql.DB
+
+	// default storage quota in bytes, 0 is unlimited
+	quotaBytes int
+
+	// last modified timestamp handed out, 0 until loaded
+	clock int
 }
 
 type Config struct {
 	CacheSize int
+
+	// QuotaBytes is the default storage quota for a user,
+	// 0 for unlimited
+	QuotaBytes int
 }
 
 func (d *DB) OpenWithConfig(conf *Config) (err error) {
@@ -140,6 +169,9 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 		return
 	}
 
+	// only one writer at a time
+	d.db.SetMaxOpenConns(1)
+
 	// settings to apply to the database
 
 	pragmas := []string{
@@ -155,6 +187,7 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 		}
 
 		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size=%d;", conf.CacheSize))
+		d.quotaBytes = conf.QuotaBytes
 	}
 
 	for _, p := range pragmas {
@@ -163,67 +196,30 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 		}
 	}
 
-	var schemaVersion int
-	if err := d.db.QueryRow("PRAGMA schema_version;").Scan(&schemaVersion); err != nil {
-		return err
+	// bring the schema up to date
+	if err = d.migrate(); err != nil {
+		return
 	}
 
-	// Initialize a new database with all the current schemas concatenated together
-	if schemaVersion == 0 {
-		tx, err := d.db.Begin()
-		if err != nil {
-			return err
-		}
-
-		if _, err := tx.Exec(SCHEMA_0 + SCHEMA_1); err != nil {
-			if rollbackErr := tx.Rollback(); rollbackErr != nil {
-				return rollbackErr
-			} else {
-				return err
-			}
-		} else {
-			if err := tx.Commit(); err != nil {
-				return err
-			}
-		}
-	} else {
-		// Migrate schema to the latest version. At the time of this
-		// comment there is only SCHEMA_1. Considering the rate of
-		// schema change, we can probably just keep it simple yet
-		// slightly more verbose using, `if userVersion == ...` statements
-		var userVersion int
-		if err := d.db.QueryRow("PRAGMA user_version;").Scan(&userVersion); err != nil {
-			return err
-		}
-
-		// SCHEMA_0 did not alter PRAGMA user_version so it defaults to 0
-		if userVersion == 0 {
-			tx, err := d.db.Begin()
-			if err != nil {
-				return err
-			}
-
-			if _, err := tx.Exec(SCHEMA_1); err != nil {
-				if rollbackErr := tx.Rollback(); rollbackErr != nil {
-					return rollbackErr
-				} else {
-					return err
-				}
-			} else {
-				if err := tx.Commit(); err != nil {
-					return err
-				}
-			}
-		}
-
-		// SCHEMA_1 sets PRAGMA user_version to 2 so the count
-		// of schemas applied is caught up and correct.
-		// putting this here for posterity and next schema upgrade
+	if d.Path == ":memory:" {
+		d.rdb = d.db
+		return
+	}
 
-		// if userVersion == 2 { ... }
+	d.rdb, err = sql.Open("sqlite3", readOnlyDSN(d.Path))
+	if err != nil {
+		return errors.Wrap(err, "Could not open read only connection")
 	}
 
-	return nil
+	d.rdb.SetMaxOpenConns(maxReadConns)
+	d.rdb.SetMaxIdleConns(1)
+	return
+}
+
+// readOnlyDSN turns path into a sqlite URI that opens the database read only
+func readOnlyDSN(path string) string {
+	u := &url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	return u.String()
 }
 
 func (d *DB) Open() (err error) {
@@ -231,6 +227,10 @@ func (d *DB) Open() (err error) {
 }
 
 func (d *DB) Close() {
+	if d.rdb != nil && d.rdb != d.db {
+		d.rdb.Close()
+	}
+
 	if d.db != nil {
 		dbDebug("Closing: %s", d.Path)
 		d.db.Close()
@@ -248,17 +248,18 @@ func NewDB(path string, conf *Config) (*DB, error) {
 }
 
 /*
-  The public functions in *DB control locking of the main object
-  so we can only have one read or write at a time. The actual database
-  work is handled by private functions.
+  The public functions in *DB control locking of the main object.
+  Reads take a read lock and use the read only connections so they can
+  happen at the same time. Writes take the exclusive lock. The actual
+  database work is handled by private functions.
 */
 
 // LastModified returns the top level last modified timestamp
 func (d *DB) LastModified() (int, error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
-	lastMod, err := getKey(d.db, STORAGE_LAST_MODIFIED)
+	lastMod, err := getKey(d.rdb, STORAGE_LAST_MODIFIED)
 	if lastMod == "" || err != nil {
 		return 0, err
 	}
@@ -272,8 +273,8 @@ func (d *DB) LastModified() (int, error) {
 }
 
 func (d *DB) GetCollectionId(name string) (id int, err error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	// return common collection id without touching the DB
 	// ew? yes, but it'll compile nice and fast
@@ -311,7 +312,7 @@ func (d *DB) GetCollectionId(name string) (id int, err error) {
 		return
 	}
 
-	err = d.db.QueryRow("SELECT Id FROM Collections where Name=?", name).Scan(&id)
+	err = d.rdb.QueryRow("SELECT Id FROM Collections where Name=?", name).Scan(&id)
 
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
@@ -321,9 +322,9 @@ func (d *DB) GetCollectionId(name string) (id int, err error) {
 }
 
 func (d *DB) GetCollectionModified(cId int) (modified int, err error) {
-	d.Lock()
-	defer d.Unlock()
-	err = d.db.QueryRow("SELECT modified FROM Collections where Id=?", cId).Scan(&modified)
+	d.RLock()
+	defer d.RUnlock()
+	err = d.rdb.QueryRow("SELECT modified FROM Collections where Id=?", cId).Scan(&modified)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
@@ -345,7 +346,12 @@ func (d *DB) CreateCollection(name string) (cId int, err error) {
 		return 0, err
 	}
 
-	modified := Now()
+	modified, err := d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
 	dml := "INSERT INTO Collections (Name, Modified) VALUES (?,?)"
 
 	results, err := tx.Exec(dml, name, modified)
@@ -360,7 +366,9 @@ func (d *DB) CreateCollection(name string) (cId int, err error) {
 		return 0, err
 	}
 
-	tx.Commit()
+	if err := d.commit(tx, modified); err != nil {
+		return 0, err
+	}
 	return int(cId64), nil
 }
 
@@ -384,30 +392,61 @@ func (d *DB) DeleteCollection(cId int) (int, error) {
 		return 0, errors.Wrapf(err, "Failed resetting last modified for collection: %d", cId)
 	}
 
-	modified := Now()
+	modified, err := d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
 	if err := d.touchStorage(tx, modified); err != nil {
 		tx.Rollback()
 		return 0, errors.Wrapf(err, "Failed setting storage timestamp")
 	}
 
-	tx.Commit()
+	if err := d.commit(tx, modified); err != nil {
+		return 0, err
+	}
 	return modified, nil
 }
 
-// DeleteEverything will delete all BSOs, record when everything was deleted
-// and vacuum to free up disk pages.
-func (d *DB) DeleteEverything() (err error) {
+// DeleteEverything will delete all BSOs and record when everything was
+// deleted. It returns the modified timestamp of the storage. The freed
+// disk pages are kept until the database is vacuumed
+func (d *DB) DeleteEverything() (int, error) {
 	d.Lock()
 	defer d.Unlock()
 
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed creating transaction")
+	}
+
+	modified, err := d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
 	// delete all BSO data and keep the other metadata around
 	dml := `
 		DELETE FROM BSO;
 		INSERT OR REPLACE INTO KeyValues (Key, Value) VALUES ("DELETE_EVERYTHING_DATE", ?);
-		VACUUM;
 		`
-	_, err = d.db.Exec(dml, time.Now().Format(time.RFC3339))
-	return
+	if _, err := tx.Exec(dml, time.Now().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return 0, errors.Wrap(err, "Failed deleting everything")
+	}
+
+	if err := d.touchStorage(tx, modified); err != nil {
+		tx.Rollback()
+		return 0, errors.Wrap(err, "Failed setting storage timestamp")
+	}
+
+	if err := d.commit(tx, modified); err != nil {
+		return 0, err
+	}
+
+	return modified, nil
 }
 
 func (d *DB) TouchCollection(cId, modified int) (err error) {
@@ -419,10 +458,10 @@ func (d *DB) TouchCollection(cId, modified int) (err error) {
 
 // InfoCollections create a map of collection names to last modified times
 func (d *DB) InfoCollections() (map[string]int, error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
-	rows, err := d.db.Query("SELECT Name,Modified FROM Collections WHERE Modified != 0")
+	rows, err := d.rdb.Query("SELECT Name,Modified FROM Collections WHERE Modified != 0")
 	if err != nil {
 		return nil, err
 	}
@@ -442,41 +481,47 @@ func (d *DB) InfoCollections() (map[string]int, error) {
 	return results, nil
 }
 
+// InfoQuota returns the bytes used and the quota for the user. A
+// quota of 0 means there is no limit
 func (d *DB) InfoQuota() (used, quota int, err error) {
-	d.Lock()
-	defer d.Unlock()
-
-	var u sql.NullInt64
+	d.RLock()
+	defer d.RUnlock()
 
-	query := `SELECT sum(PayloadSize) used
-			  FROM BSO`
-
-	err = d.db.QueryRow(query).Scan(&u)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, 0, nil
-		}
-
-		return
+	if used, err = d.usedBytes(d.rdb); err != nil {
+		return 0, 0, err
 	}
 
-	if u.Valid {
-		used = int(u.Int64)
-		return
-	} else {
-		return 0, 0, nil
+	if quota, err = d.getQuota(d.rdb); err != nil {
+		return 0, 0, err
 	}
+
+	return
 }
 
-func (d *DB) InfoCollectionUsage() (map[string]int, error) {
+// Quota returns the storage quota in bytes for the user, 0 for unlimited
+func (d *DB) Quota() (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return d.getQuota(d.rdb)
+}
+
+// SetQuota overrides the default quota for the user. Use 0 to
+// remove the limit
+func (d *DB) SetQuota(quotaBytes int) error {
 	d.Lock()
 	defer d.Unlock()
+	return setKey(d.db, STORAGE_QUOTA, strconv.Itoa(quotaBytes))
+}
+
+func (d *DB) InfoCollectionUsage() (map[string]int, error) {
+	d.RLock()
+	defer d.RUnlock()
 
 	query := `SELECT c.Name,sum(b.PayloadSize) used
 			  FROM BSO b, Collections C
 			  WHERE b.CollectionId=c.Id GROUP BY b.CollectionId`
 
-	rows, err := d.db.Query(query)
+	rows, err := d.rdb.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -497,14 +542,14 @@ func (d *DB) InfoCollectionUsage() (map[string]int, error) {
 }
 
 func (d *DB) InfoCollectionCounts() (map[string]int, error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	query := `SELECT c.Name, count(b.Id) count
 			  FROM BSO b, Collections C
 			  WHERE b.CollectionId=c.Id GROUP BY b.CollectionId`
 
-	rows, err := d.db.Query(query)
+	rows, err := d.rdb.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -549,7 +594,13 @@ func (d *DB) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
 		return nil, err
 	}
 
-	modified := Now() // same modified timestamp for all INSERT/UPDATES
+	// same modified timestamp for all INSERT/UPDATES
+	modified, err := d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
 	results := NewPostResults(modified)
 
 	for _, data := range input {
@@ -562,6 +613,11 @@ func (d *DB) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
 		}
 	}
 
+	if err := d.checkQuota(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
 	// update the collection
 	err = d.touchCollectionAndStorage(tx, cId, modified)
 	if err != nil {
@@ -569,7 +625,9 @@ func (d *DB) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
 		return nil, err
 	}
 
-	tx.Commit()
+	if err := d.commit(tx, modified); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
@@ -583,7 +641,12 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 		return
 	}
 
-	modified = Now()
+	modified, err = d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
 	err = d.putBSO(tx, cId, bId, modified, payload, sortIndex, ttl)
 
 	if err != nil {
@@ -591,6 +654,11 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 		return
 	}
 
+	if err = d.checkQuota(tx); err != nil {
+		tx.Rollback()
+		return
+	}
+
 	// update the collection
 	err = d.touchCollectionAndStorage(tx, cId, modified)
 	if err != nil {
@@ -598,15 +666,17 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 		return
 	}
 
-	tx.Commit()
+	if err := d.commit(tx, modified); err != nil {
+		return 0, err
+	}
 	return
 }
 
 func (d *DB) GetBSO(cId int, bId string) (b *BSO, err error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
-	b, err = d.getBSO(d.db, cId, bId)
+	b, err = d.getBSO(d.rdb, cId, bId)
 
 	return
 }
@@ -621,18 +691,18 @@ func (d *DB) GetBSOs(
 	limit int,
 	offset int) (r *GetResults, err error) {
 
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
-	r, err = d.getBSOs(d.db, cId, ids, older, newer, sort, limit, offset)
+	r, err = d.getBSOs(d.rdb, cId, ids, older, newer, sort, limit, offset)
 
 	return
 }
 
 func (d *DB) GetBSOModified(cId int, bId string) (modified int, err error) {
-	d.Lock()
-	defer d.Unlock()
-	err = d.db.QueryRow(`SELECT modified
+	d.RLock()
+	defer d.RUnlock()
+	err = d.rdb.QueryRow(`SELECT modified
 						 FROM BSO
 						 WHERE CollectionId=? and Id=? and TTL > ?`, cId, bId, Now()).Scan(&modified)
 
@@ -687,7 +757,11 @@ func (d *DB) DeleteBSOs(cId int, bIds ...string) (modified int, err error) {
 		return
 	}
 
-	modified = Now()
+	modified, err = d.nextModified(tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
 
 	// update the collection
 	err = d.touchCollectionAndStorage(tx, cId, modified)
@@ -696,7 +770,9 @@ func (d *DB) DeleteBSOs(cId int, bIds ...string) (modified int, err error) {
 		return
 	}
 
-	tx.Commit()
+	if err := d.commit(tx, modified); err != nil {
+		return 0, err
+	}
 	return
 }
 
@@ -717,22 +793,22 @@ func (d *DB) PurgeExpired() (removed int, err error) {
 }
 
 func (d *DB) Usage() (stats *DBPageStats, err error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	stats = &DBPageStats{}
 
-	err = d.db.QueryRow("PRAGMA page_count").Scan(&stats.Total)
+	err = d.rdb.QueryRow("PRAGMA page_count").Scan(&stats.Total)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.db.QueryRow("PRAGMA freelist_count").Scan(&stats.Free)
+	err = d.rdb.QueryRow("PRAGMA freelist_count").Scan(&stats.Free)
 	if err != nil {
 		return nil, err
 	}
 
-	err = d.db.QueryRow("PRAGMA page_size").Scan(&stats.Size)
+	err = d.rdb.QueryRow("PRAGMA page_size").Scan(&stats.Size)
 	if err != nil {
 		return nil, err
 	}
@@ -767,9 +843,9 @@ func (d *DB) SetKey(key, value string) error {
 
 // GetKey returns a previous key in the database
 func (d *DB) GetKey(key string) (string, error) {
-	d.Lock()
-	defer d.Unlock()
-	return getKey(d.db, key)
+	d.RLock()
+	defer d.RUnlock()
+	return getKey(d.rdb, key)
 }
 
 func setKey(tx dbTx, key, value string) (err error) {
@@ -786,6 +862,15 @@ func getKey(tx dbTx, key string) (value string, err error) {
 	return
 }
 
+// Checkpoint copies everything in the write-ahead log back into the
+// database file and truncates the log
+func (d *DB) Checkpoint() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	_, err = d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+	return
+}
+
 // Vacuum recovers free disk pages and reduces fragmentation of the
 // data on disk. This could take a long time depending on the size
 // of the database
@@ -796,6 +881,172 @@ func (d *DB) Vacuum() (err error) {
 	return
 }
 
+// IntegrityCheck runs PRAGMA integrity_check on the database at path
+// without changing it. It returns the problems found, none when the
+// database is ok
+func IntegrityCheck(path string) ([]string, error) {
+	// sql.Open would create a missing file
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", readOnlyDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not check %s", path)
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, errors.Wrap(err, "Could not read integrity_check result")
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+
+	return problems, rows.Err()
+}
+
+// getQuota returns the user's quota. A value saved in KeyValues
+// overrides the configured default
+func (d *DB) getQuota(tx dbTx) (int, error) {
+	val, err := getKey(tx, STORAGE_QUOTA)
+	if err != nil {
+		return 0, err
+	}
+
+	if val == "" {
+		return d.quotaBytes, nil
+	}
+
+	quota, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed converting storage quota to int")
+	}
+
+	return quota, nil
+}
+
+// usedBytes returns the size of all BSO payloads. SCHEMA_2's triggers
+// keep the total in KeyValues as part of every write
+func (d *DB) usedBytes(tx dbTx) (int, error) {
+	val, err := getKey(tx, STORAGE_USED)
+	if err != nil {
+		return 0, err
+	}
+
+	if val == "" {
+		return 0, nil
+	}
+
+	used, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed converting storage used to int")
+	}
+
+	return used, nil
+}
+
+// checkQuota returns ErrOverQuota when the BSOs in tx use more space
+// than the quota allows
+func (d *DB) checkQuota(tx dbTx) error {
+	quota, err := d.getQuota(tx)
+	if err != nil || quota <= 0 {
+		return err
+	}
+
+	used, err := d.usedBytes(tx)
+	if err != nil {
+		return err
+	}
+
+	if used > quota {
+		return ErrOverQuota
+	}
+
+	return nil
+}
+
+// nextModified returns a modified timestamp for a change. Every value
+// is greater than the last one, even if the system clock steps backwards,
+// and is rounded to 10ms like Now(). It is saved in tx so it stays
+// monotonic after the DB is closed and reopened. The clock only moves
+// forward when tx is committed with commit
+func (d *DB) nextModified(tx dbTx) (int, error) {
+	if d.clock == 0 {
+		last, err := loadClock(tx)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed loading storage clock")
+		}
+		d.clock = last
+	}
+
+	modified := Now()
+	if modified <= d.clock {
+		modified = d.clock + 10
+	}
+
+	if err := setKey(tx, STORAGE_CLOCK, strconv.Itoa(modified)); err != nil {
+		return 0, errors.Wrap(err, "Failed saving storage clock")
+	}
+
+	return modified, nil
+}
+
+// commit commits tx and then moves the clock forward to modified, the
+// value nextModified returned for tx. A rolled back change does not
+// use up a timestamp
+func (d *DB) commit(tx *sql.Tx, modified int) error {
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Failed committing transaction")
+	}
+
+	d.clock = modified
+	return nil
+}
+
+// loadClock returns the last modified timestamp handed out. DBs
+// created before STORAGE_CLOCK was saved use their newest timestamp
+func loadClock(tx dbTx) (int, error) {
+	val, err := getKey(tx, STORAGE_CLOCK)
+	if err != nil {
+		return 0, err
+	}
+
+	if val != "" {
+		return strconv.Atoi(val)
+	}
+
+	var last int
+	if val, err = getKey(tx, STORAGE_LAST_MODIFIED); err != nil {
+		return 0, err
+	} else if val != "" {
+		if last, err = strconv.Atoi(val); err != nil {
+			return 0, err
+		}
+	}
+
+	var collections sql.NullInt64
+	if err := tx.QueryRow("SELECT max(Modified) FROM Collections").Scan(&collections); err != nil {
+		return 0, err
+	}
+
+	if int(collections.Int64) > last {
+		last = int(collections.Int64)
+	}
+
+	return last, nil
+}
+
 // touchCollection updates a collection's last-modified timestamp
 func (d *DB) touchCollection(tx dbTx, cId, modified int) (err error) {
 	_, err = tx.Exec("UPDATE Collections SET modified=? WHERE Id=?", modified, cId)
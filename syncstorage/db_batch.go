@@ -17,6 +17,15 @@ type BatchRecord struct {
 	Modified     int
 }
 
+// BatchInfo describes a pending batch without the BSOs in it
+type BatchInfo struct {
+	Id           int    `json:"id"`
+	CollectionId int    `json:"collection_id"`
+	Collection   string `json:"collection"`
+	Modified     int    `json:"modified"`
+	Size         int    `json:"size"` // bytes of BSO data
+}
+
 // BatchCreate creates a new batch
 func (d *DB) BatchCreate(cId int, data string) (int, error) {
 	d.Lock()
@@ -81,11 +90,11 @@ func (d *DB) BatchAppend(id, cId int, data string) (err error) {
 
 // BatchExists checks if a batch exists without loading all the data from disk
 func (d *DB) BatchExists(id, cId int) (bool, error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	var foundId int
-	err := d.db.QueryRow("SELECT Id FROM Batches WHERE Id=? AND CollectionId=?", id, cId).Scan(&foundId)
+	err := d.rdb.QueryRow("SELECT Id FROM Batches WHERE Id=? AND CollectionId=?", id, cId).Scan(&foundId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -98,12 +107,12 @@ func (d *DB) BatchExists(id, cId int) (bool, error) {
 }
 
 func (d *DB) BatchLoad(id, cId int) (*BatchRecord, error) {
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	r := &BatchRecord{Id: id}
 
-	err := d.db.QueryRow("SELECT CollectionId, Modified, BSOS FROM Batches WHERE Id=? AND CollectionId=?", id, cId).Scan(&r.CollectionId, &r.Modified, &r.BSOS)
+	err := d.rdb.QueryRow("SELECT CollectionId, Modified, BSOS FROM Batches WHERE Id=? AND CollectionId=?", id, cId).Scan(&r.CollectionId, &r.Modified, &r.BSOS)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrBatchNotFound
@@ -146,3 +155,32 @@ func (d *DB) BatchPurge(TTL int) (int, error) {
 	purged, err := r.RowsAffected()
 	return int(purged), err
 }
+
+// BatchList returns all pending batches, oldest first
+func (d *DB) BatchList() ([]BatchInfo, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	rows, err := d.rdb.Query(`SELECT b.Id, b.CollectionId, IFNULL(c.Name, ''), b.Modified, length(b.BSOS)
+		FROM Batches b LEFT JOIN Collections c ON b.CollectionId = c.Id
+		ORDER BY b.Id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to SELECT Batches")
+	}
+	defer rows.Close()
+
+	batches := []BatchInfo{}
+	for rows.Next() {
+		var b BatchInfo
+		if err := rows.Scan(&b.Id, &b.CollectionId, &b.Collection, &b.Modified, &b.Size); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan Batch")
+		}
+		batches = append(batches, b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read Batches")
+	}
+
+	return batches, nil
+}
@@ -161,3 +161,40 @@ func TestBatchExists(t *testing.T) {
 	assert.False(notExists)
 	assert.NoError(err)
 }
+
+func TestBatchList(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+	for _, store := range []interface {
+		Storage
+		BatchLister
+	}{db, NewMemStore(nil)} {
+		batches, err := store.BatchList()
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Len(batches, 0)
+
+		id1, _ := store.BatchCreate(1, "hello")
+		id2, _ := store.BatchCreate(4, "hi")
+		if !assert.NoError(store.BatchAppend(id2, 4, " there")) {
+			return
+		}
+
+		batches, err = store.BatchList()
+		if !assert.NoError(err) || !assert.Len(batches, 2) {
+			return
+		}
+
+		assert.Equal(id1, batches[0].Id)
+		assert.Equal(1, batches[0].CollectionId)
+		assert.Equal("clients", batches[0].Collection)
+		assert.Equal(5, batches[0].Size)
+		assert.True(batches[0].Modified > 0)
+
+		assert.Equal(id2, batches[1].Id)
+		assert.Equal("history", batches[1].Collection)
+		assert.Equal(8, batches[1].Size)
+	}
+}
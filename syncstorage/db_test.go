@@ -2,8 +2,10 @@ package syncstorage
 
 import (
 	"database/sql"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -851,6 +853,122 @@ func TestPostBSOs(t *testing.T) {
 	assert.Equal(results2.Modified, cModified)
 }
 
+func TestQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{QuotaBytes: 10})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId := 1
+
+	{ // default comes from the config
+		used, quota, err := db.InfoQuota()
+		if assert.NoError(err) {
+			assert.Equal(0, used)
+			assert.Equal(10, quota)
+		}
+	}
+
+	{ // PutBSO within and over quota
+		_, err := db.PutBSO(cId, "b0", String("12345"), nil, nil)
+		assert.NoError(err)
+
+		_, err = db.PutBSO(cId, "b1", String("123456"), nil, nil)
+		assert.Equal(ErrOverQuota, err)
+
+		// rejected write is rolled back
+		_, err = db.GetBSO(cId, "b1")
+		assert.Equal(ErrNotFound, err)
+	}
+
+	{ // PostBSOs over quota
+		_, err := db.PostBSOs(cId, PostBSOInput{
+			NewPutBSOInput("b2", String("123"), nil, nil),
+			NewPutBSOInput("b3", String("123"), nil, nil),
+		})
+		assert.Equal(ErrOverQuota, err)
+
+		used, _, err := db.InfoQuota()
+		if assert.NoError(err) {
+			assert.Equal(5, used)
+		}
+	}
+
+	{ // per user override
+		if !assert.NoError(db.SetQuota(100)) {
+			return
+		}
+
+		_, quota, err := db.InfoQuota()
+		if assert.NoError(err) {
+			assert.Equal(100, quota)
+		}
+
+		_, err = db.PutBSO(cId, "b1", String("123456"), nil, nil)
+		assert.NoError(err)
+	}
+
+	{ // override to unlimited
+		if !assert.NoError(db.SetQuota(0)) {
+			return
+		}
+
+		_, err := db.PutBSO(cId, "b4", String(strings.Repeat("a", 1000)), nil, nil)
+		assert.NoError(err)
+	}
+}
+
+func TestUsedBytesFollowsWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the running total must always match summing up the BSOs
+	check := func(expected int) {
+		used, _, err := db.InfoQuota()
+		assert.NoError(err)
+		assert.Equal(expected, used)
+
+		var sum int
+		assert.NoError(db.db.QueryRow("SELECT COALESCE(sum(PayloadSize), 0) FROM BSO").Scan(&sum))
+		assert.Equal(sum, used)
+	}
+
+	_, err = db.PutBSO(1, "b0", String("12345"), nil, nil)
+	assert.NoError(err)
+	_, err = db.PostBSOs(2, PostBSOInput{
+		NewPutBSOInput("b1", String("123"), nil, nil),
+		NewPutBSOInput("b2", String("1234"), nil, Int(1)),
+	})
+	assert.NoError(err)
+	check(12)
+
+	// updates without a payload keep its size
+	_, err = db.PutBSO(1, "b0", String("12"), nil, nil)
+	assert.NoError(err)
+	_, err = db.PutBSO(1, "b0", nil, Int(3), nil)
+	assert.NoError(err)
+	check(9)
+
+	_, err = db.DeleteBSO(2, "b1")
+	assert.NoError(err)
+	check(6)
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = db.PurgeExpired()
+	assert.NoError(err)
+	check(2)
+
+	_, err = db.DeleteCollection(1)
+	assert.NoError(err)
+	check(0)
+}
+
 func TestGetBSO(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -1045,6 +1163,162 @@ func TestUsageStats(t *testing.T) {
 	}
 }
 
+func TestCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+	db, err := NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.PutBSO(1, "b0", String("hello"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	info, err := os.Stat(path + "-wal")
+	if assert.NoError(err) {
+		assert.NotEqual(int64(0), info.Size())
+	}
+
+	if assert.NoError(db.Checkpoint()) {
+		info, err := os.Stat(path + "-wal")
+		if assert.NoError(err) {
+			assert.Equal(int64(0), info.Size())
+		}
+	}
+}
+
+func TestNextModifiedPersisted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "clock")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	// pretend the system clock stepped back an hour
+	future := Now() + 60*60*1000
+	{
+		db, err := NewDB(path, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.SetKey(STORAGE_CLOCK, strconv.Itoa(future)))
+		db.Close()
+	}
+
+	db, err := NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	modified, err := db.PutBSO(1, "b0", String("x"), nil, nil)
+	if assert.NoError(err) {
+		assert.Equal(future+10, modified)
+	}
+
+	clock, err := db.GetKey(STORAGE_CLOCK)
+	assert.NoError(err)
+	assert.Equal(strconv.Itoa(future+10), clock)
+}
+
+func TestNextModifiedRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{QuotaBytes: 5})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// set the clock ahead so every write gets clock+10
+	future := Now() + 60*60*1000
+	assert.NoError(db.SetKey(STORAGE_CLOCK, strconv.Itoa(future)))
+
+	modified, err := db.PutBSO(1, "b0", String("12345"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(future+10, modified)
+
+	// rolled back for being over quota
+	_, err = db.PutBSO(1, "b1", String("1"), nil, nil)
+	assert.Equal(ErrOverQuota, err)
+	assert.Equal(modified, db.clock)
+
+	modified, err = db.DeleteBSO(1, "b0")
+	if assert.NoError(err) {
+		assert.Equal(future+20, modified)
+	}
+}
+
+func TestNextModifiedLegacy(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	// DBs without a saved clock continue from their newest timestamp
+	future := Now() + 60*60*1000
+	assert.NoError(db.SetKey(STORAGE_LAST_MODIFIED, strconv.Itoa(future)))
+
+	modified, err := db.DeleteBSOs(1, "nope")
+	if assert.NoError(err) {
+		assert.Equal(future+10, modified)
+	}
+}
+
+func TestDBReadsShareLock(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "reads")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(filepath.Join(dir, "test.db"), nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	// changes are visible to the read only connections
+	modified, err := db.PutBSO(1, "b0", String("x"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the read only connections can not change anything
+	_, err = db.rdb.Exec("DELETE FROM BSO")
+	assert.Error(err)
+
+	// a read lock does not block other readers
+	db.RLock()
+	done := make(chan int)
+	go func() {
+		m, _ := db.GetBSOModified(1, "b0")
+		done <- m
+	}()
+
+	select {
+	case m := <-done:
+		assert.Equal(modified, m)
+	case <-time.After(time.Second):
+		assert.Fail("Read blocked by another reader")
+	}
+	db.RUnlock()
+}
+
 func TestPurgeExpired(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -1118,7 +1392,7 @@ func TestDeleteEverything(t *testing.T) {
 		return
 	}
 
-	if !assert.NoError(db.DeleteEverything()) {
+	if _, err := db.DeleteEverything(); !assert.NoError(err) {
 		return
 	}
 
@@ -1204,17 +1478,17 @@ func TestSchemaUpgrades(t *testing.T) {
 	}
 	d.db.Close()
 
-	{ // Reopening the database should auto upgrade db to SCHEMA_1
+	{ // Reopening the database should auto upgrade db to the latest schema
 		d, err := NewDB(path, nil)
 		defer d.Close()
 		if !assert.NoError(err) {
 			return
 		}
 
-		{ // make sure user_version=1
+		{ // make sure user_version is the latest
 			var val int
 			if err := d.db.QueryRow("PRAGMA user_version;").Scan(&val); assert.NoError(err) {
-				if !assert.Equal(2, val) {
+				if !assert.Equal(LatestSchemaVersion(), val) {
 					return
 				}
 			} else {
@@ -1230,10 +1504,10 @@ func TestSchemaUpgrades(t *testing.T) {
 			return
 		}
 
-		{ // make sure user_version=1
+		{ // make sure user_version is still the latest
 			var val int
 			if err := d.db.QueryRow("PRAGMA user_version;").Scan(&val); assert.NoError(err) {
-				if !assert.Equal(2, val) {
+				if !assert.Equal(LatestSchemaVersion(), val) {
 					return
 				}
 			} else {
@@ -1242,3 +1516,40 @@ func TestSchemaUpgrades(t *testing.T) {
 		}
 	}
 }
+
+func TestIntegrityCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "integrity")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+	_, err = IntegrityCheck(path)
+	assert.True(os.IsNotExist(err))
+
+	db, err := NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = db.PutBSO(1, "b0", String("hello"), nil, nil)
+	assert.NoError(err)
+
+	// works while the DB is open, and after
+	problems, err := IntegrityCheck(path)
+	assert.NoError(err)
+	assert.Len(problems, 0)
+
+	db.Close()
+	problems, err = IntegrityCheck(path)
+	assert.NoError(err)
+	assert.Len(problems, 0)
+
+	// not a database
+	bad := filepath.Join(dir, "bad.db")
+	assert.NoError(ioutil.WriteFile(bad, []byte("this is not a sqlite database file"), 0644))
+	_, err = IntegrityCheck(bad)
+	assert.Error(err)
+}
@@ -0,0 +1,688 @@
+package syncstorage
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrCollectionExists = errors.New("Collection Exists")
+)
+
+// MemStore is a Storage that keeps everything in memory. It is meant
+// for tests and as a reference for writing other storage engines.
+// Nothing is persisted after it is closed.
+type MemStore struct {
+	sync.Mutex
+
+	collections      map[string]int
+	modified         map[int]int // collection id => last modified
+	nextCollectionId int
+
+	bsos map[int]map[string]*BSO // collection id => bso id => BSO
+
+	batches     map[int]*BatchRecord
+	nextBatchId int
+
+	keyValues map[string]string
+
+	// default storage quota in bytes, 0 is unlimited
+	quotaBytes int
+
+	// last modified timestamp handed out
+	clock int
+}
+
+func NewMemStore(conf *Config) *MemStore {
+	m := &MemStore{
+		collections: map[string]int{
+			"clients":     1,
+			"crypto":      2,
+			"forms":       3,
+			"history":     4,
+			"keys":        5,
+			"meta":        6,
+			"bookmarks":   7,
+			"prefs":       8,
+			"tabs":        9,
+			"passwords":   10,
+			"addons":      11,
+			"addresses":   12,
+			"creditcards": 13,
+		},
+		modified:         make(map[int]int),
+		nextCollectionId: 100, // same as the sqlite schema
+		bsos:             make(map[int]map[string]*BSO),
+		batches:          make(map[int]*BatchRecord),
+		nextBatchId:      1,
+		keyValues:        make(map[string]string),
+	}
+
+	if conf != nil {
+		m.quotaBytes = conf.QuotaBytes
+	}
+
+	return m
+}
+
+func (m *MemStore) Close() {}
+
+func (m *MemStore) LastModified() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	lastMod := m.keyValues[STORAGE_LAST_MODIFIED]
+	if lastMod == "" {
+		return 0, nil
+	}
+
+	modified, err := strconv.Atoi(lastMod)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed converting storage timestamp to int. UhOh?!")
+	}
+
+	return modified, nil
+}
+
+func (m *MemStore) GetCollectionId(name string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !CollectionNameOk(name) {
+		return 0, ErrInvalidCollectionName
+	}
+
+	if cId, ok := m.collections[name]; ok {
+		return cId, nil
+	}
+
+	return 0, ErrNotFound
+}
+
+func (m *MemStore) GetCollectionModified(cId int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.modified[cId], nil
+}
+
+func (m *MemStore) CreateCollection(name string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !CollectionNameOk(name) {
+		return 0, ErrInvalidCollectionName
+	}
+
+	if _, ok := m.collections[name]; ok {
+		return 0, ErrCollectionExists
+	}
+
+	cId := m.nextCollectionId
+	m.nextCollectionId++
+
+	m.collections[name] = cId
+	m.modified[cId] = m.nextModified()
+	return cId, nil
+}
+
+func (m *MemStore) DeleteCollection(cId int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.bsos, cId)
+
+	if m.isCollection(cId) {
+		m.modified[cId] = 0
+	}
+
+	modified := m.nextModified()
+	m.touchStorage(modified)
+	return modified, nil
+}
+
+func (m *MemStore) DeleteEverything() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	modified := m.nextModified()
+	m.bsos = make(map[int]map[string]*BSO)
+	m.keyValues["DELETE_EVERYTHING_DATE"] = time.Now().Format(time.RFC3339)
+	m.touchStorage(modified)
+	return modified, nil
+}
+
+func (m *MemStore) TouchCollection(cId, modified int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.touchCollectionAndStorage(cId, modified)
+	return nil
+}
+
+func (m *MemStore) InfoCollections() (map[string]int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	results := make(map[string]int)
+	for name, cId := range m.collections {
+		if modified := m.modified[cId]; modified != 0 {
+			results[name] = modified
+		}
+	}
+
+	return results, nil
+}
+
+func (m *MemStore) InfoCollectionUsage() (map[string]int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.collectionStats(func(b *BSO) int { return len(b.Payload) }), nil
+}
+
+func (m *MemStore) InfoCollectionCounts() (map[string]int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.collectionStats(func(b *BSO) int { return 1 }), nil
+}
+
+func (m *MemStore) InfoQuota() (used, quota int, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if quota, err = m.getQuota(); err != nil {
+		return 0, 0, err
+	}
+
+	return m.usedBytes(), quota, nil
+}
+
+func (m *MemStore) Quota() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.getQuota()
+}
+
+func (m *MemStore) SetQuota(quotaBytes int) error {
+	m.Lock()
+	defer m.Unlock()
+	m.keyValues[STORAGE_QUOTA] = strconv.Itoa(quotaBytes)
+	return nil
+}
+
+func (m *MemStore) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	modified := m.nextModified()
+	results := NewPostResults(modified)
+
+	// changes are staged so nothing is saved when over quota
+	staged := make(map[string]*BSO)
+	for _, data := range input {
+		b, err := m.putBSO(cId, staged[data.Id], data.Id, modified, data.Payload, data.SortIndex, data.TTL)
+		if err != nil {
+			results.AddFailure(data.Id, err.Error())
+			continue
+		}
+
+		staged[data.Id] = b
+		results.AddSuccess(data.Id)
+	}
+
+	if err := m.checkQuota(cId, staged); err != nil {
+		return nil, err
+	}
+
+	m.saveBSOs(cId, staged)
+	m.touchCollectionAndStorage(cId, modified)
+	return results, nil
+}
+
+func (m *MemStore) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	modified := m.nextModified()
+	b, err := m.putBSO(cId, nil, bId, modified, payload, sortIndex, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	staged := map[string]*BSO{bId: b}
+	if err := m.checkQuota(cId, staged); err != nil {
+		return 0, err
+	}
+
+	m.saveBSOs(cId, staged)
+	m.touchCollectionAndStorage(cId, modified)
+	return modified, nil
+}
+
+func (m *MemStore) GetBSO(cId int, bId string) (*BSO, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !BSOIdOk(bId) {
+		return nil, ErrInvalidBSOId
+	}
+
+	b, ok := m.bsos[cId][bId]
+	if !ok || b.TTL < Now() {
+		return nil, ErrNotFound
+	}
+
+	copied := *b
+	return &copied, nil
+}
+
+func (m *MemStore) GetBSOs(
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	sortType SortType,
+	limit int,
+	offset int) (*GetResults, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if !OffsetOk(offset) {
+		return nil, ErrInvalidOffset
+	}
+
+	if !LimitOk(limit) {
+		return nil, ErrInvalidLimit
+	}
+
+	if !NewerOk(newer) {
+		return nil, ErrInvalidNewer
+	}
+
+	// spec says only 100 ids at a time
+	if len(ids) > 100 {
+		ids = ids[0:100]
+	}
+
+	var wanted map[string]bool
+	if len(ids) > 0 {
+		wanted = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			wanted[id] = true
+		}
+	}
+
+	cutOffTTL := Now()
+	bsos := make([]*BSO, 0)
+	for id, b := range m.bsos[cId] {
+		if wanted != nil && !wanted[id] {
+			continue
+		}
+
+		if b.Modified < older && b.Modified > newer && b.TTL > cutOffTTL {
+			copied := *b
+			bsos = append(bsos, &copied)
+		}
+	}
+
+	// break ties by Id so paging through results is stable
+	sort.Slice(bsos, func(i, j int) bool {
+		a, b := bsos[i], bsos[j]
+		switch sortType {
+		case SORT_INDEX:
+			if a.SortIndex != b.SortIndex {
+				return a.SortIndex > b.SortIndex
+			}
+		case SORT_NEWEST:
+			if a.Modified != b.Modified {
+				return a.Modified > b.Modified
+			}
+		case SORT_OLDEST:
+			if a.Modified != b.Modified {
+				return a.Modified < b.Modified
+			}
+		}
+		return a.Id < b.Id
+	})
+
+	if offset > len(bsos) {
+		offset = len(bsos)
+	}
+	bsos = bsos[offset:]
+
+	results := &GetResults{BSOs: bsos}
+	if limit >= 0 && len(bsos) > limit {
+		results.BSOs = bsos[:limit]
+		results.More = true
+		results.Offset = limit + offset
+	}
+
+	return results, nil
+}
+
+func (m *MemStore) GetBSOModified(cId int, bId string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	b, ok := m.bsos[cId][bId]
+	if !ok || b.TTL <= Now() {
+		return 0, ErrNotFound
+	}
+
+	return b.Modified, nil
+}
+
+func (m *MemStore) DeleteBSO(cId int, bId string) (int, error) {
+	return m.DeleteBSOs(cId, bId)
+}
+
+func (m *MemStore) DeleteBSOs(cId int, bIds ...string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, bId := range bIds {
+		delete(m.bsos[cId], bId)
+	}
+
+	modified := m.nextModified()
+	m.touchCollectionAndStorage(cId, modified)
+	return modified, nil
+}
+
+func (m *MemStore) PurgeExpired() (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	removed := 0
+	now := Now()
+	for _, bsos := range m.bsos {
+		for id, b := range bsos {
+			if b.TTL <= now {
+				delete(bsos, id)
+				removed++
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+func (m *MemStore) BatchCreate(cId int, data string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	id := m.nextBatchId
+	m.nextBatchId++
+
+	m.batches[id] = &BatchRecord{
+		Id:           id,
+		CollectionId: cId,
+		BSOS:         data,
+		Modified:     Now(),
+	}
+
+	return id, nil
+}
+
+func (m *MemStore) BatchAppend(id, cId int, data string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	batch, ok := m.batches[id]
+	if !ok || batch.CollectionId != cId {
+		return ErrBatchNotFound
+	}
+
+	batch.BSOS += data
+	batch.Modified = Now()
+	return nil
+}
+
+func (m *MemStore) BatchExists(id, cId int) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	batch, ok := m.batches[id]
+	return ok && batch.CollectionId == cId, nil
+}
+
+func (m *MemStore) BatchLoad(id, cId int) (*BatchRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	batch, ok := m.batches[id]
+	if !ok || batch.CollectionId != cId {
+		return nil, ErrBatchNotFound
+	}
+
+	copied := *batch
+	return &copied, nil
+}
+
+func (m *MemStore) BatchRemove(id int) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.batches, id)
+	return nil
+}
+
+func (m *MemStore) BatchPurge(TTL int) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	purged := 0
+	now := Now()
+	for id, batch := range m.batches {
+		if now-batch.Modified >= TTL {
+			delete(m.batches, id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (m *MemStore) BatchList() ([]BatchInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	names := make(map[int]string, len(m.collections))
+	for name, cId := range m.collections {
+		names[cId] = name
+	}
+
+	batches := make([]BatchInfo, 0, len(m.batches))
+	for _, batch := range m.batches {
+		batches = append(batches, BatchInfo{
+			Id:           batch.Id,
+			CollectionId: batch.CollectionId,
+			Collection:   names[batch.CollectionId],
+			Modified:     batch.Modified,
+			Size:         len(batch.BSOS),
+		})
+	}
+
+	sort.Slice(batches, func(i, j int) bool { return batches[i].Id < batches[j].Id })
+	return batches, nil
+}
+
+func (m *MemStore) SetKey(key, value string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.keyValues[key] = value
+	return nil
+}
+
+func (m *MemStore) GetKey(key string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.keyValues[key], nil
+}
+
+// putBSO validates the changes and returns the updated BSO without saving
+// it. prev is used over the saved BSO when it is not nil.
+func (m *MemStore) putBSO(cId int, prev *BSO, bId string, modified int, payload *string, sortIndex *int, ttl *int) (*BSO, error) {
+	if payload == nil && sortIndex == nil && ttl == nil {
+		return nil, ErrNothingToDo
+	}
+
+	if !BSOIdOk(bId) {
+		return nil, ErrInvalidBSOId
+	}
+
+	if sortIndex != nil && !SortIndexOk(*sortIndex) {
+		return nil, ErrInvalidSortIndex
+	}
+
+	if ttl != nil && !TTLOk(*ttl) {
+		return nil, ErrInvalidTTL
+	}
+
+	if prev == nil {
+		prev = m.bsos[cId][bId]
+	}
+
+	if prev == nil {
+		b := &BSO{Id: bId, Modified: modified, TTL: modified + DEFAULT_BSO_TTL}
+		if payload != nil {
+			b.Payload = *payload
+		}
+		if sortIndex != nil {
+			b.SortIndex = *sortIndex
+		}
+		if ttl != nil {
+			b.TTL = modified + *ttl
+		}
+		return b, nil
+	}
+
+	b := *prev
+
+	// The modified time is *ONLY* changed if the
+	// payload or the sortIndex changes.
+	if payload != nil || sortIndex != nil {
+		b.Modified = modified
+	}
+	if payload != nil {
+		b.Payload = *payload
+	}
+	if sortIndex != nil {
+		b.SortIndex = *sortIndex
+	}
+	if ttl != nil {
+		b.TTL = modified + *ttl
+	}
+
+	return &b, nil
+}
+
+func (m *MemStore) saveBSOs(cId int, bsos map[string]*BSO) {
+	if len(bsos) == 0 {
+		return
+	}
+
+	if m.bsos[cId] == nil {
+		m.bsos[cId] = make(map[string]*BSO)
+	}
+
+	for id, b := range bsos {
+		m.bsos[cId][id] = b
+	}
+}
+
+func (m *MemStore) getQuota() (int, error) {
+	val := m.keyValues[STORAGE_QUOTA]
+	if val == "" {
+		return m.quotaBytes, nil
+	}
+
+	quota, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed converting storage quota to int")
+	}
+
+	return quota, nil
+}
+
+func (m *MemStore) usedBytes() int {
+	used := 0
+	for _, bsos := range m.bsos {
+		for _, b := range bsos {
+			used += len(b.Payload)
+		}
+	}
+	return used
+}
+
+// checkQuota returns ErrOverQuota if saving staged would use more
+// space than the quota allows
+func (m *MemStore) checkQuota(cId int, staged map[string]*BSO) error {
+	quota, err := m.getQuota()
+	if err != nil || quota <= 0 {
+		return err
+	}
+
+	used := m.usedBytes()
+	for id, b := range staged {
+		if prev, ok := m.bsos[cId][id]; ok {
+			used -= len(prev.Payload)
+		}
+		used += len(b.Payload)
+	}
+
+	if used > quota {
+		return ErrOverQuota
+	}
+
+	return nil
+}
+
+func (m *MemStore) collectionStats(value func(*BSO) int) map[string]int {
+	results := make(map[string]int)
+	for name, cId := range m.collections {
+		if len(m.bsos[cId]) == 0 {
+			continue
+		}
+
+		for _, b := range m.bsos[cId] {
+			results[name] += value(b)
+		}
+	}
+	return results
+}
+
+// nextModified returns a timestamp greater than the last one
+// like DB.nextModified
+func (m *MemStore) nextModified() int {
+	modified := Now()
+	if modified <= m.clock {
+		modified = m.clock + 10
+	}
+	m.clock = modified
+	return modified
+}
+
+func (m *MemStore) touchStorage(modified int) {
+	m.keyValues[STORAGE_LAST_MODIFIED] = strconv.Itoa(modified)
+}
+
+func (m *MemStore) touchCollectionAndStorage(cId, modified int) {
+	if m.isCollection(cId) {
+		m.modified[cId] = modified
+	}
+	m.touchStorage(modified)
+}
+
+func (m *MemStore) isCollection(cId int) bool {
+	for _, id := range m.collections {
+		if id == cId {
+			return true
+		}
+	}
+	return false
+}
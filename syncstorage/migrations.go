@@ -0,0 +1,219 @@
+package syncstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// migration is a change to the schema of a user's database. Version is
+// the PRAGMA user_version of the database after it has been applied
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations is the ordered registry of schema changes. To change the
+// schema add a new SCHEMA_x and append it here with the next Version.
+// Never change or reorder migrations that have already shipped.
+var migrations = []migration{
+	{Version: 1, Name: "SCHEMA_0", SQL: SCHEMA_0},
+	{Version: 2, Name: "SCHEMA_1", SQL: SCHEMA_1},
+	{Version: 3, Name: "SCHEMA_2", SQL: SCHEMA_2},
+}
+
+// LatestSchemaVersion is the version a database is at after all
+// migrations have been applied
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// schemaVersion returns the version of the last migration
+// applied to the database
+func schemaVersion(tx dbTx) (int, error) {
+	var version int
+
+	// an empty database has nothing applied
+	if err := tx.QueryRow("PRAGMA schema_version;").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	if version == 0 {
+		return 0, nil
+	}
+
+	if err := tx.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	// SCHEMA_0 did not set user_version so it was left at 0
+	if version == 0 {
+		return 1, nil
+	}
+
+	return version, nil
+}
+
+// pendingMigrations returns the migrations that still need to
+// be applied to a database at version
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// migrate applies all pending migrations in order
+func (d *DB) migrate() error {
+	version, err := schemaVersion(d.db)
+	if err != nil {
+		return errors.Wrap(err, "Could not determine schema version")
+	}
+
+	for _, m := range pendingMigrations(version) {
+		if err := d.applyMigration(m); err != nil {
+			return errors.Wrapf(err, "Migration %d (%s) failed", m.Version, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs a single migration in its own transaction and
+// records it in KeyValues
+func (d *DB) applyMigration(m migration) error {
+	start := time.Now()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version=%d;", m.Version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := setKey(tx, "SCHEMA_VERSION", strconv.Itoa(m.Version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	key := fmt.Sprintf("MIGRATION_%d", m.Version)
+	if err := setKey(tx, key, m.Name+" "+time.Now().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if log.GetLevel() == log.DebugLevel {
+		log.WithFields(log.Fields{
+			"db":      d.Path,
+			"version": m.Version,
+			"name":    m.Name,
+			"t":       time.Since(start).Nanoseconds() / 1000 / 1000,
+		}).Debug("db migration applied")
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the version of the last migration applied
+func (d *DB) SchemaVersion() (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return schemaVersion(d.rdb)
+}
+
+// MigrationStatus reports which migrations a database is missing
+type MigrationStatus struct {
+	Path    string
+	Version int
+	Latest  int
+	Pending []string
+}
+
+func (m *MigrationStatus) Behind() bool {
+	return len(m.Pending) > 0
+}
+
+// CheckMigrations is a dry run of opening the database at path. It
+// reports the migrations that would be applied without changing anything.
+// The database is opened read only so it can be checked while it is served
+func CheckMigrations(path string) (*MigrationStatus, error) {
+	// sql.Open would create a missing file
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", readOnlyDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not determine schema version of %s", path)
+	}
+
+	status := &MigrationStatus{
+		Path:    path,
+		Version: version,
+		Latest:  LatestSchemaVersion(),
+	}
+
+	for _, m := range pendingMigrations(version) {
+		status.Pending = append(status.Pending, m.Name)
+	}
+
+	return status, nil
+}
+
+// CheckMigrationsDir does a dry run on every database under dir
+// and returns the ones with pending migrations
+func CheckMigrationsDir(dir string) ([]*MigrationStatus, error) {
+	behind := []*MigrationStatus{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, ".db") {
+			return nil
+		}
+
+		status, err := CheckMigrations(path)
+		if err != nil {
+			return err
+		}
+
+		if status.Behind() {
+			behind = append(behind, status)
+		}
+
+		return nil
+	})
+
+	return behind, err
+}
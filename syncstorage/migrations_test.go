@@ -0,0 +1,159 @@
+package syncstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	assert := assert.New(t)
+	for i := 1; i < len(migrations); i++ {
+		assert.True(migrations[i-1].Version < migrations[i].Version,
+			"Migration %s out of order", migrations[i].Name)
+	}
+}
+
+func TestMigrationsRecorded(t *testing.T) {
+	assert := assert.New(t)
+	db, err := getTestDB()
+	if !assert.NoError(err) {
+		return
+	}
+
+	version, err := db.SchemaVersion()
+	if assert.NoError(err) {
+		assert.Equal(LatestSchemaVersion(), version)
+	}
+
+	for _, m := range migrations {
+		val, err := db.GetKey(fmt.Sprintf("MIGRATION_%d", m.Version))
+		if assert.NoError(err) {
+			assert.Contains(val, m.Name)
+		}
+	}
+}
+
+func TestMigrationFailureRollsBack(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "migrations")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fail.db")
+
+	{ // create a db with the current schema
+		db, err := NewDB(path, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		db.Close()
+	}
+
+	orig := migrations
+	defer func() { migrations = orig }()
+
+	latest := LatestSchemaVersion()
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{Version: latest + 1, Name: "GOOD", SQL: "CREATE TABLE Good (Id INTEGER);"},
+		migration{Version: latest + 2, Name: "BAD", SQL: "CREATE TABLE Bad (Id INTEGER); SELECT * FROM Nope;"},
+	)
+
+	_, err = NewDB(path, nil)
+	if !assert.Error(err) {
+		return
+	}
+
+	// the good migration sticks, the bad one was rolled back
+	status, err := CheckMigrations(path)
+	if assert.NoError(err) {
+		assert.Equal(latest+1, status.Version)
+		assert.Equal([]string{"BAD"}, status.Pending)
+	}
+
+	raw, _ := sql.Open("sqlite3", path)
+	defer raw.Close()
+	var name string
+	err = raw.QueryRow("SELECT name FROM sqlite_master WHERE name='Bad'").Scan(&name)
+	assert.Equal(sql.ErrNoRows, err)
+}
+
+func TestCheckMigrationsDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "migrations")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	{ // up to date
+		db, err := NewDB(filepath.Join(dir, "current.db"), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		db.Close()
+	}
+
+	oldPath := filepath.Join(dir, "01", "old.db")
+	{ // only SCHEMA_0
+		if !assert.NoError(os.Mkdir(filepath.Dir(oldPath), 0755)) {
+			return
+		}
+
+		raw, err := sql.Open("sqlite3", oldPath)
+		if !assert.NoError(err) {
+			return
+		}
+		_, err = raw.Exec(SCHEMA_0)
+		raw.Close()
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	behind, err := CheckMigrationsDir(dir)
+	if !assert.NoError(err) || !assert.Len(behind, 1) {
+		return
+	}
+
+	assert.Equal(oldPath, behind[0].Path)
+	assert.Equal(1, behind[0].Version)
+	assert.Equal(LatestSchemaVersion(), behind[0].Latest)
+	assert.Equal([]string{"SCHEMA_1", "SCHEMA_2"}, behind[0].Pending)
+
+	// a dry run changes nothing
+	status, err := CheckMigrations(oldPath)
+	if assert.NoError(err) {
+		assert.True(status.Behind())
+	}
+
+	{ // a DB that is being served can be checked
+		db, err := NewDB(filepath.Join(dir, "current.db"), nil)
+		if assert.NoError(err) {
+			status, err := CheckMigrations(db.Path)
+			if assert.NoError(err) {
+				assert.False(status.Behind())
+			}
+			db.Close()
+		}
+	}
+
+	// opening it applies the rest
+	db, err := NewDB(oldPath, nil)
+	if assert.NoError(err) {
+		db.Close()
+	}
+
+	behind, err = CheckMigrationsDir(dir)
+	if assert.NoError(err) {
+		assert.Len(behind, 0)
+	}
+}
@@ -73,3 +73,27 @@ const SCHEMA_1 = `
 	-- skip user_version=1 as that *should have been* set by 'SCHEMA_0'
 	PRAGMA user_version=2;
 `
+
+// keeps a running total of BSO payload sizes in KeyValues so quota
+// checks do not have to sum up every BSO on each write
+const SCHEMA_2 = `
+	INSERT OR REPLACE INTO KeyValues (Key, Value)
+		SELECT "Storage Used", COALESCE(sum(PayloadSize), 0) FROM BSO;
+
+	CREATE TRIGGER bso_used_insert AFTER INSERT ON BSO BEGIN
+		UPDATE KeyValues SET Value = Value + NEW.PayloadSize
+		WHERE Key = "Storage Used";
+	END;
+
+	CREATE TRIGGER bso_used_update AFTER UPDATE OF PayloadSize ON BSO BEGIN
+		UPDATE KeyValues SET Value = Value + NEW.PayloadSize - OLD.PayloadSize
+		WHERE Key = "Storage Used";
+	END;
+
+	CREATE TRIGGER bso_used_delete AFTER DELETE ON BSO BEGIN
+		UPDATE KeyValues SET Value = Value - OLD.PayloadSize
+		WHERE Key = "Storage Used";
+	END;
+
+	PRAGMA user_version=3;
+`
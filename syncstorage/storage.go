@@ -0,0 +1,76 @@
+package syncstorage
+
+// Storage is everything the web layer needs to serve the sync 1.5 API
+// for a single user. *DB is the sqlite3 implementation used in production.
+// Any other engine can be used with the web handlers as long as it passes
+// the conformance tests in the storagetest package.
+type Storage interface {
+	// Collections
+	LastModified() (int, error)
+	GetCollectionId(name string) (int, error)
+	GetCollectionModified(cId int) (int, error)
+	CreateCollection(name string) (int, error)
+	DeleteCollection(cId int) (int, error)
+	TouchCollection(cId, modified int) error
+	DeleteEverything() (int, error)
+
+	// Info
+	InfoCollections() (map[string]int, error)
+	InfoCollectionUsage() (map[string]int, error)
+	InfoCollectionCounts() (map[string]int, error)
+	InfoQuota() (used, quota int, err error)
+	Quota() (int, error)
+	SetQuota(quotaBytes int) error
+
+	// BSOs
+	PostBSOs(cId int, input PostBSOInput) (*PostResults, error)
+	PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (int, error)
+	GetBSO(cId int, bId string) (*BSO, error)
+	GetBSOs(cId int, ids []string, older int, newer int, sort SortType, limit int, offset int) (*GetResults, error)
+	GetBSOModified(cId int, bId string) (int, error)
+	DeleteBSO(cId int, bId string) (int, error)
+	DeleteBSOs(cId int, bIds ...string) (int, error)
+	PurgeExpired() (int, error)
+
+	// Batches
+	BatchCreate(cId int, data string) (int, error)
+	BatchAppend(id, cId int, data string) error
+	BatchExists(id, cId int) (bool, error)
+	BatchLoad(id, cId int) (*BatchRecord, error)
+	BatchRemove(id int) error
+	BatchPurge(TTL int) (int, error)
+
+	// Key/Values
+	SetKey(key, value string) error
+	GetKey(key string) (string, error)
+
+	Close()
+}
+
+// Vacuumer is implemented by storage engines that can reclaim
+// unused disk space
+type Vacuumer interface {
+	Usage() (*DBPageStats, error)
+	Vacuum() error
+}
+
+// Checkpointer is implemented by storage engines that should flush
+// their write-ahead log before they are closed
+type Checkpointer interface {
+	Checkpoint() error
+}
+
+// BatchLister is implemented by storage engines that can list the
+// batches waiting to be committed without loading their data
+type BatchLister interface {
+	BatchList() ([]BatchInfo, error)
+}
+
+var (
+	_ Storage      = (*DB)(nil)
+	_ Vacuumer     = (*DB)(nil)
+	_ Checkpointer = (*DB)(nil)
+	_ BatchLister  = (*DB)(nil)
+	_ Storage      = (*MemStore)(nil)
+	_ BatchLister  = (*MemStore)(nil)
+)
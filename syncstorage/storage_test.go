@@ -0,0 +1,24 @@
+package syncstorage_test
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/mozilla-services/go-syncstorage/syncstorage/storagetest"
+)
+
+func TestStorageDB(t *testing.T) {
+	storagetest.Run(t, func() syncstorage.Storage {
+		db, err := syncstorage.NewDB(":memory:", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestStorageMemStore(t *testing.T) {
+	storagetest.Run(t, func() syncstorage.Storage {
+		return syncstorage.NewMemStore(nil)
+	})
+}
@@ -0,0 +1,562 @@
+// Package storagetest is a conformance suite for syncstorage.Storage
+// implementations. Engines call Run from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func() syncstorage.Storage {
+//			return NewMyStore()
+//		})
+//	}
+package storagetest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run tests the Storage returned by open. Every sub test gets
+// a new, empty Storage and closes it when done.
+func Run(t *testing.T, open func() Storage) {
+	tests := []struct {
+		name string
+		test func(*testing.T, Storage)
+	}{
+		{"Collections", testCollections},
+		{"PutGetBSO", testPutGetBSO},
+		{"UpdateBSO", testUpdateBSO},
+		{"PostBSOs", testPostBSOs},
+		{"GetBSOs", testGetBSOs},
+		{"Expired", testExpired},
+		{"Delete", testDelete},
+		{"Info", testInfo},
+		{"Quota", testQuota},
+		{"Batches", testBatches},
+		{"KeyValues", testKeyValues},
+		{"UniqueModified", testUniqueModified},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			s := open()
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+// tick waits until Now() returns a new timestamp
+func tick() {
+	time.Sleep(10 * time.Millisecond)
+}
+
+func testCollections(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId, err := s.GetCollectionId("bookmarks")
+	require.NoError(err)
+	assert.Equal(7, cId)
+
+	_, err = s.GetCollectionId("no spaces allowed")
+	assert.Equal(ErrInvalidCollectionName, err)
+
+	_, err = s.GetCollectionId("custom")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = s.CreateCollection("no spaces allowed")
+	assert.Equal(ErrInvalidCollectionName, err)
+
+	cId, err = s.CreateCollection("custom")
+	require.NoError(err)
+	assert.True(cId >= 100, "Expected custom collections to start at 100")
+
+	found, err := s.GetCollectionId("custom")
+	require.NoError(err)
+	assert.Equal(cId, found)
+
+	_, err = s.CreateCollection("custom")
+	assert.Error(err, "Expected error creating a duplicate collection")
+
+	modified, err := s.GetCollectionModified(9999)
+	assert.NoError(err)
+	assert.Equal(0, modified)
+
+	modified = Now()
+	require.NoError(s.TouchCollection(cId, modified))
+
+	cmodified, err := s.GetCollectionModified(cId)
+	assert.NoError(err)
+	assert.Equal(modified, cmodified)
+
+	lastModified, err := s.LastModified()
+	assert.NoError(err)
+	assert.Equal(modified, lastModified)
+}
+
+func testPutGetBSO(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	modified, err := s.PutBSO(cId, "b0", String("hello"), Int(5), nil)
+	require.NoError(err)
+
+	b, err := s.GetBSO(cId, "b0")
+	require.NoError(err)
+	assert.Equal("b0", b.Id)
+	assert.Equal("hello", b.Payload)
+	assert.Equal(5, b.SortIndex)
+	assert.Equal(modified, b.Modified)
+
+	bmodified, err := s.GetBSOModified(cId, "b0")
+	assert.NoError(err)
+	assert.Equal(modified, bmodified)
+
+	cmodified, err := s.GetCollectionModified(cId)
+	assert.NoError(err)
+	assert.Equal(modified, cmodified)
+
+	lastModified, err := s.LastModified()
+	assert.NoError(err)
+	assert.Equal(modified, lastModified)
+
+	_, err = s.GetBSO(cId, "nope")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = s.GetBSOModified(cId, "nope")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = s.GetBSO(cId, "")
+	assert.Equal(ErrInvalidBSOId, err)
+
+	_, err = s.PutBSO(cId, "", String("hi"), nil, nil)
+	assert.Equal(ErrInvalidBSOId, err)
+
+	_, err = s.PutBSO(cId, "b1", nil, nil, nil)
+	assert.Equal(ErrNothingToDo, err)
+
+	_, err = s.PutBSO(cId, "b1", nil, Int(1000000000), nil)
+	assert.Equal(ErrInvalidSortIndex, err)
+
+	_, err = s.PutBSO(cId, "b1", nil, nil, Int(-1))
+	assert.Equal(ErrInvalidTTL, err)
+}
+
+func testUpdateBSO(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	modified, err := s.PutBSO(cId, "b0", String("hello"), Int(5), nil)
+	require.NoError(err)
+
+	// changing only the TTL keeps the modified time
+	tick()
+	_, err = s.PutBSO(cId, "b0", nil, nil, Int(60000))
+	require.NoError(err)
+
+	b, err := s.GetBSO(cId, "b0")
+	require.NoError(err)
+	assert.Equal(modified, b.Modified)
+	assert.Equal("hello", b.Payload)
+	assert.Equal(5, b.SortIndex)
+
+	// changing the payload updates it and keeps the sortindex
+	tick()
+	modified2, err := s.PutBSO(cId, "b0", String("updated"), nil, nil)
+	require.NoError(err)
+	assert.NotEqual(modified, modified2)
+
+	b, err = s.GetBSO(cId, "b0")
+	require.NoError(err)
+	assert.Equal(modified2, b.Modified)
+	assert.Equal("updated", b.Payload)
+	assert.Equal(5, b.SortIndex)
+}
+
+func testPostBSOs(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	results, err := s.PostBSOs(cId, PostBSOInput{
+		NewPutBSOInput("b0", String("0"), nil, nil),
+		NewPutBSOInput("b1", String("1"), Int(1), nil),
+		NewPutBSOInput("", String("bad"), nil, nil),
+		NewPutBSOInput("b2", String("2"), Int(2), nil),
+	})
+	require.NoError(err)
+
+	assert.Equal([]string{"b0", "b1", "b2"}, results.Success)
+	assert.Len(results.Failed, 1)
+	assert.Contains(results.Failed, "")
+
+	for _, id := range results.Success {
+		b, err := s.GetBSO(cId, id)
+		if assert.NoError(err) {
+			assert.Equal(results.Modified, b.Modified)
+		}
+	}
+
+	cmodified, err := s.GetCollectionModified(cId)
+	assert.NoError(err)
+	assert.Equal(results.Modified, cmodified)
+}
+
+func testGetBSOs(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	modified := make([]int, 5)
+	for i := 0; i < 5; i++ {
+		tick()
+		m, err := s.PutBSO(cId, "b"+string('0'+rune(i)), String("x"), Int(i), nil)
+		require.NoError(err)
+		modified[i] = m
+	}
+
+	ids := func(r *GetResults) []string {
+		found := make([]string, len(r.BSOs))
+		for i, b := range r.BSOs {
+			found[i] = b.Id
+		}
+		return found
+	}
+
+	r, err := s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_INDEX, -1, 0)
+	require.NoError(err)
+	assert.Equal([]string{"b4", "b3", "b2", "b1", "b0"}, ids(r))
+	assert.False(r.More)
+
+	r, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_NEWEST, -1, 0)
+	require.NoError(err)
+	assert.Equal([]string{"b4", "b3", "b2", "b1", "b0"}, ids(r))
+
+	r, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_OLDEST, -1, 0)
+	require.NoError(err)
+	assert.Equal([]string{"b0", "b1", "b2", "b3", "b4"}, ids(r))
+
+	{ // paging
+		r, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_OLDEST, 2, 0)
+		require.NoError(err)
+		assert.Equal([]string{"b0", "b1"}, ids(r))
+		assert.True(r.More)
+		assert.Equal(2, r.Offset)
+
+		r, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_OLDEST, 2, 4)
+		require.NoError(err)
+		assert.Equal([]string{"b4"}, ids(r))
+		assert.False(r.More)
+	}
+
+	{ // newer and older
+		r, err = s.GetBSOs(cId, nil, modified[3], modified[0], SORT_OLDEST, -1, 0)
+		require.NoError(err)
+		assert.Equal([]string{"b1", "b2"}, ids(r))
+	}
+
+	{ // by id
+		r, err = s.GetBSOs(cId, []string{"b3", "b1", "nope"}, MaxTimestamp, 0, SORT_OLDEST, -1, 0)
+		require.NoError(err)
+		assert.Equal([]string{"b1", "b3"}, ids(r))
+	}
+
+	{ // other collections are not included
+		r, err = s.GetBSOs(2, nil, MaxTimestamp, 0, SORT_NONE, -1, 0)
+		require.NoError(err)
+		assert.Len(r.BSOs, 0)
+	}
+
+	_, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_NONE, -2, 0)
+	assert.Equal(ErrInvalidLimit, err)
+
+	_, err = s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_NONE, -1, -1)
+	assert.Equal(ErrInvalidOffset, err)
+
+	_, err = s.GetBSOs(cId, nil, MaxTimestamp, -1, SORT_NONE, -1, 0)
+	assert.Equal(ErrInvalidNewer, err)
+}
+
+func testExpired(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	_, err := s.PutBSO(cId, "expires", String("x"), nil, Int(0))
+	require.NoError(err)
+	_, err = s.PutBSO(cId, "keep", String("x"), nil, nil)
+	require.NoError(err)
+
+	tick()
+	tick()
+
+	_, err = s.GetBSO(cId, "expires")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = s.GetBSOModified(cId, "expires")
+	assert.Equal(ErrNotFound, err)
+
+	r, err := s.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_NONE, -1, 0)
+	require.NoError(err)
+	if assert.Len(r.BSOs, 1) {
+		assert.Equal("keep", r.BSOs[0].Id)
+	}
+
+	removed, err := s.PurgeExpired()
+	assert.NoError(err)
+	assert.Equal(1, removed)
+}
+
+func testDelete(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, cId := range []int{1, 2} {
+		for _, id := range []string{"b0", "b1", "b2"} {
+			_, err := s.PutBSO(cId, id, String("x"), nil, nil)
+			require.NoError(err)
+		}
+	}
+
+	{ // some BSOs
+		tick()
+		modified, err := s.DeleteBSOs(1, "b0", "b1")
+		require.NoError(err)
+
+		r, err := s.GetBSOs(1, nil, MaxTimestamp, 0, SORT_NONE, -1, 0)
+		require.NoError(err)
+		if assert.Len(r.BSOs, 1) {
+			assert.Equal("b2", r.BSOs[0].Id)
+		}
+
+		cmodified, _ := s.GetCollectionModified(1)
+		assert.Equal(modified, cmodified)
+	}
+
+	{ // a single BSO
+		tick()
+		modified, err := s.DeleteBSO(1, "b2")
+		require.NoError(err)
+
+		_, err = s.GetBSO(1, "b2")
+		assert.Equal(ErrNotFound, err)
+
+		lastModified, _ := s.LastModified()
+		assert.Equal(modified, lastModified)
+	}
+
+	{ // a collection
+		tick()
+		modified, err := s.DeleteCollection(2)
+		require.NoError(err)
+
+		r, err := s.GetBSOs(2, nil, MaxTimestamp, 0, SORT_NONE, -1, 0)
+		require.NoError(err)
+		assert.Len(r.BSOs, 0)
+
+		cmodified, _ := s.GetCollectionModified(2)
+		assert.Equal(0, cmodified)
+
+		info, err := s.InfoCollections()
+		require.NoError(err)
+		assert.NotContains(info, "crypto")
+
+		lastModified, _ := s.LastModified()
+		assert.Equal(modified, lastModified)
+	}
+
+	{ // everything
+		putModified, err := s.PutBSO(3, "b0", String("x"), nil, nil)
+		require.NoError(err)
+		modified, err := s.DeleteEverything()
+		require.NoError(err)
+		assert.True(modified > putModified)
+
+		lastModified, _ := s.LastModified()
+		assert.Equal(modified, lastModified)
+
+		_, err = s.GetBSO(3, "b0")
+		assert.Equal(ErrNotFound, err)
+
+		used, _, err := s.InfoQuota()
+		assert.NoError(err)
+		assert.Equal(0, used)
+	}
+}
+
+func testInfo(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId, err := s.CreateCollection("custom")
+	require.NoError(err)
+
+	_, err = s.PutBSO(1, "b0", String("1234"), nil, nil)
+	require.NoError(err)
+	_, err = s.PutBSO(1, "b1", String("12"), nil, nil)
+	require.NoError(err)
+	modified, err := s.PutBSO(cId, "b0", String("1"), nil, nil)
+	require.NoError(err)
+
+	info, err := s.InfoCollections()
+	require.NoError(err)
+	assert.Contains(info, "clients")
+	assert.Equal(modified, info["custom"])
+	assert.NotContains(info, "bookmarks")
+
+	usage, err := s.InfoCollectionUsage()
+	require.NoError(err)
+	assert.Equal(map[string]int{"clients": 6, "custom": 1}, usage)
+
+	counts, err := s.InfoCollectionCounts()
+	require.NoError(err)
+	assert.Equal(map[string]int{"clients": 2, "custom": 1}, counts)
+}
+
+func testQuota(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(s.SetQuota(10))
+	quota, err := s.Quota()
+	require.NoError(err)
+	assert.Equal(10, quota)
+
+	_, err = s.PutBSO(1, "b0", String("12345"), nil, nil)
+	require.NoError(err)
+
+	{ // over quota changes nothing
+		_, err = s.PutBSO(1, "b1", String("123456"), nil, nil)
+		assert.Equal(ErrOverQuota, err)
+
+		_, err = s.PostBSOs(1, PostBSOInput{
+			NewPutBSOInput("b1", String("123"), nil, nil),
+			NewPutBSOInput("b2", String("123"), nil, nil),
+		})
+		assert.Equal(ErrOverQuota, err)
+
+		_, err = s.GetBSO(1, "b1")
+		assert.Equal(ErrNotFound, err)
+	}
+
+	// replacing a BSO only counts the difference
+	_, err = s.PutBSO(1, "b0", String("1234567890"), nil, nil)
+	assert.NoError(err)
+
+	used, quota, err := s.InfoQuota()
+	require.NoError(err)
+	assert.Equal(10, used)
+	assert.Equal(10, quota)
+
+	// 0 removes the limit
+	require.NoError(s.SetQuota(0))
+	_, err = s.PutBSO(1, "b1", String(strings.Repeat("x", 100)), nil, nil)
+	assert.NoError(err)
+}
+
+func testBatches(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId := 1
+	id, err := s.BatchCreate(cId, "a")
+	require.NoError(err)
+
+	found, err := s.BatchExists(id, cId)
+	assert.NoError(err)
+	assert.True(found)
+
+	found, err = s.BatchExists(id, cId+1)
+	assert.NoError(err)
+	assert.False(found)
+
+	require.NoError(s.BatchAppend(id, cId, "b"))
+	assert.Equal(ErrBatchNotFound, s.BatchAppend(id, cId+1, "c"))
+	assert.Equal(ErrBatchNotFound, s.BatchAppend(id+1000, cId, "c"))
+
+	batch, err := s.BatchLoad(id, cId)
+	require.NoError(err)
+	assert.Equal(id, batch.Id)
+	assert.Equal(cId, batch.CollectionId)
+	assert.Equal("ab", batch.BSOS)
+
+	_, err = s.BatchLoad(id, cId+1)
+	assert.Equal(ErrBatchNotFound, err)
+
+	require.NoError(s.BatchRemove(id))
+	found, err = s.BatchExists(id, cId)
+	assert.NoError(err)
+	assert.False(found)
+
+	{ // purge
+		_, err := s.BatchCreate(cId, "old")
+		require.NoError(err)
+
+		tick()
+		tick()
+
+		newId, err := s.BatchCreate(cId, "new")
+		require.NoError(err)
+
+		purged, err := s.BatchPurge(15)
+		assert.NoError(err)
+		assert.Equal(1, purged)
+
+		found, err = s.BatchExists(newId, cId)
+		assert.NoError(err)
+		assert.True(found)
+	}
+}
+
+func testKeyValues(t *testing.T, s Storage) {
+	assert := assert.New(t)
+
+	val, err := s.GetKey("missing")
+	assert.NoError(err)
+	assert.Equal("", val)
+
+	assert.NoError(s.SetKey("k", "v1"))
+	assert.NoError(s.SetKey("k", "v2"))
+
+	val, err = s.GetKey("k")
+	assert.NoError(err)
+	assert.Equal("v2", val)
+}
+
+func testUniqueModified(t *testing.T, s Storage) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cId, err := s.CreateCollection("custom")
+	require.NoError(err)
+	last, err := s.GetCollectionModified(cId)
+	require.NoError(err)
+
+	// every change gets a newer timestamp without waiting
+	for i := 0; i < 10; i++ {
+		var modified int
+		switch i % 3 {
+		case 0:
+			modified, err = s.PutBSO(cId, "b0", String("x"), nil, nil)
+		case 1:
+			var r *PostResults
+			r, err = s.PostBSOs(cId, PostBSOInput{NewPutBSOInput("b1", String("x"), nil, nil)})
+			if r != nil {
+				modified = r.Modified
+			}
+		case 2:
+			modified, err = s.DeleteBSOs(cId, "b1")
+		}
+
+		require.NoError(err)
+		assert.True(modified > last, "Expected %d > %d", modified, last)
+		assert.Equal(0, modified%10, "Expected modified rounded to 10ms")
+		last = modified
+	}
+}
@@ -56,6 +56,11 @@ func (t *Token) Expired() bool {
 	return float64(time.Now().Unix()) > t.Payload.Expires
 }
 
+// ExpiredAfter checks if the token expired more than grace ago
+func (t *Token) ExpiredAfter(grace time.Duration) bool {
+	return float64(time.Now().Unix())-grace.Seconds() > t.Payload.Expires
+}
+
 func randomHexString(length int) (string, error) {
 	data := make([]byte, length)
 	_, err := rand.Read(data)
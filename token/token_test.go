@@ -115,6 +115,23 @@ func Test_TokenExpired(t *testing.T) {
 
 }
 
+func TestTokenExpiredAfter(t *testing.T) {
+	payload := TokenPayload{
+		Uid:     1234,
+		Node:    "http://node.mozilla.org",
+		Expires: float64(time.Now().Unix() - 30),
+	}
+
+	generatedToken, err := NewToken([]byte("thisisasecret"), payload)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.True(t, generatedToken.ExpiredAfter(0))
+	assert.True(t, generatedToken.ExpiredAfter(10*time.Second))
+	assert.False(t, generatedToken.ExpiredAfter(time.Minute))
+}
+
 func TestTokenPayload(t *testing.T) {
 	payload := TokenPayload{
 		Uid:     1234,
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var ErrAdminUnauthorized = errors.New("Admin token required")
+
+type AdminConfig struct {
+	// Token, when set, must be sent as "Authorization: Bearer <Token>"
+	Token string
+
+	// Pprof serves net/http/pprof at /debug/pprof/
+	Pprof bool
+
+	// PoolStats is served at /pool/stats
+	PoolStats func() PoolStats
+
+	// Users, when set, serves the /users/{uid} endpoints of the
+	// AdminUserHandler. They can delete data so they are only served
+	// when Token is set. Each request is logged to AuditLog, or to the
+	// standard logger when it is nil
+	Users    *SyncPoolHandler
+	AuditLog *log.Logger
+}
+
+// AdminHandler serves endpoints for operators: metrics, profiling, pool
+// stats and managing users. It is meant for its own listener that is not reachable
+// by sync clients
+type AdminHandler struct {
+	router *mux.Router
+	config AdminConfig
+}
+
+func NewAdminHandler(config AdminConfig) *AdminHandler {
+	r := mux.NewRouter()
+	h := &AdminHandler{
+		router: r,
+		config: config,
+	}
+
+	r.Handle("/__metrics__", DefaultMetrics)
+
+	if config.PoolStats != nil {
+		r.HandleFunc("/pool/stats", h.handlePoolStats).Methods("GET")
+	}
+
+	if config.Users != nil {
+		if config.Token == "" {
+			log.Warn("AdminHandler: /users/ endpoints disabled, they need an admin token")
+		} else {
+			r.PathPrefix("/users/").Handler(NewAdminUserHandler(config.Users, config.AuditLog))
+		}
+	}
+
+	if config.Pprof {
+		r.PathPrefix("/debug/pprof/").Handler(NewPprofHandler(http.NotFoundHandler()))
+	}
+
+	return h
+}
+
+// Handle adds another admin endpoint. It gets the same authentication
+func (h *AdminHandler) Handle(path string, handler http.Handler) *mux.Route {
+	return h.router.Handle(path, handler)
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.config.Token != "" && !h.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		sendRequestProblem(w, req, http.StatusUnauthorized, ErrAdminUnauthorized)
+		return
+	}
+
+	h.router.ServeHTTP(w, req)
+}
+
+func (h *AdminHandler) authorized(req *http.Request) bool {
+	const prefix = "Bearer "
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	given := []byte(strings.TrimPrefix(auth, prefix))
+	return subtle.ConstantTimeCompare(given, []byte(h.config.Token)) == 1
+}
+
+func (h *AdminHandler) handlePoolStats(w http.ResponseWriter, req *http.Request) {
+	JSON(w, req, http.StatusOK, h.config.PoolStats())
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandlerToken(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewAdminHandler(AdminConfig{Token: "s3cret"})
+
+	resp := request("GET", "http://admin/__metrics__", nil, handler)
+	assert.Equal(http.StatusUnauthorized, resp.Code)
+
+	for auth, code := range map[string]int{
+		"Bearer wrong":  http.StatusUnauthorized,
+		"s3cret":        http.StatusUnauthorized,
+		"Bearer s3cret": http.StatusOK,
+	} {
+		resp := requestheaders("GET", "http://admin/__metrics__", nil,
+			http.Header{"Authorization": {auth}}, handler)
+		assert.Equal(code, resp.Code, auth)
+	}
+}
+
+func TestAdminHandlerRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewAdminHandler(AdminConfig{
+		PoolStats: func() PoolStats { return PoolStats{Open: 3, Requests: 10} },
+	})
+
+	resp := request("GET", "http://admin/pool/stats", nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var stats map[string]int
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &stats))
+		assert.Equal(3, stats["open"])
+		assert.Equal(10, stats["requests"])
+	}
+
+	// pprof is off unless asked for
+	resp = request("GET", "http://admin/debug/pprof/", nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	handler = NewAdminHandler(AdminConfig{Pprof: true})
+	resp = request("GET", "http://admin/debug/pprof/", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// users can not be managed without a token
+	handler = NewAdminHandler(AdminConfig{Users: NewSyncPoolHandler(testSyncPoolConfig(), nil)})
+	resp = request("GET", "http://admin/users/"+uniqueUID(), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// more endpoints can be added
+	handler.Handle("/extra", EchoHandler)
+	resp = request("GET", "http://admin/extra", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
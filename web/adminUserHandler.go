@@ -0,0 +1,157 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// AdminUserHandler serves the /users/{uid} admin endpoints to inspect
+// and manage a user's storage:
+//
+//	GET    /users/{uid}          collections, counts and usage
+//	GET    /users/{uid}/batches  uncommitted batches
+//	POST   /users/{uid}/tidy     purge expired BSOs and batches now
+//	POST   /users/{uid}/vacuum   vacuum the DB
+//	POST   /users/{uid}/evict    close the DB and remove it from the pool
+//	DELETE /users/{uid}          delete all data and the DB files
+//
+// Every request is written to the audit log
+type AdminUserHandler struct {
+	router *mux.Router
+	pool   *SyncPoolHandler
+	audit  *log.Logger
+}
+
+// adminUserAction does the work for an endpoint and returns what is
+// sent back as JSON
+type adminUserAction func(uid string) (interface{}, error)
+
+// NewAdminUserHandler creates an AdminUserHandler. A nil audit logger
+// writes to the standard logger
+func NewAdminUserHandler(pool *SyncPoolHandler, audit *log.Logger) *AdminUserHandler {
+	if audit == nil {
+		audit = log.StandardLogger()
+	}
+
+	r := mux.NewRouter()
+	h := &AdminUserHandler{
+		router: r,
+		pool:   pool,
+		audit:  audit,
+	}
+
+	const user = "/users/{uid:[0-9]+}"
+	r.HandleFunc(user, h.handle("info", h.info)).Methods("GET")
+	r.HandleFunc(user, h.handle("delete", h.delete)).Methods("DELETE")
+	r.HandleFunc(user+"/batches", h.handle("batches", h.batches)).Methods("GET")
+	r.HandleFunc(user+"/tidy", h.handle("tidy", h.tidy)).Methods("POST")
+	r.HandleFunc(user+"/vacuum", h.handle("vacuum", h.vacuum)).Methods("POST")
+	r.HandleFunc(user+"/evict", h.handle("evict", h.evict)).Methods("POST")
+
+	return h
+}
+
+func (h *AdminUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.router.ServeHTTP(w, req)
+}
+
+// handle runs the action, writes the audit log entry and sends the
+// result
+func (h *AdminUserHandler) handle(name string, action adminUserAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		uid := mux.Vars(req)["uid"]
+
+		start := time.Now()
+		result, err := action(uid)
+
+		status := http.StatusOK
+		if err != nil {
+			status = adminErrorStatus(err)
+		}
+
+		fields := log.Fields{
+			"action": name,
+			"uid":    uid,
+			"remote": req.RemoteAddr,
+			"agent":  req.UserAgent(),
+			"status": status,
+			"t":      int64(time.Since(start) / time.Millisecond),
+		}
+		if err != nil {
+			fields["err"] = err.Error()
+		}
+		h.audit.WithFields(fields).Info("Admin audit")
+
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				InternalError(w, req, err)
+			} else {
+				sendRequestProblem(w, req, status, err)
+			}
+			return
+		}
+
+		JSON(w, req, http.StatusOK, result)
+	}
+}
+
+func adminErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case ErrUserNotFound:
+		return http.StatusNotFound
+	case ErrUserBusy:
+		return http.StatusConflict
+	case ErrPoolStopped:
+		return http.StatusServiceUnavailable
+	case ErrNotSupported:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *AdminUserHandler) info(uid string) (interface{}, error) {
+	return h.pool.UserInfo(uid)
+}
+
+func (h *AdminUserHandler) batches(uid string) (interface{}, error) {
+	batches, err := h.pool.UserBatches(uid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"batches": batches}, nil
+}
+
+func (h *AdminUserHandler) tidy(uid string) (interface{}, error) {
+	took, err := h.pool.TidyUpUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"t": int64(took / time.Millisecond)}, nil
+}
+
+func (h *AdminUserHandler) vacuum(uid string) (interface{}, error) {
+	beforeKB, afterKB, err := h.pool.VacuumUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"before_kb": beforeKB,
+		"after_kb":  afterKB,
+	}, nil
+}
+
+func (h *AdminUserHandler) evict(uid string) (interface{}, error) {
+	return map[string]interface{}{"evicted": h.pool.EvictUser(uid)}, nil
+}
+
+func (h *AdminUserHandler) delete(uid string) (interface{}, error) {
+	if err := h.pool.DeleteUser(uid); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"deleted": true}, nil
+}
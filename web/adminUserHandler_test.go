@@ -0,0 +1,303 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuditLog() (*log.Logger, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	audit := log.New()
+	audit.Out = buf
+	audit.Formatter = &log.JSONFormatter{}
+	return audit, buf
+}
+
+// testAdminUserHandler serves the /users/ endpoints of pool and sends
+// the admin token with every request
+func testAdminUserHandler(pool *SyncPoolHandler, audit *log.Logger) http.Handler {
+	handler := NewAdminHandler(AdminConfig{Token: "s3cret", Users: pool, AuditLog: audit})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Set("Authorization", "Bearer s3cret")
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func TestAdminUserHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	audit, auditBuf := testAuditLog()
+	handler := testAdminUserHandler(pool, audit)
+
+	// users without a DB are not created
+	resp := request("GET", "http://admin/users/"+uid, nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+	assert.Nil(pool.pools[0].peekElement(uid))
+
+	body := bytes.NewBufferString(`[{"id":"b0", "payload":"hello"}, {"id":"b1", "payload":"world"}]`)
+	resp = jsonrequest("POST", syncurl(uid, "storage/bookmarks"), body, pool)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	body = bytes.NewBufferString(`[{"id":"h0", "payload":"pending"}]`)
+	resp = jsonrequest("POST", syncurl(uid, "storage/history?batch=true"), body, pool)
+	if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("GET", "http://admin/users/"+uid, nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		var info UserInfo
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &info))
+		assert.Equal(2, info.Counts["bookmarks"])
+		assert.Equal(10, info.Usage["bookmarks"])
+		assert.Contains(info.Collections, "bookmarks")
+		assert.NotContains(info.Collections, "history")
+		assert.True(info.SizeKB > 0)
+	}
+
+	resp = request("GET", "http://admin/users/"+uid+"/batches", nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		var result struct {
+			Batches []map[string]interface{} `json:"batches"`
+		}
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &result))
+		if assert.Len(result.Batches, 1) {
+			assert.Equal("history", result.Batches[0]["collection"])
+		}
+	}
+
+	resp = request("POST", "http://admin/users/"+uid+"/tidy", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = request("POST", "http://admin/users/"+uid+"/vacuum", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(resp.Body.String(), "after_kb")
+
+	resp = request("POST", "http://admin/users/"+uid+"/evict", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(`{"evicted":true}`, resp.Body.String())
+	assert.Nil(pool.pools[0].peekElement(uid))
+
+	resp = request("POST", "http://admin/users/"+uid+"/evict", nil, handler)
+	assert.Equal(`{"evicted":false}`, resp.Body.String())
+
+	// only uids are matched
+	resp = request("GET", "http://admin/users/abc", nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// everything that reached an action is audited
+	lines := strings.Split(strings.TrimSpace(auditBuf.String()), "\n")
+	if assert.Len(lines, 7) {
+		var entry map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal("info", entry["action"])
+		assert.Equal(uid, entry["uid"])
+		assert.Equal(float64(http.StatusNotFound), entry["status"])
+		assert.Equal(ErrUserNotFound.Error(), entry["err"])
+
+		entry = nil
+		assert.NoError(json.Unmarshal([]byte(lines[5]), &entry))
+		assert.Equal("evict", entry["action"])
+		assert.Equal(float64(http.StatusOK), entry["status"])
+		assert.Nil(entry["err"])
+	}
+}
+
+func TestAdminUserHandlerDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "adminuser")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	uid := uniqueUID()
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	audit, auditBuf := testAuditLog()
+	handler := testAdminUserHandler(pool, audit)
+
+	resp := request("DELETE", "http://admin/users/"+uid, nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	body := bytes.NewBufferString(`[{"id":"b0", "payload":"hello"}]`)
+	resp = jsonrequest("POST", syncurl(uid, "storage/bookmarks"), body, pool)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	path, file := pool.pools[0].PathAndFile(uid)
+	dbFile := filepath.Join(path, file)
+	_, err = os.Stat(dbFile)
+	if !assert.NoError(err) {
+		return
+	}
+
+	resp = request("DELETE", "http://admin/users/"+uid, nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	assert.Nil(pool.pools[0].peekElement(uid))
+	for _, f := range []string{dbFile, dbFile + "-wal", dbFile + "-shm"} {
+		_, err = os.Stat(f)
+		assert.True(os.IsNotExist(err), f)
+	}
+
+	resp = request("GET", "http://admin/users/"+uid, nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// the user starts over on their next request
+	resp = request("GET", syncurl(uid, "info/collection_counts"), nil, pool)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("{}", resp.Body.String())
+
+	assert.Contains(auditBuf.String(), `"action":"delete"`)
+}
+
+func TestSyncPoolHandlerDeleteUserReserves(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "adminuser")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	uid := uniqueUID()
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	body := bytes.NewBufferString(`[{"id":"b0", "payload":"hello"}]`)
+	resp := jsonrequest("POST", syncurl(uid, "storage/bookmarks"), body, pool)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// a request in flight keeps the delete from finishing
+	p := pool.pools[0]
+	element := p.peekElement(uid)
+	element.handler.requestLock.RLock()
+
+	done := make(chan error)
+	go func() { done <- pool.DeleteUser(uid) }()
+
+	for {
+		p.Lock()
+		_, reserved := p.reserved[uid]
+		p.Unlock()
+		if reserved {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the DB can not be opened again until its files are removed
+	_, _, err = p.getElement(uid)
+	assert.Equal(errElementStopped, err)
+
+	element.handler.requestLock.RUnlock()
+	assert.NoError(<-done)
+
+	path, file := p.PathAndFile(uid)
+	_, err = os.Stat(filepath.Join(path, file))
+	assert.True(os.IsNotExist(err))
+	assert.Nil(p.peekElement(uid))
+	assert.Len(p.reserved, 0)
+}
+
+func TestSyncPoolHandlerEvictUserNotHandedOut(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	defer pool.StopHTTP()
+
+	p := pool.pools[0]
+	element, _, err := p.getElement(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// a request in flight keeps StopHTTP waiting
+	element.handler.requestLock.RLock()
+
+	evicted := make(chan bool)
+	go func() { evicted <- pool.EvictUser(uid) }()
+
+	for i := 0; i < 100; i++ {
+		if p.peekElement(uid) == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the handler being stopped is never handed out
+	_, _, err = p.getElement(uid)
+	assert.Equal(errElementStopped, err)
+
+	element.handler.requestLock.RUnlock()
+	assert.True(<-evicted)
+	assert.Len(p.reserved, 0)
+}
+
+func TestAdminUserHandlerDeleteClearsCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "adminuser")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	uid := uniqueUID()
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	cache := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+	pool.Cache = cache
+	handler := testAdminUserHandler(pool, nil)
+
+	body := bytes.NewBufferString(`[{"id":"b0", "payload":"hello"}]`)
+	resp := jsonrequest("POST", syncurl(uid, "storage/bookmarks"), body, cache)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// fill the cache
+	resp = request("GET", syncurl(uid, "info/collections"), nil, cache)
+	if !assert.Contains(resp.Body.String(), "bookmarks") {
+		return
+	}
+
+	resp = request("DELETE", "http://admin/users/"+uid, nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "info/collections"), nil, cache)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("{}", resp.Body.String())
+}
@@ -83,13 +83,20 @@ func (s *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 					"uid": uid,
 				}).Debug("CacheHandler clear")
 			}
-			s.cache.Set(uid, nil)
+			s.ClearUser(uid)
 		}
 		s.handler.ServeHTTP(w, req)
 		return
 	}
 }
 
+// ClearUser drops the cached data of uid. It is for changes that do
+// not go through the CacheHandler, like deleting a user from the
+// admin API
+func (s *CacheHandler) ClearUser(uid string) {
+	s.cache.Set(uid, nil)
+}
+
 // for serialization of the json body and last modified header
 // values into one []byte. The X-Last-Modified timestamp is 13 bytes
 // ie: 1234567890.12.
@@ -101,6 +108,8 @@ const lastModifiedBytes = 13
 func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *http.Request) {
 	// cache hit
 	if data, err := s.cache.Get(uid); err == nil && len(data) > 0 {
+		metricCache.Inc("info_collections", "hit")
+
 		// TODO in change this
 		lastModified := string(data[:lastModifiedBytes])
 
@@ -125,6 +134,7 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 	}
 
 	// cache miss...
+	metricCache.Inc("info_collections", "miss")
 	cacheWriter := newCacheResponseWriter(w)
 	s.handler.ServeHTTP(cacheWriter, req)
 
@@ -147,6 +157,8 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 
 func (s *CacheHandler) infoConfiguration(uid string, w http.ResponseWriter, req *http.Request) {
 	if data, err := s.cache.Get("config"); err == nil && len(data) > 0 {
+		metricCache.Inc("info_configuration", "hit")
+
 		// add the the X-Last-Modified header
 		w.Header().Set("Content-Type", "application/json")
 		io.Copy(w, bytes.NewReader(data))
@@ -154,6 +166,7 @@ func (s *CacheHandler) infoConfiguration(uid string, w http.ResponseWriter, req
 	}
 
 	// fill the cache ...
+	metricCache.Inc("info_configuration", "miss")
 	cacheWriter := newCacheResponseWriter(w)
 	s.handler.ServeHTTP(cacheWriter, req)
 
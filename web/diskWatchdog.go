@@ -0,0 +1,167 @@
+package web
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var ErrInsufficientStorage = errors.New("Not enough free disk space")
+
+// disk levels of the DiskWatchdogHandler
+const (
+	diskOK int32 = iota
+	diskLow
+	diskFull
+)
+
+type DiskWatchdogConfig struct {
+	// Dir is the directory whose filesystem is watched
+	Dir string
+
+	// how often free space is sampled
+	Interval time.Duration
+
+	// Below the soft limits clients are sent X-Weave-Backoff. Below the
+	// hard limits writes are rejected with a 507. 0 disables a limit
+	SoftKB     int
+	HardKB     int
+	SoftInodes int
+	HardInodes int
+
+	// seconds sent in X-Weave-Backoff
+	BackoffSeconds int
+}
+
+// DiskWatchdogHandler samples the free space and inodes of the data
+// directory in the background. When they get low clients are asked to
+// back off. When they get too low POSTs and PUTs are rejected before
+// sqlite can fail in the middle of a transaction. GETs and DELETEs
+// always pass through so users can still free up space
+type DiskWatchdogHandler struct {
+	handler http.Handler
+	config  DiskWatchdogConfig
+
+	level int32
+
+	// replaced in tests
+	diskFree func(path string) (kb uint64, inodes uint64, err error)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewDiskWatchdogHandler(h http.Handler, config DiskWatchdogConfig) *DiskWatchdogHandler {
+	d := &DiskWatchdogHandler{
+		handler:  h,
+		config:   config,
+		diskFree: diskFree,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	d.check()
+
+	if config.Interval > 0 {
+		go d.run()
+	} else {
+		close(d.done)
+	}
+
+	return d
+}
+
+func (d *DiskWatchdogHandler) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.check()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Stop ends background sampling
+func (d *DiskWatchdogHandler) Stop() {
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	<-d.done
+}
+
+// check samples the disk and updates the level
+func (d *DiskWatchdogHandler) check() {
+	kb, inodes, err := d.diskFree(d.config.Dir)
+	if err != nil {
+		// don't block writes because we can't tell
+		log.WithFields(log.Fields{
+			"dir": d.config.Dir,
+			"err": err.Error(),
+		}).Error("DiskWatchdog could not get free space")
+		return
+	}
+
+	below := func(free uint64, limit int) bool {
+		return limit > 0 && free < uint64(limit)
+	}
+
+	level := diskOK
+	if below(kb, d.config.HardKB) || below(inodes, d.config.HardInodes) {
+		level = diskFull
+	} else if below(kb, d.config.SoftKB) || below(inodes, d.config.SoftInodes) {
+		level = diskLow
+	}
+
+	if prev := atomic.SwapInt32(&d.level, level); prev != level {
+		fields := log.Fields{
+			"dir":         d.config.Dir,
+			"free_kb":     kb,
+			"free_inodes": inodes,
+		}
+
+		switch level {
+		case diskFull:
+			log.WithFields(fields).Error("DiskWatchdog rejecting writes")
+		case diskLow:
+			log.WithFields(fields).Warn("DiskWatchdog sending backoff")
+		default:
+			log.WithFields(fields).Info("DiskWatchdog disk space OK")
+		}
+	}
+}
+
+func (d *DiskWatchdogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	level := atomic.LoadInt32(&d.level)
+	if level == diskOK {
+		d.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("X-Weave-Backoff", strconv.Itoa(d.config.BackoffSeconds))
+
+	if level == diskFull && (r.Method == "POST" || r.Method == "PUT") {
+		if r.Body != nil {
+			io.Copy(ioutil.Discard, r.Body)
+			r.Body.Close()
+		}
+
+		WeaveInsufficientStorage(w, r, ErrInsufficientStorage)
+		return
+	}
+
+	d.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskWatchdogHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DiskWatchdogConfig{
+		Dir:            "/data",
+		SoftKB:         1000,
+		HardKB:         100,
+		SoftInodes:     50,
+		HardInodes:     5,
+		BackoffSeconds: 1800,
+	}
+
+	var freeKB, freeInodes uint64 = 10000, 10000
+	handler := NewDiskWatchdogHandler(EchoHandler, config)
+	handler.diskFree = func(path string) (uint64, uint64, error) {
+		assert.Equal("/data", path)
+		return freeKB, freeInodes, nil
+	}
+	defer handler.Stop()
+
+	send := func(method string) *http.Response {
+		resp := request(method, syncurl(uniqueUID(), "storage/col/b0"), bytes.NewBufferString("{}"), handler)
+		return resp.Result()
+	}
+
+	{ // plenty of space
+		handler.check()
+		resp := send("PUT")
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal("", resp.Header.Get("X-Weave-Backoff"))
+	}
+
+	{ // below the soft limit
+		freeKB = 500
+		handler.check()
+		for _, method := range []string{"GET", "PUT", "POST", "DELETE"} {
+			resp := send(method)
+			assert.Equal(http.StatusOK, resp.StatusCode, method)
+			assert.Equal("1800", resp.Header.Get("X-Weave-Backoff"), method)
+		}
+	}
+
+	{ // below the hard limit
+		freeKB = 50
+		handler.check()
+		for _, method := range []string{"PUT", "POST"} {
+			resp := request(method, syncurl(uniqueUID(), "storage/col?batch=true"), bytes.NewBufferString("[]"), handler)
+			assert.Equal(http.StatusInsufficientStorage, resp.Code, method)
+			assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+			assert.Equal("1800", resp.Header().Get("X-Weave-Backoff"))
+		}
+
+		for _, method := range []string{"GET", "DELETE"} {
+			resp := send(method)
+			assert.Equal(http.StatusOK, resp.StatusCode, method)
+			assert.Equal("1800", resp.Header.Get("X-Weave-Backoff"), method)
+		}
+	}
+
+	{ // running out of inodes counts too
+		freeKB = 10000
+		freeInodes = 1
+		handler.check()
+		assert.Equal(http.StatusInsufficientStorage, send("PUT").StatusCode)
+
+		freeInodes = 20
+		handler.check()
+		assert.Equal(http.StatusOK, send("PUT").StatusCode)
+		assert.Equal("1800", send("PUT").Header.Get("X-Weave-Backoff"))
+	}
+
+	{ // recovers
+		freeInodes = 10000
+		handler.check()
+		assert.Equal("", send("PUT").Header.Get("X-Weave-Backoff"))
+	}
+}
+
+func TestDiskWatchdogHandlerDisabledLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewDiskWatchdogHandler(EchoHandler, DiskWatchdogConfig{Dir: "/data"})
+	handler.diskFree = func(path string) (uint64, uint64, error) {
+		return 0, 0, nil
+	}
+	defer handler.Stop()
+
+	handler.check()
+	resp := request("PUT", syncurl(uniqueUID(), "storage/col/b0"), bytes.NewBufferString("{}"), handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package web
+
+import "github.com/pkg/errors"
+
+func diskFree(path string) (kb uint64, inodes uint64, err error) {
+	return 0, 0, errors.New("diskFree not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package web
+
+import "syscall"
+
+// diskFree returns the KB and inodes available to unprivileged users
+// on the filesystem that holds path
+func diskFree(path string) (kb uint64, inodes uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize) / 1024, uint64(st.Ffree), nil
+}
@@ -6,13 +6,15 @@ import (
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/mozilla-services/go-syncstorage/token"
 	"github.com/pkg/errors"
-	"github.com/willf/bloom"
 	"go.mozilla.org/hawk"
 )
 
@@ -20,40 +22,101 @@ var (
 	EmptyData       = []byte{}
 	ErrTokenInvalid = errors.New("Token is invalid")
 	ErrTokenExpired = errors.New("Token is expired")
+	ErrTokenNode    = errors.New("Token is for another node")
 )
 
 type HawkHandler struct {
 	handler http.Handler
 
-	// bloom filters for nonce checking
-	bloomPrev *bloom.BloomFilter
-	bloomNow  *bloom.BloomFilter
+	secrets     []Secret
+	secretsLock sync.RWMutex
 
-	// use to control rotation of bloom filters
-	bloomHalflife time.Duration
-	lastRotate    time.Time
-	bloomLock     sync.Mutex
+	// Tokens caches parsed tokens. nil disables caching
+	Tokens *TokenCache
 
-	secrets []string
+	// Nonces catches replayed requests. Replace it to change its size
+	// or to save nonces across restarts
+	Nonces *NonceCache
+
+	// ExpiryGrace is how long after a token's expiry it will still be
+	// accepted. It allows for small differences between the tokenserver's
+	// clock and ours and is independent of hawk.MaxTimestampSkew
+	ExpiryGrace time.Duration
+
+	// ServerAuthorization adds a Server-Authorization header to
+	// authenticated responses so clients can verify them. It has a hash
+	// of the body so responses are buffered before they are sent
+	ServerAuthorization bool
+
+	// PublicURLs are the URLs clients reach this server with. A token's
+	// Node must match one of them. Empty disables the check
+	PublicURLs []string
+
+	// EnforcePublicURL rejects tokens for other nodes with a 401 so clients
+	// get a new token. When false mismatches are only logged
+	EnforcePublicURL bool
 }
 
 func NewHawkHandler(handler http.Handler, secrets []string) *HawkHandler {
-	// the m value for the bloom filter is likely larger than
-	// we need. It figures 60,000 requests/minute * 50 = 3,000,000 bits
-	// or ~2.8MB. The code rotates between two of them so about 5.6MB
-	// of memory for nonce checking.
-
-	m := uint(1000 * 60 * 50)
 	return &HawkHandler{
-		handler:       handler,
-		secrets:       secrets,
-		bloomPrev:     bloom.New(m, 5),
-		bloomNow:      bloom.New(m, 5),
-		bloomHalflife: 30 * time.Second,
-		lastRotate:    time.Now(),
+		handler: handler,
+		secrets: NewSecrets(secrets),
+		Nonces:  NewNonceCache(NonceCacheConfig{}),
+		Tokens:  NewTokenCache(defaultTokenCacheSize),
 	}
 }
 
+// SetSecrets replaces the secrets tokens are verified with. Cached tokens
+// are dropped so ones signed with a removed secret stop working
+func (h *HawkHandler) SetSecrets(secrets []Secret) {
+	h.secretsLock.Lock()
+	defer h.secretsLock.Unlock()
+
+	h.secrets = secrets
+	if h.Tokens != nil {
+		h.Tokens.Purge()
+	}
+}
+
+// parseToken verifies the token with each active secret until one works.
+// It also returns the index of the secret that worked
+func (h *HawkHandler) parseToken(tokenString string) (token.Token, int, error) {
+	h.secretsLock.RLock()
+	defer h.secretsLock.RUnlock()
+
+	now := time.Now()
+
+	if h.Tokens != nil {
+		if parsedToken, index, ok := h.Tokens.Get(tokenString); ok {
+			// the secret may have been retired since
+			if h.secrets[index].Active(now) {
+				return parsedToken, index, nil
+			}
+		}
+	}
+
+	var tokenError error = ErrTokenInvalid
+	for index, secret := range h.secrets {
+		if !secret.Active(now) {
+			continue
+		}
+
+		parsedToken, err := token.ParseToken([]byte(secret.Value), tokenString)
+		if err != nil {
+			tokenError = err
+			continue
+		}
+
+		if h.Tokens != nil {
+			h.Tokens.Add(parsedToken, index)
+		}
+
+		return parsedToken, index, nil
+	}
+
+	return token.Token{}, -1, tokenError
+}
+
 func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Step 0: Create a session context. Added since sendRequestProblem
@@ -79,12 +142,14 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	auth, err := hawk.NewAuthFromRequest(r, nil, h.hawkNonceNotFound)
 	if err != nil {
 		if e, ok := err.(hawk.AuthFormatError); ok {
+			metricHawkFailures.Inc("malformed")
 			sendRequestProblem(w, r, http.StatusForbidden,
 				errors.Errorf("Hawk: Malformed hawk header, field: %s, err: %s", e.Field, e.Err))
 		} else if authError, ok := err.(hawk.AuthError); ok {
 			w.Header().Set("WWW-Authenticate", "Hawk")
 			switch authError {
 			case hawk.ErrReplay: // log the replay'd nonce
+				metricHawkFailures.Inc("replay")
 				authInfo, _ := hawk.ParseRequestHeader(r.Header.Get("Authorization"))
 				sendRequestProblem(w, r, http.StatusForbidden,
 					errors.Errorf("Hawk: Replay nonce=%s", authInfo.Nonce))
@@ -92,30 +157,23 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				// send a 401 for no Authorization header issues to force clients to
 				// fetch a new token. See https://bugzilla.mozilla.org/show_bug.cgi?id=1318799
 				// reasons.
+				metricHawkFailures.Inc("no_auth")
 				sendRequestProblem(w, r, http.StatusUnauthorized, errors.Wrap(err, "Hawk: AuthError"))
 			default:
+				metricHawkFailures.Inc("auth_error")
 				sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: AuthError"))
 			}
 		} else {
+			metricHawkFailures.Inc("unknown")
 			sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: Unknown Error"))
 		}
 		return
 	}
 
 	// Step 2: Extract the Token
-	var (
-		parsedToken token.Token
-		tokenError  error = ErrTokenInvalid
-	)
-
-	for _, secret := range h.secrets {
-		parsedToken, tokenError = token.ParseToken([]byte(secret), auth.Credentials.ID)
-		if tokenError == nil { // found the right secret
-			break
-		}
-	}
-
+	parsedToken, secretIndex, tokenError := h.parseToken(auth.Credentials.ID)
 	if tokenError != nil {
+		metricHawkFailures.Inc("invalid_token")
 		sendRequestProblem(w, r, http.StatusUnauthorized, errors.Wrap(tokenError, "Hawk: Invalid token"))
 		return
 	} else {
@@ -125,15 +183,29 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		auth.Credentials.Hash = sha256.New
 	}
 
-	// Step 3: Make sure it's valid...
-	if err := auth.Valid(); err != nil {
+	// Step 2.5: Reject expired tokens. Send a 401 so clients will fetch
+	// a new token from the tokenserver
+	if parsedToken.ExpiredAfter(h.ExpiryGrace) {
 		w.Header().Set("WWW-Authenticate", "Hawk")
+		metricHawkFailures.Inc("token_expired")
+		sendRequestProblem(w, r, http.StatusUnauthorized,
+			errors.Wrapf(ErrTokenExpired, "Hawk: Token expired at %0.3f", parsedToken.Payload.Expires))
+		return
+	}
 
+	// Step 3: Make sure it's valid...
+	if err := auth.Valid(); err != nil {
 		// special case, want to see how far client clocks are off
 		if err == hawk.ErrTimestampSkew {
+			// send our time, signed with the token's key, so the
+			// client can correct its clock and retry
+			w.Header().Set("WWW-Authenticate", auth.StaleTimestampHeader())
 			skew := auth.ActualTimestamp.Sub(auth.Timestamp)
+			metricHawkFailures.Inc("timestamp_skew")
 			sendRequestProblem(w, r, http.StatusForbidden, errors.Errorf("Hawk: timestamp skew too large %0.3f", skew.Seconds()))
 		} else {
+			w.Header().Set("WWW-Authenticate", "Hawk")
+			metricHawkFailures.Inc("invalid_mac")
 			sendRequestProblem(w, r, http.StatusForbidden, errors.Wrap(err, "Hawk: auth invalid"))
 		}
 		return
@@ -148,16 +220,37 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// a strange series of events can cause clients to use a token that doesn't
 			// match the URL. Sending a 401 should cause clients to abort, fetch a new token
 			// and regenerate the correct URL
+			metricHawkFailures.Inc("uid_mismatch")
 			sendRequestProblem(w, r, http.StatusUnauthorized,
 				errors.Errorf("Hawk: UID in URL (%s) != Token UID (%s)", pathUID, tokenUid))
 			return
 		}
 	}
 
+	// Step 4.5: Make sure the token was issued for this node. A token for
+	// another node means the tokenserver sent the user elsewhere and data
+	// written here would be split from the rest of it
+	if len(h.PublicURLs) > 0 && !h.nodeMatches(parsedToken.Payload.Node) {
+		if h.EnforcePublicURL {
+			metricNodeMismatch.Inc("reject")
+			metricHawkFailures.Inc("node_mismatch")
+			sendRequestProblem(w, r, http.StatusUnauthorized,
+				errors.Wrapf(ErrTokenNode, "Hawk: Token node %s", parsedToken.Payload.Node))
+			return
+		}
+
+		metricNodeMismatch.Inc("log")
+		log.WithFields(log.Fields{
+			"uid":  parsedToken.Payload.UidString(),
+			"node": parsedToken.Payload.Node,
+		}).Warn("HawkHandler token node does not match PUBLIC_URL")
+	}
+
 	// Step 5: Validate the payload hash if it exists
 	if auth.Hash != nil {
 		contentType := r.Header.Get("Content-Type")
 		if contentType == "" {
+			metricHawkFailures.Inc("content_type")
 			sendRequestProblem(w, r, http.StatusBadRequest,
 				errors.New("Hawk: Content-Type required"))
 			return
@@ -165,6 +258,7 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		mediaType, _, err := mime.ParseMediaType(contentType)
 		if err != nil {
+			metricHawkFailures.Inc("content_type")
 			sendRequestProblem(w, r, http.StatusBadRequest,
 				errors.Wrap(err, "Hawk: Could not parse Content-Type"))
 			return
@@ -173,6 +267,10 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// read and replace io.Reader
 		content, err := ioutil.ReadAll(r.Body)
 		if err != nil {
+			if requestTooLarge(err) {
+				WeaveRequestTooLarge(w, r, errors.Wrap(err, "Hawk: Could not read request body"))
+				return
+			}
 			sendRequestProblem(w, r, http.StatusBadRequest,
 				errors.Wrap(err, "Hawk: Could not read request body"))
 			return
@@ -183,6 +281,7 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pHash.Write(content)
 		if !auth.ValidHash(pHash) {
 			w.Header().Set("WWW-Authenticate", "Hawk")
+			metricHawkFailures.Inc("payload_hash")
 			sendRequestProblem(w, r, http.StatusForbidden,
 				errors.New("Hawk: payload hash invalid"))
 			return
@@ -191,35 +290,98 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Step 6: Update the session token and pass it on
 	session.Token = parsedToken.Payload
-	h.handler.ServeHTTP(w, r)
+	session.SecretIndex = secretIndex
+	metricTokenSecret.Inc(strconv.Itoa(secretIndex))
+
+	if !h.ServerAuthorization {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
 
+	sw := &serverAuthWriter{ResponseWriter: w, code: http.StatusOK}
+	h.handler.ServeHTTP(sw, r)
+	sw.send(auth)
+}
+
+// serverAuthWriter holds on to a response until its body can be hashed
+// for the Server-Authorization header
+type serverAuthWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (s *serverAuthWriter) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		s.code = code
+	}
+}
+
+func (s *serverAuthWriter) Write(data []byte) (int, error) {
+	s.wroteHeader = true
+	return s.body.Write(data)
+}
+
+// send signs and writes the buffered response
+func (s *serverAuthWriter) send(auth *hawk.Auth) {
+	mediaType, _, _ := mime.ParseMediaType(s.Header().Get("Content-Type"))
+	pHash := auth.PayloadHash(mediaType)
+	pHash.Write(s.body.Bytes())
+	auth.SetHash(pHash)
+
+	s.Header().Set("Server-Authorization", auth.ResponseHeader(""))
+	s.ResponseWriter.WriteHeader(s.code)
+	s.ResponseWriter.Write(s.body.Bytes())
 }
 
 func (h *HawkHandler) hawkNonceNotFound(nonce string, t time.Time, creds *hawk.Credentials) bool {
 	// From the Docs:
 	//   The nonce is generated by the client, and is a string unique across all
 	//   requests with the same timestamp and key identifier combination.
-	var key string
+	var id string
 	if creds != nil {
-		key = nonce + t.String() + creds.ID
-	} else {
-		key = nonce + t.String()
+		id = creds.ID
 	}
 
-	// rotate the blooms?
-	h.bloomLock.Lock()
-	now := time.Now()
-	if now.Sub(h.lastRotate) > h.bloomHalflife {
-		h.bloomNow, h.bloomPrev = h.bloomPrev, h.bloomNow // switcheroo
-		h.bloomNow.ClearAll()
-		h.lastRotate = now
-	}
-	h.bloomLock.Unlock()
+	return h.Nonces.Check(nonce, t, id)
+}
 
-	if h.bloomNow.TestString(key) || h.bloomPrev.TestString(key) {
+// nodeMatches checks if node is one of the PublicURLs
+func (h *HawkHandler) nodeMatches(node string) bool {
+	normalized, err := normalizeNode(node)
+	if err != nil {
 		return false
 	}
 
-	h.bloomNow.AddString(key)
-	return true
+	for _, publicURL := range h.PublicURLs {
+		if n, err := normalizeNode(publicURL); err == nil && n == normalized {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeNode reduces a node URL to its lower case scheme and host,
+// without a default port, so equivalent URLs compare equal
+func normalizeNode(node string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(node))
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.Errorf("Missing scheme or host in %s", node)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if (scheme == "https" && strings.HasSuffix(host, ":443")) ||
+		(scheme == "http" && strings.HasSuffix(host, ":80")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+
+	return scheme + "://" + host, nil
 }
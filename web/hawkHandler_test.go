@@ -13,6 +13,7 @@ import (
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/mozilla-services/go-syncstorage/token"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"go.mozilla.org/hawk"
 )
@@ -80,7 +81,7 @@ func testtoken(secret string, uid uint64) token.Token {
 	payload := token.TokenPayload{
 		Uid:      uid,
 		Node:     node,
-		Expires:  float64(syncstorage.Now()+60) / 1000,
+		Expires:  float64(syncstorage.Now())/1000 + 60,
 		Salt:     "pacific",
 		FxaUID:   "fxa_" + strconv.FormatUint(uid, 10),
 		DeviceId: "device_" + strconv.FormatUint(uid, 10),
@@ -94,11 +95,69 @@ func testtoken(secret string, uid uint64) token.Token {
 	return tok
 }
 
+// expiredtoken creates a token that expired `ago` in the past
+func expiredtoken(secret string, uid uint64, ago time.Duration) token.Token {
+	payload := token.TokenPayload{
+		Uid:     uid,
+		Node:    "https://syncnode-12345.services.mozilla.com",
+		Expires: float64(time.Now().Add(-ago).Unix()),
+		Salt:    "pacific",
+	}
+
+	tok, err := token.NewToken([]byte(secret), payload)
+	if err != nil {
+		panic(err)
+	}
+
+	return tok
+}
+
+func TestHawkTokenExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := expiredtoken(hawkH.secrets[0].Value, uid, 10*time.Second)
+
+	session := &Session{}
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	req = req.WithContext(NewSessionContext(req.Context(), session))
+
+	resp := sendrequest(req, hawkH)
+	assert.Equal(http.StatusUnauthorized, resp.Code)
+	assert.Equal("Hawk", resp.Header().Get("WWW-Authenticate"))
+	if assert.Error(session.ErrorResult) {
+		assert.Equal(ErrTokenExpired, errors.Cause(session.ErrorResult))
+	}
+}
+
+func TestHawkTokenExpiryGrace(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	hawkH.ExpiryGrace = time.Minute
+
+	{ // expired, but within the grace window
+		tok := expiredtoken(hawkH.secrets[0].Value, uid, 10*time.Second)
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	{ // expired beyond the grace window
+		tok := expiredtoken(hawkH.secrets[0].Value, uid, 2*time.Minute)
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusUnauthorized, resp.Code)
+	}
+}
+
 func TestHawkUidMismatchFails(t *testing.T) {
 	var uid uint64 = 12345
 
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
-	tok := testtoken(hawkH.secrets[0], uid)
+	tok := testtoken(hawkH.secrets[0].Value, uid)
 
 	// provide a different UID in the sync url
 	req, _ := hawkrequest("GET", syncurl("67890", "info/collections"), tok)
@@ -126,7 +185,7 @@ func TestHawkMultiSecrets(t *testing.T) {
 	hawkH := NewHawkHandler(EchoHandler, []string{"one", "two", "three"})
 
 	for _, secret := range hawkH.secrets {
-		tok := testtoken(secret, uid)
+		tok := testtoken(secret.Value, uid)
 		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
 		resp := sendrequest(req, hawkH)
 		if assert.Equal(t, http.StatusOK, resp.Code) {
@@ -140,7 +199,7 @@ func TestHawkAuthGET(t *testing.T) {
 	var uid uint64 = 12345
 
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
-	tok := testtoken(hawkH.secrets[0], uid)
+	tok := testtoken(hawkH.secrets[0].Value, uid)
 
 	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
 	resp := sendrequest(req, hawkH)
@@ -155,7 +214,7 @@ func TestHawkAuthPOST(t *testing.T) {
 	var uid uint64 = 12345
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
 
-	tok := testtoken(hawkH.secrets[0], uid)
+	tok := testtoken(hawkH.secrets[0].Value, uid)
 
 	payload := "Thank you for flying Hawk"
 	body := bytes.NewBufferString(payload)
@@ -185,32 +244,21 @@ func TestHawkNonceCheckFunc(t *testing.T) {
 	assert.False(hawkH.hawkNonceNotFound("t2", ts, creds1))
 }
 
-func TestHawkBloomRotate(t *testing.T) {
+func TestHawkNonceSkewWindow(t *testing.T) {
 	assert := assert.New(t)
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
-
-	// use a very short halflife to not wait so long
-	// by default it is 30 seconds, to allow for 1 minute validity
-	// of hawk nonces
-	halfLife := 10 * time.Millisecond
-
-	hawkH.bloomHalflife = halfLife
 	creds := &hawk.Credentials{ID: "bacon"}
 
-	// test several rotations through
-	for i := 0; i < 3; i++ {
-		ts := time.Now()
+	// replays are caught for as long as the timestamp passes the skew check
+	ts := time.Now().Add(-hawk.MaxTimestampSkew + 2*time.Second)
+	assert.True(hawkH.hawkNonceNotFound("nonce", ts, creds))
+	assert.False(hawkH.hawkNonceNotFound("nonce", ts, creds))
 
-		assert.True(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce not to be found")
-
-		time.Sleep(halfLife + time.Millisecond) // force a rotation
-		assert.False(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be found")
-
-		time.Sleep(halfLife + time.Millisecond) // force another rotation
-		assert.True(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be gone")
-
-		assert.False(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be found")
-	}
+	// too old to pass auth.Valid(), not worth remembering
+	old := time.Now().Add(-2 * hawk.MaxTimestampSkew)
+	assert.True(hawkH.hawkNonceNotFound("nonce", old, creds))
+	assert.True(hawkH.hawkNonceNotFound("nonce", old, creds))
+	assert.Equal(1, hawkH.Nonces.Len())
 }
 
 func BenchmarkHawkNonceNotFound(b *testing.B) {
@@ -229,7 +277,7 @@ func TestHawkReplayNonce(t *testing.T) {
 
 	var uid uint64 = 12345
 
-	tok := testtoken(hawkH.secrets[0], uid)
+	tok := testtoken(hawkH.secrets[0].Value, uid)
 	req1, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
 	resp1 := sendrequest(req1, hawkH)
 	assert.Equal(http.StatusOK, resp1.Code)
@@ -245,7 +293,7 @@ func TestHawkAuthNonceRequest(t *testing.T) {
 
 	var uid uint64 = 12345
 
-	tok := testtoken(hawkH.secrets[0], uid)
+	tok := testtoken(hawkH.secrets[0].Value, uid)
 	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
 	resp := sendrequest(req, hawkH)
 	assert.Equal(t, http.StatusOK, resp.Code)
@@ -258,8 +306,149 @@ func TestHawkAuthNonceRequest(t *testing.T) {
 func BenchmarkHawkAuth(b *testing.B) {
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
 	for i := 0; i < b.N; i++ {
-		tok := testtoken(hawkH.secrets[0], uint64(i))
+		tok := testtoken(hawkH.secrets[0].Value, uint64(i))
 		req, _ := hawkrequest("GET", "/", tok)
 		sendrequest(req, hawkH)
 	}
 }
+
+func TestHawkRequestTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0].Value, uid)
+	h := NewRequestLimitHandler(hawkH, 10)
+
+	body := bytes.NewBufferString("Thank you for flying Hawk")
+	req, _ := hawkrequestbody("POST", syncurl(uid, "storage/collections/boom"), tok, "text/plain", body)
+
+	// hide the Content-Length so the body has to be read to
+	// discover it is too large
+	req.ContentLength = -1
+	resp := sendrequest(req, h)
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, resp.Body.String())
+}
+
+func TestHawkTimestampSkewHint(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0].Value, uid)
+
+	req, _ := http.NewRequest("GET", syncurl(uid, "info/collections"), nil)
+	auth := hawk.NewRequestAuth(req, &hawk.Credentials{
+		ID:   tok.Token,
+		Key:  tok.DerivedSecret,
+		Hash: sha256.New,
+	}, -10*time.Minute)
+	req.Header.Set("Authorization", auth.RequestHeader())
+
+	resp := sendrequest(req, hawkH)
+	assert.Equal(http.StatusForbidden, resp.Code)
+
+	header := resp.Header().Get("WWW-Authenticate")
+	assert.Contains(header, `error="Stale timestamp"`)
+
+	// the client can correct its clock with the signed timestamp
+	_, err := auth.UpdateOffset(header)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.InDelta(time.Now().Unix(), auth.Timestamp.Unix(), 5)
+
+	req.Header.Set("Authorization", auth.RequestHeader())
+	resp = sendrequest(req, hawkH)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// a hint signed with another key is rejected
+	other := testtoken(hawkH.secrets[0].Value, uid+1)
+	auth.Credentials.Key = other.DerivedSecret
+	_, err = auth.UpdateOffset(header)
+	assert.Equal(hawk.ErrInvalidMAC, err)
+}
+
+func TestHawkServerAuthorization(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"hello":"world"}`))
+	})
+
+	hawkH := NewHawkHandler(handler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0].Value, uid)
+
+	{ // off by default
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		resp := sendrequest(req, hawkH)
+		assert.Equal("", resp.Header().Get("Server-Authorization"))
+	}
+
+	hawkH.ServerAuthorization = true
+	req, auth := hawkrequestbody("POST", syncurl(uid, "storage/col"), tok,
+		"application/json", bytes.NewBufferString(`[]`))
+	resp := sendrequest(req, hawkH)
+	assert.Equal(http.StatusCreated, resp.Code)
+	assert.Equal(`{"hello":"world"}`, resp.Body.String())
+
+	if !assert.NoError(auth.ValidResponse(resp.Header().Get("Server-Authorization"))) {
+		return
+	}
+
+	pHash := auth.PayloadHash("application/json")
+	pHash.Write(resp.Body.Bytes())
+	assert.True(auth.ValidHash(pHash), "response payload hash invalid")
+}
+
+func TestHawkPublicURL(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0].Value, uid) // for https://syncnode-12345.services.mozilla.com
+
+	send := func() int {
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		return sendrequest(req, hawkH).Code
+	}
+
+	hawkH.PublicURLs = []string{"https://syncnode-999.services.mozilla.com"}
+
+	// only logged until enforced
+	assert.Equal(http.StatusOK, send())
+
+	hawkH.EnforcePublicURL = true
+	assert.Equal(http.StatusUnauthorized, send())
+
+	hawkH.PublicURLs = []string{
+		"https://syncnode-999.services.mozilla.com",
+		"HTTPS://SyncNode-12345.services.mozilla.com:443/",
+	}
+	assert.Equal(http.StatusOK, send())
+}
+
+func TestNormalizeNode(t *testing.T) {
+	assert := assert.New(t)
+
+	for in, expected := range map[string]string{
+		"https://node.example.com":        "https://node.example.com",
+		"https://Node.Example.com:443/":   "https://node.example.com",
+		"https://node.example.com:8443":   "https://node.example.com:8443",
+		"http://node.example.com:80/path": "http://node.example.com",
+		" http://node.example.com:8080/ ": "http://node.example.com:8080",
+	} {
+		n, err := normalizeNode(in)
+		assert.NoError(err, in)
+		assert.Equal(expected, n, in)
+	}
+
+	for _, bad := range []string{"", "node.example.com", "https://", "://node"} {
+		_, err := normalizeNode(bad)
+		assert.Error(err, bad)
+	}
+}
@@ -2,17 +2,44 @@ package web
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 
 	"github.com/gorilla/mux"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
 )
 
+// pool conflict rates are not checked until there have been this
+// many requests since the last heartbeat
+const heartbeatMinRequests = 20
+
 // InfoHandler serves endpoints that are not part of the sync 1.5
 // api that a syncserver should provide
 type InfoHandler struct {
 	router *mux.Router
+
+	// DataDir is checked by __heartbeat__ to be writable, have enough
+	// free space and that a database can be created in it. Empty or
+	// :memory: skips the disk checks
+	DataDir string
+
+	// MinFreeKB fails the heartbeat when DataDir has less free space
+	MinFreeKB int
+
+	// PoolStats and MaxConflictRate fail the heartbeat when more than
+	// MaxConflictRate of requests since the last heartbeat were rejected
+	// with a 409 by the pool
+	PoolStats       func() PoolStats
+	MaxConflictRate float64
+
+	// serializes heartbeats so they don't share the probe DB
+	heartbeatLock sync.Mutex
+	lastStats     PoolStats
 }
 
 func NewInfoHandler(h http.Handler) *InfoHandler {
@@ -25,6 +52,7 @@ func NewInfoHandler(h http.Handler) *InfoHandler {
 	r.NotFoundHandler = h
 	r.HandleFunc("/", server.handleRoot)
 	r.HandleFunc("/__heartbeat__", server.handleHeartbeat)
+	r.HandleFunc("/__lbheartbeat__", server.handleLBHeartbeat)
 	r.HandleFunc("/__version__", server.handleVersion)
 
 	return server
@@ -38,7 +66,134 @@ func (h *InfoHandler) handleRoot(w http.ResponseWriter, req *http.Request) {
 	OKResponse(w, "It Works!  SyncStorage is successfully running on this host.")
 }
 
+// heartbeatResult follows the Dockerflow __heartbeat__ format
+type heartbeatResult struct {
+	Status  string            `json:"status"`
+	Checks  map[string]string `json:"checks"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// handleHeartbeat checks the server can store data. It is more expensive
+// than __lbheartbeat__ and is meant for monitoring, not load balancers
 func (h *InfoHandler) handleHeartbeat(w http.ResponseWriter, req *http.Request) {
+	h.heartbeatLock.Lock()
+	defer h.heartbeatLock.Unlock()
+
+	result := heartbeatResult{
+		Status:  "ok",
+		Checks:  make(map[string]string),
+		Details: make(map[string]string),
+	}
+
+	check := func(name string, err error) {
+		if err != nil {
+			result.Status = "error"
+			result.Checks[name] = "error"
+			result.Details[name] = err.Error()
+		} else {
+			result.Checks[name] = "ok"
+		}
+	}
+
+	if h.DataDir != "" && h.DataDir != ":memory:" {
+		check("datadir_writable", h.checkWritable())
+		check("disk_free", h.checkDiskFree())
+		check("probe_db", h.checkProbeDB())
+	}
+
+	if h.PoolStats != nil {
+		check("pool_conflicts", h.checkConflicts())
+	}
+
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	JSON(w, req, status, result)
+}
+
+func (h *InfoHandler) checkWritable() error {
+	f, err := ioutil.TempFile(h.DataDir, "__heartbeat__")
+	if err != nil {
+		return errors.Wrap(err, "Could not create file")
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte("OK")); err != nil {
+		f.Close()
+		return errors.Wrap(err, "Could not write file")
+	}
+
+	return errors.Wrap(f.Close(), "Could not close file")
+}
+
+func (h *InfoHandler) checkDiskFree() error {
+	freeKB, _, err := diskFree(h.DataDir)
+	if err != nil {
+		return errors.Wrap(err, "Could not get free space")
+	}
+
+	if freeKB < uint64(h.MinFreeKB) {
+		return errors.Errorf("%dKB free, below %dKB", freeKB, h.MinFreeKB)
+	}
+
+	return nil
+}
+
+// checkProbeDB makes sure sqlite can create, write and read a database
+func (h *InfoHandler) checkProbeDB() error {
+	dbFile := filepath.Join(h.DataDir, "__heartbeat__.db")
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(dbFile + suffix)
+		}
+	}()
+
+	db, err := syncstorage.NewDB(dbFile, nil)
+	if err != nil {
+		return errors.Wrap(err, "Could not open")
+	}
+	defer db.Close()
+
+	if err := db.SetKey("heartbeat", "OK"); err != nil {
+		return errors.Wrap(err, "Could not write")
+	}
+
+	if value, err := db.GetKey("heartbeat"); err != nil {
+		return errors.Wrap(err, "Could not read")
+	} else if value != "OK" {
+		return errors.Errorf("Read %q, expected OK", value)
+	}
+
+	return nil
+}
+
+// checkConflicts compares the pool's counters to the last heartbeat's
+func (h *InfoHandler) checkConflicts() error {
+	stats := h.PoolStats()
+
+	requests := stats.Requests - h.lastStats.Requests
+	conflicts := stats.Conflicts - h.lastStats.Conflicts
+
+	// wait for enough requests to get a useful rate
+	if requests < heartbeatMinRequests {
+		return nil
+	}
+
+	h.lastStats = stats
+
+	rate := float64(conflicts) / float64(requests)
+	if h.MaxConflictRate > 0 && rate > h.MaxConflictRate {
+		return errors.Errorf("%d of %d requests (%0.1f%%) were pool conflicts",
+			conflicts, requests, rate*100)
+	}
+
+	return nil
+}
+
+// handleLBHeartbeat is cheap enough for load balancers to call often
+func (h *InfoHandler) handleLBHeartbeat(w http.ResponseWriter, req *http.Request) {
 	OKResponse(w, "OK")
 }
 
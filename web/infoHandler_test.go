@@ -0,0 +1,107 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func heartbeat(handler http.Handler) (int, heartbeatResult) {
+	resp := request("GET", "http://test/__heartbeat__", nil, handler)
+
+	var result heartbeatResult
+	json.Unmarshal(resp.Body.Bytes(), &result)
+	return resp.Code, result
+}
+
+func TestInfoHandlerHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "heartbeat")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	handler := NewInfoHandler(EchoHandler)
+	handler.DataDir = dir
+
+	code, result := heartbeat(handler)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", result.Status)
+	assert.Equal(map[string]string{
+		"datadir_writable": "ok",
+		"disk_free":        "ok",
+		"probe_db":         "ok",
+	}, result.Checks)
+
+	// the probe files are cleaned up
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(files, 0)
+
+	// more space than any test machine has
+	handler.MinFreeKB = 1 << 50
+	code, result = heartbeat(handler)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("error", result.Status)
+	assert.Equal("error", result.Checks["disk_free"])
+	assert.Contains(result.Details["disk_free"], "KB free")
+}
+
+func TestInfoHandlerHeartbeatDataDirMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "heartbeat")
+	if !assert.NoError(err) {
+		return
+	}
+	os.RemoveAll(dir)
+
+	handler := NewInfoHandler(EchoHandler)
+	handler.DataDir = filepath.Join(dir, "missing")
+
+	code, result := heartbeat(handler)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("error", result.Checks["datadir_writable"])
+	assert.Equal("error", result.Checks["probe_db"])
+}
+
+func TestInfoHandlerHeartbeatConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	var stats PoolStats
+	handler := NewInfoHandler(EchoHandler)
+	handler.PoolStats = func() PoolStats { return stats }
+	handler.MaxConflictRate = 0.1
+
+	// too few requests to tell
+	stats = PoolStats{Requests: 10, Conflicts: 10}
+	code, _ := heartbeat(handler)
+	assert.Equal(http.StatusOK, code)
+
+	stats = PoolStats{Requests: 110, Conflicts: 50}
+	code, result := heartbeat(handler)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("error", result.Checks["pool_conflicts"])
+
+	// only the requests since the last heartbeat count
+	stats = PoolStats{Requests: 210, Conflicts: 55}
+	code, result = heartbeat(handler)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", result.Checks["pool_conflicts"])
+}
+
+func TestInfoHandlerLBHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewInfoHandler(EchoHandler)
+	handler.DataDir = "/does/not/exist"
+
+	resp := request("GET", "http://test/__lbheartbeat__", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
@@ -0,0 +1,194 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrServerBusy = errors.New("Server too busy")
+
+// LoadObserver receives timings from the SyncPoolHandler so load
+// can be judged by more than the number of requests
+type LoadObserver interface {
+	// ObservePoolWait is how long a request waited to get its user
+	// handler from the pool, including conflict retries
+	ObservePoolWait(time.Duration)
+
+	// ObserveDB is how long the user handler took to serve a request
+	// once it had the user's lock and the request body
+	ObserveDB(time.Duration)
+}
+
+type LoadGovernorConfig struct {
+	// Above the soft limits successful responses include X-Weave-Backoff.
+	// Above the hard limits requests are rejected with a 503. 0 disables
+	// a limit
+	SoftInFlight int
+	HardInFlight int
+	SoftPoolWait time.Duration
+	HardPoolWait time.Duration
+	SoftDB       time.Duration
+	HardDB       time.Duration
+
+	// timings are averaged over the last one to two windows
+	Window time.Duration
+
+	// seconds sent in X-Weave-Backoff and Retry-After
+	BackoffSeconds    int
+	RetryAfterSeconds int
+}
+
+// LoadGovernor asks clients to back off when the server is busy and
+// turns requests away when it is overloaded. It follows the sync 1.5
+// contract: X-Weave-Backoff on successful responses and a 503 with
+// Retry-After when a request is not handled
+type LoadGovernor struct {
+	handler http.Handler
+	config  LoadGovernorConfig
+
+	inFlight int32
+	poolWait *windowAverage
+	db       *windowAverage
+}
+
+func NewLoadGovernor(h http.Handler, config LoadGovernorConfig) *LoadGovernor {
+	return &LoadGovernor{
+		handler:  h,
+		config:   config,
+		poolWait: newWindowAverage(config.Window),
+		db:       newWindowAverage(config.Window),
+	}
+}
+
+func (g *LoadGovernor) ObservePoolWait(d time.Duration) { g.poolWait.add(d.Seconds()) }
+func (g *LoadGovernor) ObserveDB(d time.Duration)       { g.db.add(d.Seconds()) }
+
+// over checks if the current load is over any of the limits
+func (g *LoadGovernor) over(inFlight, maxInFlight int, poolWait, db time.Duration) bool {
+	over := func(value, limit float64) bool {
+		return limit > 0 && value >= limit
+	}
+
+	return over(float64(inFlight), float64(maxInFlight)) ||
+		over(g.poolWait.avg(), poolWait.Seconds()) ||
+		over(g.db.avg(), db.Seconds())
+}
+
+func (g *LoadGovernor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inFlight := int(atomic.AddInt32(&g.inFlight, 1))
+	metricLoadInFlight.Add(1)
+	defer func() {
+		atomic.AddInt32(&g.inFlight, -1)
+		metricLoadInFlight.Add(-1)
+	}()
+
+	if g.over(inFlight, g.config.HardInFlight, g.config.HardPoolWait, g.config.HardDB) {
+		metricLoadShed.Inc("reject")
+		w.Header().Set("Retry-After", strconv.Itoa(g.config.RetryAfterSeconds))
+		w.Header().Set("X-Weave-Backoff", strconv.Itoa(g.config.BackoffSeconds))
+		sendRequestProblem(w, r, http.StatusServiceUnavailable, ErrServerBusy)
+		return
+	}
+
+	if g.over(inFlight, g.config.SoftInFlight, g.config.SoftPoolWait, g.config.SoftDB) {
+		metricLoadShed.Inc("backoff")
+		w = &backoffWriter{ResponseWriter: w, backoff: strconv.Itoa(g.config.BackoffSeconds)}
+	}
+
+	g.handler.ServeHTTP(w, r)
+}
+
+// backoffWriter adds X-Weave-Backoff to successful responses
+type backoffWriter struct {
+	http.ResponseWriter
+	backoff     string
+	wroteHeader bool
+}
+
+func (b *backoffWriter) WriteHeader(code int) {
+	if !b.wroteHeader {
+		b.wroteHeader = true
+		if code >= 200 && code < 300 {
+			b.Header().Set("X-Weave-Backoff", b.backoff)
+		}
+	}
+	b.ResponseWriter.WriteHeader(code)
+}
+
+func (b *backoffWriter) Write(data []byte) (int, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.ResponseWriter.Write(data)
+}
+
+func (b *backoffWriter) Flush() {
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// windowAverage is the average of the values added in the current and
+// the previous window. Old values expire on their own so an average can
+// not get stuck when requests stop coming in
+type windowAverage struct {
+	sync.Mutex
+	window time.Duration
+
+	start     time.Time // of the current window
+	cur, prev struct {
+		sum float64
+		n   int
+	}
+}
+
+func newWindowAverage(window time.Duration) *windowAverage {
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	return &windowAverage{window: window, start: time.Now()}
+}
+
+// rotate starts a new window if the current one is over. The caller
+// must hold the lock
+func (a *windowAverage) rotate(now time.Time) {
+	elapsed := now.Sub(a.start)
+	if elapsed < a.window {
+		return
+	}
+
+	if elapsed < 2*a.window {
+		a.prev = a.cur
+	} else {
+		a.prev.sum, a.prev.n = 0, 0
+	}
+
+	a.cur.sum, a.cur.n = 0, 0
+	a.start = now
+}
+
+func (a *windowAverage) add(v float64) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.rotate(time.Now())
+	a.cur.sum += v
+	a.cur.n++
+}
+
+func (a *windowAverage) avg() float64 {
+	a.Lock()
+	defer a.Unlock()
+
+	a.rotate(time.Now())
+	n := a.cur.n + a.prev.n
+	if n == 0 {
+		return 0
+	}
+	return (a.cur.sum + a.prev.sum) / float64(n)
+}
@@ -0,0 +1,200 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadGovernorInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	started := make(chan struct{}, 3)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+		OKResponse(w, "OK")
+	})
+
+	g := NewLoadGovernor(slow, LoadGovernorConfig{
+		SoftInFlight:      2,
+		HardInFlight:      3,
+		BackoffSeconds:    300,
+		RetryAfterSeconds: 30,
+	})
+
+	url := syncurl(uniqueUID(), "info/collections")
+	results := make(chan *http.Response, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- request("GET", url, nil, g).Result()
+		}()
+		<-started
+	}
+
+	// the third request is over the hard limit
+	resp := request("GET", url, nil, g)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Equal("30", resp.Header().Get("Retry-After"))
+	assert.Equal("300", resp.Header().Get("X-Weave-Backoff"))
+
+	close(block)
+	wg.Wait()
+	close(results)
+
+	// the second request was over the soft limit
+	var backoffs int
+	for resp := range results {
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		if resp.Header.Get("X-Weave-Backoff") == "300" {
+			backoffs++
+		}
+	}
+	assert.Equal(1, backoffs)
+
+	// quiet again
+	resp = request("GET", url, nil, g)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Header().Get("X-Weave-Backoff"))
+}
+
+func TestLoadGovernorLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	config := LoadGovernorConfig{
+		SoftPoolWait:      100 * time.Millisecond,
+		HardPoolWait:      time.Second,
+		SoftDB:            100 * time.Millisecond,
+		HardDB:            time.Second,
+		Window:            50 * time.Millisecond,
+		BackoffSeconds:    300,
+		RetryAfterSeconds: 30,
+	}
+
+	url := syncurl(uniqueUID(), "info/collections")
+
+	{ // slow DBs send backoff on successful responses only
+		g := NewLoadGovernor(EchoHandler, config)
+		g.ObserveDB(500 * time.Millisecond)
+
+		resp := request("GET", url, nil, g)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("300", resp.Header().Get("X-Weave-Backoff"))
+
+		g.handler = notFound
+		resp = request("GET", url, nil, g)
+		assert.Equal(http.StatusNotFound, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Backoff"))
+	}
+
+	{ // slow pool rejects, until the window passes
+		g := NewLoadGovernor(EchoHandler, config)
+		g.ObservePoolWait(2 * time.Second)
+
+		resp := request("GET", url, nil, g)
+		assert.Equal(http.StatusServiceUnavailable, resp.Code)
+		assert.Equal("30", resp.Header().Get("Retry-After"))
+
+		time.Sleep(2 * config.Window)
+		resp = request("GET", url, nil, g)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Backoff"))
+	}
+}
+
+func TestWindowAverage(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newWindowAverage(time.Minute)
+	assert.Equal(float64(0), a.avg())
+
+	a.add(1)
+	a.add(3)
+	assert.Equal(float64(2), a.avg())
+
+	// the previous window still counts
+	a.rotate(a.start.Add(time.Minute))
+	a.add(5)
+	assert.Equal(float64(3), a.avg())
+
+	// after two windows everything expired
+	a.rotate(a.start.Add(2 * time.Minute))
+	assert.Equal(float64(0), a.avg())
+}
+
+type testLoadObserver struct {
+	sync.Mutex
+	poolWaits, dbs int
+}
+
+func (o *testLoadObserver) ObservePoolWait(time.Duration) { o.Lock(); o.poolWaits++; o.Unlock() }
+func (o *testLoadObserver) ObserveDB(time.Duration)       { o.Lock(); o.dbs++; o.Unlock() }
+
+func TestSyncPoolHandlerLoadObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	defer handler.StopHTTP()
+
+	observer := &testLoadObserver{}
+	handler.Load = observer
+
+	resp := request("GET", syncurl(uniqueUID(), "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	observer.Lock()
+	defer observer.Unlock()
+	assert.Equal(1, observer.poolWaits)
+	assert.Equal(1, observer.dbs)
+}
+
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p[:1], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSyncUserHandlerServeTimedSkipsBody(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	body := &slowReader{data: []byte(`{"payload":"hi"}`), delay: 5 * time.Millisecond}
+	req, _ := http.NewRequest("PUT", syncurl(uid, "storage/col/b0"), body)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	took := handler.serveTimed(w, req)
+	total := time.Since(start)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(total >= 80*time.Millisecond, "body should have been slow")
+	assert.True(took < total/2, "reading the body was timed")
+}
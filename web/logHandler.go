@@ -99,6 +99,7 @@ func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if session.Token.Uid != 0 {
 			fields["fxa_uid"] = session.Token.FxaUID
 			fields["device_id"] = session.Token.DeviceId
+			fields["secret"] = session.SecretIndex
 		}
 
 		if errno != 0 && session.ErrorResult != nil {
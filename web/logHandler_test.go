@@ -105,7 +105,7 @@ func TestLogHandlerContext(t *testing.T) {
 	logHandle := NewLogHandler(logger, hawkHandle)
 
 	var uid uint64 = 12345
-	tok := testtoken(hawkHandle.secrets[0], uid)
+	tok := testtoken(hawkHandle.secrets[0].Value, uid)
 	req, _ := hawkrequestbody("POST", syncurl(uid, "some/endpoint"), tok, "text/plain",
 		bytes.NewBufferString(strings.Repeat("ABC", 10)))
 	resp := sendrequest(req, logHandle)
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// how many times a busy user is retried before giving up
+const maintenanceMaxAttempts = 3
+
+// how long to wait before retrying a user that was busy
+var maintenanceRetryDelay = 5 * time.Second
+
+// maintenanceJob runs maintenance for a user. It returns skip=true when
+// the user was busy and should be retried later and the approximate
+// KB of disk IO that was used
+type maintenanceJob func(uid string) (skip bool, ioKB int, err error)
+
+// maintenanceScheduler runs maintenance jobs (purges and vacuums) in
+// the background so they are never on the request path. Jobs run with
+// bounded concurrency and are paced to stay within an IO budget
+type maintenanceScheduler struct {
+	sync.Mutex
+
+	run   maintenanceJob
+	queue chan string
+
+	// uids that are queued or waiting to be retried
+	pending  map[string]int // uid => attempts
+	inFlight int
+
+	// KB of IO per second, 0 is unlimited
+	ioBudgetKB int
+	nextStart  time.Time
+
+	stop    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newMaintenanceScheduler(workers, queueSize, ioBudgetKB int, run maintenanceJob) *maintenanceScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	m := &maintenanceScheduler{
+		run:        run,
+		queue:      make(chan string, queueSize),
+		pending:    make(map[string]int),
+		ioBudgetKB: ioBudgetKB,
+		stop:       make(chan struct{}),
+	}
+
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+
+	return m
+}
+
+// Enqueue schedules maintenance for uid. It returns false if uid is
+// already scheduled or the queue is full
+func (m *maintenanceScheduler) Enqueue(uid string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.pending[uid]; ok {
+		return false
+	}
+
+	return m.push(uid, 0)
+}
+
+// push adds uid to the queue. The caller must hold the lock
+func (m *maintenanceScheduler) push(uid string, attempts int) bool {
+	if m.stopped {
+		return false
+	}
+
+	select {
+	case m.queue <- uid:
+		m.pending[uid] = attempts
+		return true
+	default:
+		if log.GetLevel() == log.DebugLevel {
+			log.WithFields(log.Fields{
+				"uid": uid,
+			}).Debug("maintenance queue full")
+		}
+		return false
+	}
+}
+
+// Len returns the number of users waiting for maintenance
+func (m *maintenanceScheduler) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.pending) - m.inFlight
+}
+
+// Stop waits for running jobs to finish and drops everything queued
+func (m *maintenanceScheduler) Stop() {
+	m.Lock()
+	if m.stopped {
+		m.Unlock()
+		return
+	}
+	m.stopped = true
+	close(m.stop)
+	m.Unlock()
+
+	m.wg.Wait()
+}
+
+func (m *maintenanceScheduler) worker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case uid := <-m.queue:
+			if !m.wait() {
+				return
+			}
+			m.process(uid)
+		}
+	}
+}
+
+// wait blocks until the IO budget allows another job to start. It
+// returns false if the scheduler was stopped while waiting
+func (m *maintenanceScheduler) wait() bool {
+	m.Lock()
+	delay := m.nextStart.Sub(time.Now())
+	m.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+func (m *maintenanceScheduler) process(uid string) {
+	m.Lock()
+	m.inFlight++
+	attempts := m.pending[uid]
+	m.Unlock()
+
+	start := time.Now()
+	skip, ioKB, err := m.run(uid)
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.inFlight--
+	delete(m.pending, uid)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid": uid,
+			"err": err.Error(),
+		}).Error("maintenance job failed")
+	}
+
+	// pay for the IO used by delaying the next job
+	if m.ioBudgetKB > 0 && ioKB > 0 {
+		if m.nextStart.Before(start) {
+			m.nextStart = start
+		}
+		m.nextStart = m.nextStart.Add(time.Duration(ioKB) * time.Second / time.Duration(m.ioBudgetKB))
+	}
+
+	if !skip {
+		return
+	}
+
+	attempts++
+	if attempts >= maintenanceMaxAttempts {
+		if log.GetLevel() == log.DebugLevel {
+			log.WithFields(log.Fields{
+				"uid":      uid,
+				"attempts": attempts,
+			}).Debug("maintenance gave up on busy user")
+		}
+		return
+	}
+
+	// keep it pending so it is not queued twice while waiting
+	m.pending[uid] = attempts
+	time.AfterFunc(maintenanceRetryDelay, func() {
+		m.Lock()
+		defer m.Unlock()
+
+		delete(m.pending, uid)
+		m.push(uid, attempts)
+	})
+}
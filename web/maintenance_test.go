@@ -0,0 +1,183 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceSchedulerRunsJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	ran := make(map[string]int)
+	done := make(chan struct{}, 10)
+
+	m := newMaintenanceScheduler(2, 10, 0, func(uid string) (bool, int, error) {
+		mu.Lock()
+		ran[uid]++
+		mu.Unlock()
+		done <- struct{}{}
+		return false, 0, nil
+	})
+	defer m.Stop()
+
+	assert.True(m.Enqueue("1"))
+	assert.True(m.Enqueue("2"))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			assert.Fail("Timed out waiting for jobs")
+			return
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(map[string]int{"1": 1, "2": 1}, ran)
+	mu.Unlock()
+}
+
+func TestMaintenanceSchedulerQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	m := newMaintenanceScheduler(1, 2, 0, func(uid string) (bool, int, error) {
+		<-block
+		return false, 0, nil
+	})
+
+	assert.True(m.Enqueue("running"))
+
+	// wait for the worker to pick it up
+	for i := 0; i < 100 && m.Len() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.True(m.Enqueue("1"))
+	assert.False(m.Enqueue("1"), "Expected duplicates to be dropped")
+	assert.True(m.Enqueue("2"))
+	assert.False(m.Enqueue("3"), "Expected a full queue to drop uids")
+	assert.Equal(2, m.Len())
+
+	close(block)
+	m.Stop()
+	assert.False(m.Enqueue("4"), "Expected nothing to be queued after Stop")
+}
+
+func TestMaintenanceSchedulerRetriesBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	orig := maintenanceRetryDelay
+	maintenanceRetryDelay = time.Millisecond
+	defer func() { maintenanceRetryDelay = orig }()
+
+	var attempts int32
+	m := newMaintenanceScheduler(1, 10, 0, func(uid string) (bool, int, error) {
+		atomic.AddInt32(&attempts, 1)
+		return true, 0, nil
+	})
+	defer m.Stop()
+
+	m.Enqueue("busy")
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(int32(maintenanceMaxAttempts), atomic.LoadInt32(&attempts))
+	assert.Equal(0, m.Len())
+}
+
+func TestMaintenanceSchedulerIOBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var starts []time.Time
+	done := make(chan struct{}, 2)
+
+	// 100KB at 1000KB/s should delay the next job by 100ms
+	m := newMaintenanceScheduler(1, 10, 1000, func(uid string) (bool, int, error) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		done <- struct{}{}
+		return false, 100, nil
+	})
+	defer m.Stop()
+
+	m.Enqueue("1")
+	m.Enqueue("2")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			assert.Fail("Timed out waiting for jobs")
+			return
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(starts[1].Sub(starts[0]) >= 100*time.Millisecond,
+		"Expected the IO budget to delay the second job")
+}
+
+func TestSyncUserHandlerTidyUpIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	atomic.AddInt32(&handler.inFlight, 1)
+	busy, _, err := handler.TidyUpIdle(time.Hour, time.Hour, 0)
+	assert.NoError(err)
+	assert.True(busy)
+	atomic.AddInt32(&handler.inFlight, -1)
+
+	busy, _, err = handler.TidyUpIdle(time.Hour, time.Hour, 0)
+	assert.NoError(err)
+	assert.False(busy)
+
+	next, err := db.GetKey("NEXT_PURGE")
+	assert.NoError(err)
+	assert.NotEqual("", next)
+
+	handler.StopHTTP()
+	busy, _, err = handler.TidyUpIdle(time.Hour, time.Hour, 0)
+	assert.NoError(err)
+	assert.False(busy)
+}
+
+func TestSyncPoolHandlerMaintenanceAfterRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	defer handler.StopHTTP()
+
+	uid := uniqueUID()
+	body := bytes.NewBufferString(`{"payload":"hi"}`)
+	resp := jsonrequest("PUT", syncurl(uid, "storage/col/b0"), body, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	el := handler.pools[handler.poolIndex(uid)].peekElement(uid)
+	if !assert.NotNil(el) {
+		return
+	}
+
+	// TidyUp sets NEXT_PURGE the first time it runs
+	var next string
+	for i := 0; i < 100 && next == ""; i++ {
+		time.Sleep(5 * time.Millisecond)
+		next, _ = el.handler.db.GetKey("NEXT_PURGE")
+	}
+	assert.NotEqual("", next, "Expected maintenance to run in the background")
+}
@@ -0,0 +1,447 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMetrics holds all the metrics recorded by the web handlers.
+// It is served in the prometheus text format at /__metrics__
+var DefaultMetrics = NewMetrics()
+
+var (
+	latencyBuckets     = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	maintenanceBuckets = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+
+	metricRequests = DefaultMetrics.NewCounter("syncstorage_http_requests_total",
+		"HTTP requests by route, method and status",
+		"route", "method", "status")
+	metricRequestDuration = DefaultMetrics.NewHistogram("syncstorage_http_request_duration_seconds",
+		"HTTP request latency by route and method",
+		latencyBuckets, "route", "method")
+	metricHawkFailures = DefaultMetrics.NewCounter("syncstorage_hawk_failures_total",
+		"Requests rejected by hawk authentication by reason",
+		"reason")
+	metricTokenCache = DefaultMetrics.NewCounter("syncstorage_hawk_token_cache_total",
+		"Token cache lookups by result, hit, miss or expired",
+		"result")
+	metricTokenSecret = DefaultMetrics.NewCounter("syncstorage_hawk_token_secret_total",
+		"Tokens verified by the index of the secret that matched",
+		"index")
+	metricNodeMismatch = DefaultMetrics.NewCounter("syncstorage_hawk_node_mismatch_total",
+		"Tokens issued for another node by action, log or reject",
+		"action")
+	metricNonceOverflow = DefaultMetrics.NewCounter("syncstorage_hawk_nonce_overflow_total",
+		"Nonces moved out of the exact replay cache because it was full")
+	metricPoolOpen = DefaultMetrics.NewGauge("syncstorage_pool_open_handlers",
+		"User handlers with an open database")
+	metricPoolEvictions = DefaultMetrics.NewCounter("syncstorage_pool_evictions_total",
+		"User handlers closed by the pool by reason",
+		"reason")
+	metricPoolConflicts = DefaultMetrics.NewCounter("syncstorage_pool_conflicts_total",
+		"Requests that found their user handler stopping")
+	metricCache = DefaultMetrics.NewCounter("syncstorage_cache_requests_total",
+		"CacheHandler lookups by route and result",
+		"route", "result")
+	metricBatches = DefaultMetrics.NewCounter("syncstorage_batch_operations_total",
+		"Batch uploads by operation",
+		"op")
+	metricMaintenanceDuration = DefaultMetrics.NewHistogram("syncstorage_maintenance_duration_seconds",
+		"Time spent purging and vacuuming user databases",
+		maintenanceBuckets, "op")
+	metricLoadInFlight = DefaultMetrics.NewGauge("syncstorage_load_in_flight",
+		"Requests being handled by the LoadGovernor")
+	metricLoadShed = DefaultMetrics.NewCounter("syncstorage_load_shed_total",
+		"Requests sent X-Weave-Backoff or rejected by the LoadGovernor",
+		"action")
+	metricRateLimited = DefaultMetrics.NewCounter("syncstorage_rate_limited_total",
+		"Requests rejected by rate limits",
+		"limit")
+	metricPurged = DefaultMetrics.NewCounter("syncstorage_purged_total",
+		"Expired records removed by maintenance",
+		"type")
+	metricVacuumFreed = DefaultMetrics.NewCounter("syncstorage_vacuum_freed_kb_total",
+		"Disk space freed by vacuums in KB")
+	metricSweep = DefaultMetrics.NewCounter("syncstorage_sweep_dbs_total",
+		"User databases visited by the Sweeper by result, swept, not_due, pooled, inactive, deleted or error",
+		"result")
+)
+
+// MetricsSink receives every metric update as it happens. It is used
+// to push metrics somewhere, like statsd, in addition to serving them
+type MetricsSink interface {
+	Count(name string, labels, values []string, v float64)
+	Gauge(name string, labels, values []string, v float64)
+	Observe(name string, labels, values []string, v float64)
+}
+
+// Metrics is a registry of counters, gauges and histograms. It is a
+// small subset of what the prometheus client provides, enough to
+// export our own metrics in the prometheus text format
+type Metrics struct {
+	sync.Mutex
+	families []*metricFamily
+
+	sink atomic.Value // sinkHolder
+}
+
+// atomic.Value needs the same concrete type every time
+type sinkHolder struct{ MetricsSink }
+
+// SetSink sends all future metric updates to sink as well. A nil
+// sink stops sending them
+func (m *Metrics) SetSink(sink MetricsSink) {
+	m.sink.Store(sinkHolder{sink})
+}
+
+func (m *Metrics) getSink() MetricsSink {
+	holder, _ := m.sink.Load().(sinkHolder)
+	return holder.MetricsSink
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+type metricFamily struct {
+	sync.Mutex
+	metrics *Metrics
+
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64
+
+	series map[string]*metricSeries // label values => series
+}
+
+type metricSeries struct {
+	values []string
+	value  float64
+
+	// histograms only
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (m *Metrics) register(f *metricFamily) *metricFamily {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, existing := range m.families {
+		if existing.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+
+	f.metrics = m
+	f.series = make(map[string]*metricSeries)
+	m.families = append(m.families, f)
+
+	// metrics without labels are reported from the start
+	if len(f.labels) == 0 {
+		f.get(nil)
+	}
+
+	return f
+}
+
+// NewCounter registers a counter that can only go up
+func (m *Metrics) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{m.register(&metricFamily{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// NewGauge registers a gauge that can go up and down
+func (m *Metrics) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{m.register(&metricFamily{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+// NewHistogram registers a histogram with the sorted upper bounds
+// in buckets. The +Inf bucket is added automatically
+func (m *Metrics) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{m.register(&metricFamily{
+		name:    name,
+		help:    help,
+		kind:    "histogram",
+		labels:  labels,
+		buckets: buckets,
+	})}
+}
+
+// get returns the series for values, creating it if required. The
+// caller must hold the lock
+func (f *metricFamily) get(values []string) *metricSeries {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// value returns the current value of a counter or gauge, or the
+// number of observations of a histogram
+func (f *metricFamily) value(values ...string) float64 {
+	f.Lock()
+	defer f.Unlock()
+
+	s := f.get(values)
+	if f.kind == "histogram" {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+type Counter struct{ *metricFamily }
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counters can not decrease")
+	}
+
+	c.Lock()
+	c.get(values).value += v
+	c.Unlock()
+
+	if sink := c.metrics.getSink(); sink != nil {
+		sink.Count(c.name, c.labels, values, v)
+	}
+}
+
+type Gauge struct{ *metricFamily }
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.Lock()
+	g.get(values).value = v
+	g.Unlock()
+
+	if sink := g.metrics.getSink(); sink != nil {
+		sink.Gauge(g.name, g.labels, values, v)
+	}
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.Lock()
+	s := g.get(values)
+	s.value += v
+	v = s.value
+	g.Unlock()
+
+	if sink := g.metrics.getSink(); sink != nil {
+		sink.Gauge(g.name, g.labels, values, v)
+	}
+}
+
+type Histogram struct{ *metricFamily }
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.Lock()
+	s := h.get(values)
+	s.sum += v
+	s.count++
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	h.Unlock()
+
+	if sink := h.metrics.getSink(); sink != nil {
+		sink.Observe(h.name, h.labels, values, v)
+	}
+}
+
+// Since observes the seconds elapsed since start
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// WriteText writes all metrics in the prometheus text exposition format
+func (m *Metrics) WriteText(buf *bytes.Buffer) {
+	m.Lock()
+	families := append([]*metricFamily(nil), m.families...)
+	m.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	for _, f := range families {
+		f.writeText(buf)
+	}
+}
+
+func (f *metricFamily) writeText(buf *bytes.Buffer) {
+	f.Lock()
+	defer f.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, f.labelText(s.values, ""), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, f.labelText(s.values, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, f.labelText(s.values, "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, f.labelText(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, f.labelText(s.values, ""), s.count)
+	}
+}
+
+// labelText formats the {name="value",...} part of a sample. le is
+// added for histogram buckets when it is not empty
+func (f *metricFamily) labelText(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// ServeHTTP serves the metrics for prometheus to scrape
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := new(bytes.Buffer)
+	m.WriteText(buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// MetricsHandler counts and times every request by route, method
+// and status
+type MetricsHandler struct {
+	handler http.Handler
+}
+
+func NewMetricsHandler(h http.Handler) *MetricsHandler {
+	return &MetricsHandler{handler: h}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	logger := makeLogger(w)
+	h.handler.ServeHTTP(logger, req)
+
+	status := logger.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	route := metricsRoute(req.URL.Path)
+	method := metricsMethod(req.Method)
+	metricRequests.Inc(route, method, strconv.Itoa(status))
+	metricRequestDuration.Since(start, route, method)
+}
+
+// metricsMethod keeps client chosen methods from adding label values
+func metricsMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS":
+		return method
+	default:
+		return "other"
+	}
+}
+
+// metricsRoute turns a request path into a route name without uids,
+// collection names or bso ids so the number of label values stays small
+func metricsRoute(path string) string {
+	switch path {
+	case "/", "/__heartbeat__", "/__lbheartbeat__", "/__version__", "/__metrics__":
+		return path
+	}
+
+	if !strings.HasPrefix(path, "/1.5/") {
+		return "other"
+	}
+
+	// parts[0] is the uid
+	parts := strings.Split(strings.TrimSuffix(path[len("/1.5/"):], "/"), "/")
+	switch {
+	case len(parts) == 1:
+		return "/1.5/{uid}"
+	case parts[1] == "info" && len(parts) == 3:
+		switch parts[2] {
+		case "collections", "collection_usage", "collection_counts", "configuration", "quota":
+			return "/1.5/{uid}/info/" + parts[2]
+		}
+	case parts[1] == "storage":
+		switch len(parts) {
+		case 2:
+			return "/1.5/{uid}/storage"
+		case 3:
+			return "/1.5/{uid}/storage/{collection}"
+		case 4:
+			return "/1.5/{uid}/storage/{collection}/{bso}"
+		}
+	}
+
+	return "other"
+}
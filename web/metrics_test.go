@@ -0,0 +1,189 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsWriteText(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMetrics()
+	counter := m.NewCounter("test_requests_total", "Requests\nby path", "path")
+	gauge := m.NewGauge("test_open", "Open things")
+	hist := m.NewHistogram("test_seconds", "Durations", []float64{0.1, 1}, "op")
+	unused := m.NewCounter("test_unused_total", "Never incremented")
+
+	counter.Inc(`/a"b`)
+	counter.Add(2, `/a"b`)
+	gauge.Add(3)
+	gauge.Add(-1)
+	hist.Observe(0.05, "x")
+	hist.Observe(0.5, "x")
+	hist.Observe(5, "x")
+
+	assert.Equal(float64(3), counter.value(`/a"b`))
+	assert.Equal(float64(2), gauge.value())
+	assert.Equal(float64(3), hist.value("x"))
+	assert.Equal(float64(0), unused.value())
+
+	buf := new(bytes.Buffer)
+	m.WriteText(buf)
+
+	expected := `# HELP test_open Open things
+# TYPE test_open gauge
+test_open 2
+# HELP test_requests_total Requests\nby path
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b"} 3
+# HELP test_seconds Durations
+# TYPE test_seconds histogram
+test_seconds_bucket{op="x",le="0.1"} 1
+test_seconds_bucket{op="x",le="1"} 2
+test_seconds_bucket{op="x",le="+Inf"} 3
+test_seconds_sum{op="x"} 5.55
+test_seconds_count{op="x"} 3
+# HELP test_unused_total Never incremented
+# TYPE test_unused_total counter
+test_unused_total 0
+`
+	assert.Equal(expected, buf.String())
+
+	assert.Panics(func() { m.NewCounter("test_open", "duplicate") })
+	assert.Panics(func() { counter.Inc() }, "Expected wrong number of labels to panic")
+}
+
+func TestMetricsRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	routes := map[string]string{
+		"/":                                "/",
+		"/__heartbeat__":                   "/__heartbeat__",
+		"/__metrics__":                     "/__metrics__",
+		"/1.5/123":                         "/1.5/{uid}",
+		"/1.5/123/storage":                 "/1.5/{uid}/storage",
+		"/1.5/123/info/collections":        "/1.5/{uid}/info/collections",
+		"/1.5/123/info/quota":              "/1.5/{uid}/info/quota",
+		"/1.5/123/info/nope":               "other",
+		"/1.5/123/storage/bookmarks":       "/1.5/{uid}/storage/{collection}",
+		"/1.5/123/storage/bookmarks/":      "/1.5/{uid}/storage/{collection}",
+		"/1.5/123/storage/bookmarks/abcde": "/1.5/{uid}/storage/{collection}/{bso}",
+		"/1.5/123/storage/a/b/c":           "other",
+		"/favicon.ico":                     "other",
+	}
+
+	for path, route := range routes {
+		assert.Equal(route, metricsRoute(path), path)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := NewMetricsHandler(NewInfoHandler(notFound))
+
+	okBefore := metricRequests.value("/__heartbeat__", "GET", "200")
+	missBefore := metricRequests.value("/1.5/{uid}/storage/{collection}", "GET", "404")
+
+	request("GET", "http://test/__heartbeat__", nil, handler)
+	request("GET", syncurl(uniqueUID(), "storage/bookmarks"), nil, handler)
+
+	assert.Equal(okBefore+1, metricRequests.value("/__heartbeat__", "GET", "200"))
+	assert.Equal(missBefore+1, metricRequests.value("/1.5/{uid}/storage/{collection}", "GET", "404"))
+
+	// made up methods share one label value
+	otherBefore := metricRequests.value("other", "other", "404")
+	request("MADEUP", "http://test/nope", nil, handler)
+	request("PROPFIND", "http://test/nope", nil, handler)
+	assert.Equal(otherBefore+2, metricRequests.value("other", "other", "404"))
+	text := new(bytes.Buffer)
+	DefaultMetrics.WriteText(text)
+	assert.NotContains(text.String(), `method="MADEUP"`)
+
+	// only served on the admin listener
+	resp := request("GET", "http://test/__metrics__", nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	resp = request("GET", "http://test/__metrics__", nil, NewAdminHandler(AdminConfig{}))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Contains(resp.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(resp.Body.String(), `syncstorage_http_requests_total{route="/__heartbeat__",method="GET",status="200"}`)
+	assert.Contains(resp.Body.String(), `syncstorage_http_request_duration_seconds_bucket{route="/__heartbeat__",method="GET",le="+Inf"}`)
+	assert.Contains(resp.Body.String(), "# TYPE syncstorage_pool_open_handlers gauge")
+}
+
+func TestMetricsHawkFailures(t *testing.T) {
+	assert := assert.New(t)
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+
+	before := metricHawkFailures.value("replay")
+
+	tok := testtoken(hawkH.secrets[0].Value, 12345)
+	req, _ := hawkrequest("GET", syncurl(12345, "info/collections"), tok)
+	sendrequest(req, hawkH)
+	sendrequest(req, hawkH)
+
+	assert.Equal(before+1, metricHawkFailures.value("replay"))
+}
+
+func TestMetricsCache(t *testing.T) {
+	assert := assert.New(t)
+	handler := NewCacheHandler(cacheMockHandler, DefaultCacheHandlerConfig)
+	url := syncurl(uniqueUID(), "info/collections")
+
+	hits := metricCache.value("info_collections", "hit")
+	misses := metricCache.value("info_collections", "miss")
+
+	request("GET", url, nil, handler)
+	request("GET", url, nil, handler)
+
+	assert.Equal(hits+1, metricCache.value("info_collections", "hit"))
+	assert.Equal(misses+1, metricCache.value("info_collections", "miss"))
+}
+
+func TestMetricsBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+	url := syncurl(uid, "storage/col")
+
+	before := map[string]float64{}
+	for _, op := range []string{"create", "append", "commit"} {
+		before[op] = metricBatches.value(op)
+	}
+
+	body := bytes.NewBufferString(`[{"id":"b0", "payload":"0"}]`)
+	resp := requestheaders("POST", url+"?batch=true", body, header, handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code) {
+		return
+	}
+
+	var results PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+		return
+	}
+
+	body = bytes.NewBufferString(`[{"id":"b1", "payload":"1"}]`)
+	resp = requestheaders("POST", url+"?batch="+results.Batch, body, header, handler)
+	assert.Equal(http.StatusAccepted, resp.Code)
+
+	resp = requestheaders("POST", url+"?commit=true&batch="+results.Batch, bytes.NewBufferString("[]"), header, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	for _, op := range []string{"create", "append", "commit"} {
+		assert.Equal(before[op]+1, metricBatches.value(op), op)
+	}
+}
@@ -50,6 +50,10 @@ func catchBadCrypto(next http.HandlerFunc) http.HandlerFunc {
 
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
+			if requestTooLarge(err) {
+				WeaveRequestTooLarge(w, r, errors.Wrap(err, "Could not download crypto body"))
+				return
+			}
 			InternalError(w, r, errors.Wrap(err, "Could not download crypto body"))
 			return
 		}
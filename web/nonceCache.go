@@ -0,0 +1,368 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/willf/bloom"
+	"go.mozilla.org/hawk"
+)
+
+const (
+	defaultNonceMaxEntries = 500000
+
+	// overflow bloom filters kept before the oldest is dropped, this
+	// bounds memory when the cache is full for a long time
+	maxNonceOverflows = 4
+
+	// smallest overflow bloom filter in bits
+	minNonceOverflowBits = 1 << 16
+)
+
+// nonceFileMagic starts a saved NonceCache file
+var nonceFileMagic = []byte("NONCES01")
+
+type NonceCacheConfig struct {
+	// MaxEntries is the most nonces remembered exactly. When it is reached
+	// the nonces closest to expiring move to a bloom filter
+	MaxEntries int
+
+	// File, when set, is where nonces are saved so replays are still
+	// caught after a restart
+	File         string
+	SaveInterval time.Duration
+}
+
+// nonceKey is a hash of the nonce, timestamp and token id. Hashing keeps
+// entries a fixed size no matter how large the token is
+type nonceKey [16]byte
+
+func newNonceKey(nonce string, ts time.Time, id string) (key nonceKey) {
+	h := sha256.New()
+	h.Write([]byte(nonce))
+	h.Write([]byte{0})
+	binary.Write(h, binary.BigEndian, ts.Unix())
+	h.Write([]byte(id))
+	copy(key[:], h.Sum(nil))
+	return
+}
+
+// NonceCache remembers hawk nonces to catch replayed requests. A nonce is
+// kept until its timestamp is outside of hawk.MaxTimestampSkew, when the
+// request would be rejected anyways. Requests with timestamps outside of
+// the skew are never stored.
+type NonceCache struct {
+	sync.Mutex
+	config NonceCacheConfig
+
+	entries map[nonceKey]int64   // key => expiry, unix seconds
+	expires map[int64][]nonceKey // expiry => keys
+	oldest  int64                // nothing expires before this second
+
+	// nonces pushed out when entries is full, oldest first. A filter
+	// is dropped once all of its nonces have expired
+	overflow []*nonceOverflow
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// nonceOverflow is a bloom filter of up to MaxEntries nonces
+type nonceOverflow struct {
+	filter *bloom.BloomFilter
+	n      int
+	until  int64 // when the last nonce in it expires
+}
+
+func NewNonceCache(config NonceCacheConfig) *NonceCache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultNonceMaxEntries
+	}
+
+	c := &NonceCache{
+		config:  config,
+		entries: make(map[nonceKey]int64),
+		expires: make(map[int64][]nonceKey),
+		oldest:  time.Now().Unix(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if config.File != "" {
+		if err := c.load(time.Now()); err != nil {
+			log.WithFields(log.Fields{
+				"file": config.File,
+				"err":  err.Error(),
+			}).Error("NonceCache could not load saved nonces")
+		}
+	}
+
+	if config.File != "" && config.SaveInterval > 0 {
+		go c.run()
+	} else {
+		close(c.done)
+	}
+
+	return c
+}
+
+func (c *NonceCache) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.saveAndLog()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops background saving and saves the nonces one last time
+func (c *NonceCache) Close() {
+	select {
+	case <-c.stop:
+		return
+	default:
+		close(c.stop)
+	}
+	<-c.done
+
+	if c.config.File != "" {
+		c.saveAndLog()
+	}
+}
+
+// Check records the nonce and returns true if it has not been seen before
+func (c *NonceCache) Check(nonce string, ts time.Time, id string) bool {
+	return c.check(newNonceKey(nonce, ts, id), ts.Unix(), time.Now().Unix())
+}
+
+func (c *NonceCache) check(key nonceKey, ts, now int64) bool {
+	skew := int64(hawk.MaxTimestampSkew / time.Second)
+
+	// auth.Valid() will reject it, no need to remember it. The extra
+	// second covers the rounding of hawk timestamps
+	if ts < now-skew-1 || ts > now+skew+1 {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.expire(now)
+
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+
+	for _, o := range c.overflow {
+		if o.filter.Test(key[:]) {
+			return false
+		}
+	}
+
+	c.add(key, ts+skew+2)
+	return true
+}
+
+// add stores a key, making room if needed. The caller must hold the lock
+func (c *NonceCache) add(key nonceKey, expiry int64) {
+	if len(c.entries) >= c.config.MaxEntries {
+		c.evict()
+	}
+
+	c.entries[key] = expiry
+	c.expires[expiry] = append(c.expires[expiry], key)
+	if expiry < c.oldest {
+		c.oldest = expiry
+	}
+}
+
+// evict moves the nonces closest to expiring into an overflow bloom
+// filter. The caller must hold the lock
+func (c *NonceCache) evict() {
+	var o *nonceOverflow
+	if len(c.overflow) > 0 {
+		o = c.overflow[len(c.overflow)-1]
+	}
+
+	if o == nil || o.n >= c.config.MaxEntries {
+		// about a 1% false positive rate when full
+		bits := c.config.MaxEntries * 10
+		if bits < minNonceOverflowBits {
+			bits = minNonceOverflowBits
+		}
+
+		o = &nonceOverflow{filter: bloom.New(uint(bits), 7)}
+		c.overflow = append(c.overflow, o)
+
+		if len(c.overflow) > maxNonceOverflows {
+			log.Warn("NonceCache dropping unexpired nonces, HAWK_NONCE_MAX_ENTRIES is too small")
+			c.overflow = c.overflow[1:]
+		}
+	}
+
+	for ; len(c.expires) > 0; c.oldest++ {
+		keys, ok := c.expires[c.oldest]
+		if !ok {
+			continue
+		}
+
+		for _, key := range keys {
+			o.filter.Add(key[:])
+			delete(c.entries, key)
+		}
+		delete(c.expires, c.oldest)
+
+		o.n += len(keys)
+		if c.oldest > o.until {
+			o.until = c.oldest
+		}
+
+		metricNonceOverflow.Add(float64(len(keys)))
+		return
+	}
+}
+
+// expire removes nonces that can not pass the timestamp check anymore.
+// The caller must hold the lock
+func (c *NonceCache) expire(now int64) {
+	if len(c.expires) == 0 {
+		c.oldest = now
+	}
+
+	for ; c.oldest <= now; c.oldest++ {
+		for _, key := range c.expires[c.oldest] {
+			delete(c.entries, key)
+		}
+		delete(c.expires, c.oldest)
+	}
+
+	for len(c.overflow) > 0 && c.overflow[0].until <= now {
+		c.overflow = c.overflow[1:]
+	}
+}
+
+// Len is the number of nonces remembered exactly
+func (c *NonceCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+func (c *NonceCache) saveAndLog() {
+	start := time.Now()
+	if n, err := c.save(); err != nil {
+		log.WithFields(log.Fields{
+			"file": c.config.File,
+			"err":  err.Error(),
+		}).Error("NonceCache could not save nonces")
+	} else {
+		log.WithFields(log.Fields{
+			"file":   c.config.File,
+			"nonces": n,
+			"t":      int64(time.Since(start) / time.Millisecond),
+		}).Debug("NonceCache saved nonces")
+	}
+}
+
+// save writes the nonces to a temporary file and moves it into place
+// so a crash never leaves a partial file. Nonces in the overflow bloom
+// filter are not saved
+func (c *NonceCache) save() (int, error) {
+	c.Lock()
+	buf := bytes.NewBuffer(make([]byte, 0, len(nonceFileMagic)+len(c.entries)*24))
+	buf.Write(nonceFileMagic)
+	for key, expiry := range c.entries {
+		buf.Write(key[:])
+		binary.Write(buf, binary.BigEndian, expiry)
+	}
+	n := len(c.entries)
+	c.Unlock()
+
+	tmp := c.config.File + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not create file")
+	}
+
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "Could not write file")
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "Could not sync file")
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "Could not close file")
+	}
+
+	if err := os.Rename(tmp, c.config.File); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "Could not rename file")
+	}
+
+	return n, nil
+}
+
+// load reads saved nonces that have not expired yet
+func (c *NonceCache) load(now time.Time) error {
+	f, err := os.Open(c.config.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Could not open file")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(nonceFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, nonceFileMagic) {
+		return errors.New("Not a nonce cache file")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	var (
+		key    nonceKey
+		expiry int64
+	)
+
+	for {
+		if _, err := io.ReadFull(r, key[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "Could not read nonce")
+		}
+
+		if err := binary.Read(r, binary.BigEndian, &expiry); err != nil {
+			return errors.Wrap(err, "Could not read expiry")
+		}
+
+		if expiry > now.Unix() {
+			c.add(key, expiry)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/hawk"
+)
+
+func TestNonceCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewNonceCache(NonceCacheConfig{})
+	skew := int64(hawk.MaxTimestampSkew / time.Second)
+	now := time.Now().Unix()
+
+	key := newNonceKey("nonce", time.Unix(now, 0), "id")
+	assert.True(c.check(key, now, now))
+	assert.False(c.check(key, now, now))
+
+	// still a replay right up to the edge of the skew
+	assert.False(c.check(key, now, now+skew))
+
+	// then forgotten
+	assert.True(c.check(key, now, now+skew+2))
+	assert.True(c.check(newNonceKey("other", time.Unix(now+skew+2, 0), "id"), now+skew+2, now+skew+2))
+	assert.Equal(1, c.Len())
+
+	// different ids and timestamps are different nonces
+	assert.NotEqual(newNonceKey("nonce", time.Unix(now, 0), "id"), newNonceKey("nonce", time.Unix(now, 0), "id2"))
+	assert.NotEqual(newNonceKey("nonce", time.Unix(now, 0), "id"), newNonceKey("nonce", time.Unix(now+1, 0), "id"))
+}
+
+func TestNonceCacheOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewNonceCache(NonceCacheConfig{MaxEntries: 10})
+	now := time.Now().Unix()
+
+	keys := make([]nonceKey, 20)
+	for i := range keys {
+		// older timestamps expire first
+		ts := now - 20 + int64(i)
+		keys[i] = newNonceKey(strconv.Itoa(i), time.Unix(ts, 0), "id")
+		assert.True(c.check(keys[i], ts, now))
+	}
+
+	assert.Equal(10, c.Len())
+
+	// the oldest were moved to the bloom filter and are still caught
+	for i := range keys {
+		assert.False(c.check(keys[i], now-20+int64(i), now), "nonce %d not found", i)
+	}
+
+	// the bloom filter is dropped once everything in it has expired
+	c.Lock()
+	assert.Len(c.overflow, 1)
+	c.expire(now + int64(hawk.MaxTimestampSkew/time.Second))
+	assert.Len(c.overflow, 0)
+	c.Unlock()
+}
+
+func TestNonceCacheOverflowBounded(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewNonceCache(NonceCacheConfig{MaxEntries: 10})
+	now := time.Now().Unix()
+
+	// fill more overflow filters than are kept
+	for i := 0; i < 10*(maxNonceOverflows+2); i++ {
+		key := newNonceKey(strconv.Itoa(i), time.Unix(now, 0), "id")
+		c.check(key, now, now)
+	}
+
+	c.Lock()
+	assert.Len(c.overflow, maxNonceOverflows)
+	c.Unlock()
+}
+
+func TestNonceCacheSave(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "nonces")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "nonces")
+	ts := time.Now()
+
+	c := NewNonceCache(NonceCacheConfig{File: file, SaveInterval: time.Hour})
+	assert.True(c.Check("a", ts, "id"))
+	assert.True(c.Check("b", ts, "id"))
+	c.Close()
+
+	// the replays are caught after a restart
+	c = NewNonceCache(NonceCacheConfig{File: file})
+	assert.Equal(2, c.Len())
+	assert.False(c.Check("a", ts, "id"))
+	assert.True(c.Check("c", ts, "id"))
+
+	// expired nonces are not loaded
+	c.Lock()
+	c.entries = map[nonceKey]int64{newNonceKey("old", ts, "id"): ts.Unix() - 1}
+	c.Unlock()
+	_, err = c.save()
+	assert.NoError(err)
+	assert.Equal(0, NewNonceCache(NonceCacheConfig{File: file}).Len())
+
+	// a bad file is ignored
+	ioutil.WriteFile(file, []byte("garbage"), 0600)
+	assert.Equal(0, NewNonceCache(NonceCacheConfig{File: file}).Len())
+}
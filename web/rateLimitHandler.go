@@ -0,0 +1,212 @@
+package web
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUserRateLimited = errors.New("User rate limit exceeded")
+	ErrIPRateLimited   = errors.New("IP rate limit exceeded")
+)
+
+// how often full (idle) buckets are removed to free memory
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens and refills at rate tokens
+// per second. Each request takes one token
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a tokenBucket for each key
+type rateLimiter struct {
+	sync.Mutex
+
+	rate  float64 // tokens per second
+	burst float64
+
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it
+// returns false and how long until there will be a token
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep removes buckets that have refilled completely. They are the
+// same as a new bucket. The caller must hold the lock
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// sendRateLimited sends a 429 with a Retry-After of at least a second
+func sendRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration, reason error) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendRequestProblem(w, r, http.StatusTooManyRequests, reason)
+}
+
+type UserRateLimitConfig struct {
+	// requests per second and the most that can be done at once.
+	// A 0 rate disables the limit
+	ReadRate   float64
+	ReadBurst  int
+	WriteRate  float64
+	WriteBurst int
+}
+
+// UserRateLimitHandler limits how often each user can make requests so
+// one misbehaving client can not starve the user's other devices. Reads
+// and writes have separate budgets. It needs the session token so it
+// must come after the HawkHandler
+type UserRateLimitHandler struct {
+	handler http.Handler
+	read    *rateLimiter
+	write   *rateLimiter
+}
+
+func NewUserRateLimitHandler(h http.Handler, config UserRateLimitConfig) *UserRateLimitHandler {
+	handler := &UserRateLimitHandler{handler: h}
+
+	if config.ReadRate > 0 {
+		handler.read = newRateLimiter(config.ReadRate, config.ReadBurst)
+	}
+
+	if config.WriteRate > 0 {
+		handler.write = newRateLimiter(config.WriteRate, config.WriteBurst)
+	}
+
+	return handler
+}
+
+func (h *UserRateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var uid string
+	if session, ok := SessionFromContext(r.Context()); ok {
+		uid = session.Token.UidString()
+	}
+
+	limiter, kind := h.write, "write"
+	if r.Method == "GET" || r.Method == "HEAD" {
+		limiter, kind = h.read, "read"
+	}
+
+	if limiter != nil && uid != "" {
+		if ok, wait := limiter.allow(uid, time.Now()); !ok {
+			metricRateLimited.Inc("user_" + kind)
+			sendRateLimited(w, r, wait,
+				errors.Wrapf(ErrUserRateLimited, "uid=%s %s", uid, kind))
+			return
+		}
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+type IPRateLimitConfig struct {
+	Rate  float64 // requests per second
+	Burst int
+
+	// use the last address in X-Forwarded-For, the one added by
+	// our load balancer, instead of the connection's address
+	TrustForwardedFor bool
+}
+
+// IPRateLimitHandler limits requests per remote address. It goes
+// before the HawkHandler so floods of unauthenticated requests are
+// turned away before any crypto is done
+type IPRateLimitHandler struct {
+	handler http.Handler
+	config  IPRateLimitConfig
+	limiter *rateLimiter
+}
+
+func NewIPRateLimitHandler(h http.Handler, config IPRateLimitConfig) *IPRateLimitHandler {
+	return &IPRateLimitHandler{
+		handler: h,
+		config:  config,
+		limiter: newRateLimiter(config.Rate, config.Burst),
+	}
+}
+
+func (h *IPRateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := h.remoteIP(r)
+	if ok, wait := h.limiter.allow(ip, time.Now()); !ok {
+		metricRateLimited.Inc("ip")
+		sendRateLimited(w, r, wait, errors.Wrapf(ErrIPRateLimited, "ip=%s", ip))
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *IPRateLimitHandler) remoteIP(r *http.Request) string {
+	if h.config.TrustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
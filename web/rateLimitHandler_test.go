@@ -0,0 +1,118 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newRateLimiter(2, 3) // 2/second, burst of 3
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a", now)
+		assert.True(ok)
+	}
+
+	ok, wait := l.allow("a", now)
+	assert.False(ok)
+	assert.Equal(500*time.Millisecond, wait)
+
+	// other keys have their own bucket
+	ok, _ = l.allow("b", now)
+	assert.True(ok)
+
+	// refills over time
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	assert.True(ok)
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	assert.False(ok)
+
+	// full buckets are swept
+	l.allow("c", now.Add(rateLimitSweepInterval+time.Second))
+	assert.Len(l.buckets, 1)
+}
+
+func TestUserRateLimitHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewUserRateLimitHandler(EchoHandler, UserRateLimitConfig{
+		ReadRate:   0.1,
+		ReadBurst:  2,
+		WriteRate:  0.1,
+		WriteBurst: 1,
+	})
+
+	uid := uniqueUID()
+	url := syncurl(uid, "storage/col/b0")
+
+	assert.Equal(http.StatusOK, request("GET", url, nil, handler).Code)
+	assert.Equal(http.StatusOK, request("GET", url, nil, handler).Code)
+
+	resp := request("GET", url, nil, handler)
+	assert.Equal(http.StatusTooManyRequests, resp.Code)
+	assert.Equal("10", resp.Header().Get("Retry-After"))
+	assert.Contains(resp.Body.String(), "User rate limit exceeded")
+
+	// writes have their own budget
+	assert.Equal(http.StatusOK, request("PUT", url, bytes.NewBufferString("{}"), handler).Code)
+	resp = request("DELETE", url, nil, handler)
+	assert.Equal(http.StatusTooManyRequests, resp.Code)
+
+	// other users are not affected
+	assert.Equal(http.StatusOK, request("GET", syncurl(uniqueUID(), "storage/col/b0"), nil, handler).Code)
+}
+
+func TestUserRateLimitHandlerDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewUserRateLimitHandler(EchoHandler, UserRateLimitConfig{})
+	url := syncurl(uniqueUID(), "storage/col/b0")
+	for i := 0; i < 10; i++ {
+		assert.Equal(http.StatusOK, request("GET", url, nil, handler).Code)
+	}
+}
+
+func TestIPRateLimitHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	send := func(handler http.Handler, remoteAddr, xff string) int {
+		req, _ := http.NewRequest("GET", "http://test/1.5/123/info/collections", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		return sendrequest(req, handler).Code
+	}
+
+	{
+		handler := NewIPRateLimitHandler(EchoHandler, IPRateLimitConfig{Rate: 0.1, Burst: 1})
+		assert.Equal(http.StatusOK, send(handler, "10.0.0.1:1234", ""))
+
+		// a different port is the same client
+		assert.Equal(http.StatusTooManyRequests, send(handler, "10.0.0.1:5678", ""))
+		assert.Equal(http.StatusOK, send(handler, "10.0.0.2:1234", ""))
+
+		// X-Forwarded-For is ignored unless trusted
+		assert.Equal(http.StatusTooManyRequests, send(handler, "10.0.0.1:1234", "192.168.1.1"))
+	}
+
+	{
+		handler := NewIPRateLimitHandler(EchoHandler, IPRateLimitConfig{
+			Rate:              0.1,
+			Burst:             1,
+			TrustForwardedFor: true,
+		})
+
+		// the load balancer's address is the same for everyone
+		assert.Equal(http.StatusOK, send(handler, "10.0.0.1:1234", "1.2.3.4, 192.168.1.1"))
+		assert.Equal(http.StatusOK, send(handler, "10.0.0.1:1234", "192.168.1.2"))
+		assert.Equal(http.StatusTooManyRequests, send(handler, "10.0.0.1:1234", "192.168.1.1"))
+	}
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrRequestTooLarge = errors.New("Request body too large")
+)
+
+// RequestLimitHandler caps the size of request bodies before anything
+// downstream has a chance to buffer them. Requests with a Content-Length
+// over the limit are rejected immediately. Bodies without one (chunked)
+// are wrapped so reads fail with ErrRequestTooLarge once the limit is passed
+type RequestLimitHandler struct {
+	handler  http.Handler
+	maxBytes int64
+}
+
+func NewRequestLimitHandler(h http.Handler, maxBytes int) *RequestLimitHandler {
+	return &RequestLimitHandler{
+		handler:  h,
+		maxBytes: int64(maxBytes),
+	}
+}
+
+func (h *RequestLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		// wrap it first so even draining the body of a rejected
+		// request can not read more than maxBytes
+		r.Body = &limitedBody{rc: r.Body, remaining: h.maxBytes}
+	}
+
+	if r.ContentLength > h.maxBytes {
+		WeaveRequestTooLarge(w, r,
+			errors.Wrapf(ErrRequestTooLarge, "Content-Length(%d) > %d", r.ContentLength, h.maxBytes))
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// limitedBody is like http.MaxBytesReader except it returns
+// ErrRequestTooLarge so handlers can tell it apart from other read errors
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (l *limitedBody) Read(p []byte) (n int, err error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// read one more byte than allowed to detect going over the limit
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err = l.rc.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		l.err = err
+		return n, err
+	}
+
+	n = int(l.remaining)
+	l.remaining = 0
+	l.err = ErrRequestTooLarge
+	return n, l.err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
+}
+
+// requestTooLarge checks if err was caused by reading past the
+// limit set by RequestLimitHandler
+func requestTooLarge(err error) bool {
+	return errors.Cause(err) == ErrRequestTooLarge
+}
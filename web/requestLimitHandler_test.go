@@ -0,0 +1,101 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// unsized hides the type of the reader so http.NewRequest can not
+// determine the ContentLength, like a chunked request body
+type unsized struct {
+	io.Reader
+}
+
+func TestRequestLimitHandlerContentLength(t *testing.T) {
+	assert := assert.New(t)
+
+	called := false
+	h := NewRequestLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), 10)
+
+	body := bytes.NewBufferString(strings.Repeat("a", 11))
+	resp := request("POST", syncurl(uniqueUID(), "storage/col"), body, h)
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, resp.Body.String())
+	assert.False(called, "Expected downstream handler not to be called")
+}
+
+func TestRequestLimitHandlerChunked(t *testing.T) {
+	assert := assert.New(t)
+
+	var readErr error
+	h := NewRequestLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	}), 10)
+
+	{ // at the limit is ok
+		body := unsized{strings.NewReader(strings.Repeat("a", 10))}
+		request("POST", syncurl(uniqueUID(), "storage/col"), body, h)
+		assert.NoError(readErr)
+	}
+
+	{ // over the limit
+		body := unsized{strings.NewReader(strings.Repeat("a", 11))}
+		request("POST", syncurl(uniqueUID(), "storage/col"), body, h)
+		assert.Equal(ErrRequestTooLarge, readErr)
+	}
+}
+
+func TestRequestLimitHandlerSyncUserHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	h := NewRequestLimitHandler(NewSyncUserHandler(uid, db, nil), 64)
+
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/json")
+
+	payload := `{"payload":"` + strings.Repeat("a", 64) + `"}`
+
+	{ // PUT
+		body := unsized{strings.NewReader(payload)}
+		resp := requestheaders("PUT", syncurl(uid, "storage/col/b0"), body, header, h)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // POST
+		body := unsized{strings.NewReader("[" + payload + "]")}
+		resp := requestheaders("POST", syncurl(uid, "storage/col"), body, header, h)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // POST application/newlines
+		header.Set("Content-Type", "application/newlines")
+		body := unsized{strings.NewReader(payload + "\n")}
+		resp := requestheaders("POST", syncurl(uid, "storage/col"), body, header, h)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // crypto/keys
+		header.Set("Content-Type", "application/json")
+		body := unsized{strings.NewReader(payload)}
+		resp := requestheaders("PUT", syncurl(uid, "storage/crypto/keys"), body, header, h)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+	}
+
+	{ // small enough requests work
+		body := unsized{strings.NewReader(`{"payload":"hi"}`)}
+		resp := requestheaders("PUT", syncurl(uid, "storage/col/b0"), body, header, h)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+}
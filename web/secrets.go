@@ -0,0 +1,226 @@
+package web
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Secret is a secret shared with the tokenserver. Tokens signed with it are
+// only accepted between NotBefore and NotAfter. A zero time is unbounded
+type Secret struct {
+	Value     string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Active checks if tokens signed with the secret are accepted at t
+func (s Secret) Active(t time.Time) bool {
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		return false
+	}
+	if !s.NotAfter.IsZero() && t.After(s.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// NewSecrets makes Secrets that are always active
+func NewSecrets(values []string) []Secret {
+	secrets := make([]Secret, len(values))
+	for i, value := range values {
+		secrets[i] = Secret{Value: value}
+	}
+	return secrets
+}
+
+// ParseSecrets reads one secret per line. A secret can be followed by
+// not_before=<RFC3339> and not_after=<RFC3339>. Blank lines and lines
+// starting with # are skipped:
+//
+//	# retired on the 1st
+//	oldsecret not_after=2017-06-01T00:00:00Z
+//	newsecret not_before=2017-05-01T00:00:00Z
+func ParseSecrets(r io.Reader) ([]Secret, error) {
+	var secrets []Secret
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		secret := Secret{Value: fields[0]}
+
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("line %d: expected key=value, got %s", lineNum, field)
+			}
+
+			t, err := time.Parse(time.RFC3339, parts[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d: invalid %s", lineNum, parts[0])
+			}
+
+			switch parts[0] {
+			case "not_before":
+				secret.NotBefore = t
+			case "not_after":
+				secret.NotAfter = t
+			default:
+				return nil, errors.Errorf("line %d: unknown field %s", lineNum, parts[0])
+			}
+		}
+
+		if !secret.NotBefore.IsZero() && !secret.NotAfter.IsZero() && !secret.NotAfter.After(secret.NotBefore) {
+			return nil, errors.Errorf("line %d: not_after must be after not_before", lineNum)
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read secrets")
+	}
+
+	if len(secrets) == 0 {
+		return nil, errors.New("No secrets found")
+	}
+
+	return secrets, nil
+}
+
+// LoadSecretsFile reads secrets from a file, see ParseSecrets
+func LoadSecretsFile(path string) ([]Secret, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open secrets file")
+	}
+	defer f.Close()
+
+	return ParseSecrets(f)
+}
+
+// SecretsWatcher reloads a secrets file when it changes and passes the
+// new secrets to OnChange. A file that can not be loaded is logged and
+// the current secrets are kept
+type SecretsWatcher struct {
+	sync.Mutex
+
+	file     string
+	onChange func([]Secret)
+
+	// modification time and size of the last file loaded
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSecretsWatcher checks file for changes every interval. Reload can
+// be called, e.g. on SIGHUP, to load it right away
+func NewSecretsWatcher(file string, interval time.Duration, onChange func([]Secret)) *SecretsWatcher {
+	w := &SecretsWatcher{
+		file:     file,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if info, err := os.Stat(file); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+
+	if interval > 0 {
+		go w.run(interval)
+	} else {
+		close(w.done)
+	}
+
+	return w
+}
+
+func (w *SecretsWatcher) run(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Stop ends watching for changes
+func (w *SecretsWatcher) Stop() {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+}
+
+// check reloads the file if it has changed
+func (w *SecretsWatcher) check() {
+	info, err := os.Stat(w.file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": w.file,
+			"err":  err.Error(),
+		}).Error("SecretsWatcher could not stat secrets file")
+		return
+	}
+
+	w.Lock()
+	changed := !info.ModTime().Equal(w.modTime) || info.Size() != w.size
+	w.Unlock()
+
+	if changed {
+		w.Reload()
+	}
+}
+
+// Reload loads the file and passes the secrets to OnChange
+func (w *SecretsWatcher) Reload() error {
+	w.Lock()
+	defer w.Unlock()
+
+	info, err := os.Stat(w.file)
+	if err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+
+	secrets, err := LoadSecretsFile(w.file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": w.file,
+			"err":  err.Error(),
+		}).Error("SecretsWatcher could not load secrets, keeping the current ones")
+		return err
+	}
+
+	w.onChange(secrets)
+
+	log.WithFields(log.Fields{
+		"file":    w.file,
+		"secrets": len(secrets),
+	}).Info("SecretsWatcher loaded secrets")
+
+	return nil
+}
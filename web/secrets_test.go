@@ -0,0 +1,146 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	secrets, err := ParseSecrets(strings.NewReader(`
+# comment
+one
+two not_before=2017-05-01T00:00:00Z
+three not_after=2017-06-01T00:00:00Z not_before=2017-01-01T00:00:00Z
+`))
+
+	if !assert.NoError(err) {
+		return
+	}
+
+	may := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal([]Secret{
+		{Value: "one"},
+		{Value: "two", NotBefore: may},
+		{
+			Value:     "three",
+			NotBefore: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:  time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}, secrets)
+
+	assert.True(secrets[1].Active(may))
+	assert.False(secrets[1].Active(may.Add(-time.Second)))
+	assert.True(secrets[2].Active(may))
+	assert.False(secrets[2].Active(may.AddDate(0, 2, 0)))
+
+	for _, bad := range []string{
+		"",
+		"# only a comment",
+		"one not_before",
+		"one not_before=yesterday",
+		"one expires=2017-05-01T00:00:00Z",
+		"one not_before=2017-06-01T00:00:00Z not_after=2017-05-01T00:00:00Z",
+	} {
+		_, err := ParseSecrets(strings.NewReader(bad))
+		assert.Error(err, bad)
+	}
+}
+
+func TestHawkSecretsTimes(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, nil)
+	hawkH.SetSecrets([]Secret{
+		{Value: "retired", NotAfter: time.Now().Add(-time.Minute)},
+		{Value: "current"},
+		{Value: "next", NotBefore: time.Now().Add(time.Hour)},
+	})
+
+	send := func(secret string) int {
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), testtoken(secret, uid))
+		return sendrequest(req, hawkH).Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, send("retired"))
+	assert.Equal(http.StatusOK, send("current"))
+	assert.Equal(http.StatusUnauthorized, send("next"))
+
+	// the index of the matching secret is passed on for logging
+	var session *Session
+	hawkH.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ = SessionFromContext(r.Context())
+	})
+	send("current")
+	if assert.NotNil(session) {
+		assert.Equal(1, session.SecretIndex)
+	}
+}
+
+func TestHawkSecretsRetiredWhileCached(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken("sekret", uid)
+
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
+	assert.Equal(1, hawkH.Tokens.Len())
+
+	// retire the secret without replacing the list, as if time passed
+	hawkH.secretsLock.Lock()
+	hawkH.secrets[0].NotAfter = time.Now().Add(-time.Second)
+	hawkH.secretsLock.Unlock()
+
+	req, _ = hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	assert.Equal(http.StatusUnauthorized, sendrequest(req, hawkH).Code)
+}
+
+func TestSecretsWatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secrets")
+	if !assert.NoError(ioutil.WriteFile(file, []byte("one\n"), 0600)) {
+		return
+	}
+
+	loaded := make(chan []Secret, 10)
+	w := NewSecretsWatcher(file, 10*time.Millisecond, func(s []Secret) { loaded <- s })
+	defer w.Stop()
+
+	// changes are picked up
+	ioutil.WriteFile(file, []byte("one\ntwo\n"), 0600)
+	select {
+	case secrets := <-loaded:
+		assert.Equal(NewSecrets([]string{"one", "two"}), secrets)
+	case <-time.After(5 * time.Second):
+		assert.Fail("secrets were not reloaded")
+	}
+
+	// bad files keep the current secrets
+	ioutil.WriteFile(file, []byte("# nothing\n"), 0600)
+	assert.Error(w.Reload())
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(loaded, 0)
+
+	// on demand
+	ioutil.WriteFile(file, []byte("three\n"), 0600)
+	assert.NoError(w.Reload())
+	assert.Equal(NewSecrets([]string{"three"}), <-loaded)
+}
@@ -13,6 +13,9 @@ var sKey sessionKey = 0
 type Session struct {
 	Token       token.TokenPayload
 	ErrorResult error
+
+	// index of the secret that verified the token
+	SecretIndex int
 }
 
 func NewSessionContext(ctx context.Context, ses *Session) context.Context {
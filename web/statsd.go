@@ -0,0 +1,272 @@
+package web
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// keeps packets under the common 1500 byte MTU
+	statsdPacketSize = 1432
+
+	// observations buffered between flushes, extra ones are dropped
+	statsdMaxTimings = 10000
+)
+
+type StatsdConfig struct {
+	// host:port of the statsd server
+	Addr string
+
+	// added to the start of every metric name, a "." is added
+	// between them when it does not end in one
+	Prefix string
+
+	// "key:value" tags sent with every metric. Only used with DogStatsD
+	Tags []string
+
+	// send metric labels as DogStatsD tags. Plain statsd does not
+	// have tags so label values are added to the metric name instead
+	DogStatsD bool
+
+	// how often aggregated metrics are sent
+	FlushInterval time.Duration
+
+	// fraction of timings that are sent, between 0 and 1. Counters and
+	// gauges are aggregated locally and are never sampled
+	SampleRate float64
+}
+
+// Statsd is a MetricsSink that pushes metrics to a statsd server over
+// UDP. Counters are summed and gauges keep their last value between
+// flushes so a busy server sends a handful of packets per interval
+// instead of one per request.
+type Statsd struct {
+	sync.Mutex
+
+	conf StatsdConfig
+	conn net.Conn
+
+	// metric line without the value => value
+	counters map[string]float64
+	gauges   map[string]float64
+	timings  []statsdTiming
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type statsdTiming struct {
+	name string // with the prefix
+	tags string
+	ms   float64
+}
+
+func NewStatsd(conf StatsdConfig) (*Statsd, error) {
+	if conf.SampleRate <= 0 || conf.SampleRate > 1 {
+		return nil, errors.Errorf("statsd: SampleRate must be > 0 and <= 1, got %v", conf.SampleRate)
+	}
+
+	if conf.FlushInterval <= 0 {
+		return nil, errors.New("statsd: FlushInterval must be > 0")
+	}
+
+	if conf.Prefix != "" && !strings.HasSuffix(conf.Prefix, ".") {
+		conf.Prefix += "."
+	}
+
+	conn, err := net.Dial("udp", conf.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "statsd: could not connect")
+	}
+
+	s := &Statsd{
+		conf:     conf,
+		conn:     conn,
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *Statsd) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// Close sends anything still buffered and closes the connection
+func (s *Statsd) Close() {
+	close(s.stop)
+	<-s.done
+	s.conn.Close()
+}
+
+// key turns a metric and its labels into the statsd name and tags
+func (s *Statsd) key(name string, labels, values []string) (string, string) {
+	name = s.conf.Prefix + name
+
+	if !s.conf.DogStatsD {
+		for _, v := range values {
+			name += "." + statsdSanitize(v)
+		}
+		return name, ""
+	}
+
+	tags := make([]string, 0, len(s.conf.Tags)+len(labels))
+	tags = append(tags, s.conf.Tags...)
+	for i, label := range labels {
+		tags = append(tags, label+":"+statsdTagEscaper.Replace(values[i]))
+	}
+
+	return name, strings.Join(tags, ",")
+}
+
+func (s *Statsd) Count(name string, labels, values []string, v float64) {
+	name, tags := s.key(name, labels, values)
+
+	s.Lock()
+	s.counters[statsdLine(name, "c", tags)] += v
+	s.Unlock()
+}
+
+func (s *Statsd) Gauge(name string, labels, values []string, v float64) {
+	name, tags := s.key(name, labels, values)
+
+	s.Lock()
+	s.gauges[statsdLine(name, "g", tags)] = v
+	s.Unlock()
+}
+
+// Observe sends v, in seconds, as a timing in milliseconds
+func (s *Statsd) Observe(name string, labels, values []string, v float64) {
+	if s.conf.SampleRate < 1 && rand.Float64() >= s.conf.SampleRate {
+		return
+	}
+
+	name, tags := s.key(name, labels, values)
+
+	s.Lock()
+	if len(s.timings) < statsdMaxTimings {
+		s.timings = append(s.timings, statsdTiming{name: name, tags: tags, ms: v * 1000})
+	}
+	s.Unlock()
+}
+
+// statsdLine is the name and tags of a metric in a way that is easy to
+// add the value to later. It looks like: name|type|#tags
+func statsdLine(name, kind, tags string) string {
+	if tags == "" {
+		return name + "|" + kind
+	}
+	return name + "|" + kind + "|#" + tags
+}
+
+// flush sends everything aggregated since the last flush
+func (s *Statsd) flush() {
+	s.Lock()
+	counters, gauges, timings := s.counters, s.gauges, s.timings
+	s.counters = make(map[string]float64)
+	s.gauges = make(map[string]float64)
+	s.timings = nil
+	s.Unlock()
+
+	lines := make([]string, 0, len(counters)+len(gauges)+len(timings))
+	for key, v := range counters {
+		lines = append(lines, statsdFormat(key, v))
+	}
+	for key, v := range gauges {
+		lines = append(lines, statsdFormat(key, v))
+	}
+	sort.Strings(lines)
+
+	var rate string
+	if s.conf.SampleRate < 1 {
+		rate = "|@" + strconv.FormatFloat(s.conf.SampleRate, 'f', -1, 64)
+	}
+
+	for _, t := range timings {
+		line := t.name + ":" + strconv.FormatFloat(t.ms, 'f', 3, 64) + "|ms" + rate
+		if t.tags != "" {
+			line += "|#" + t.tags
+		}
+		lines = append(lines, line)
+	}
+
+	s.send(lines)
+}
+
+// statsdFormat adds the value to a statsdLine key
+func statsdFormat(key string, v float64) string {
+	i := strings.Index(key, "|")
+	return key[:i] + ":" + strconv.FormatFloat(v, 'f', -1, 64) + key[i:]
+}
+
+// send packs lines into as few packets as possible
+func (s *Statsd) send(lines []string) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdPacketSize {
+			s.write(buf.Bytes())
+			buf.Reset()
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+
+	if buf.Len() > 0 {
+		s.write(buf.Bytes())
+	}
+}
+
+func (s *Statsd) write(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		if log.GetLevel() == log.DebugLevel {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Debug("statsd write failed")
+		}
+	}
+}
+
+// DogStatsD tag values can have most characters except the separators
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_", " ", "_")
+
+// statsdSanitize replaces characters that have a meaning in the
+// statsd protocol or that make awkward metric names
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
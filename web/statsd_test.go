@@ -0,0 +1,184 @@
+package web
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// statsdListener returns a local UDP listener and a func that reads
+// every line received until nothing arrives for a short while
+func statsdListener(t *testing.T) (net.PacketConn, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() []string {
+		var lines []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return lines
+			}
+
+			if n > statsdPacketSize {
+				t.Errorf("packet too large: %d bytes", n)
+			}
+
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+	}
+
+	return conn, read
+}
+
+func testStatsd(t *testing.T, addr string, conf StatsdConfig) (*Metrics, *Statsd) {
+	conf.Addr = addr
+	if conf.FlushInterval == 0 {
+		conf.FlushInterval = time.Hour
+	}
+	if conf.SampleRate == 0 {
+		conf.SampleRate = 1
+	}
+
+	s, err := NewStatsd(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetrics()
+	m.SetSink(s)
+	return m, s
+}
+
+func TestStatsdAggregates(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, read := statsdListener(t)
+	defer listener.Close()
+
+	m, s := testStatsd(t, listener.LocalAddr().String(), StatsdConfig{
+		Prefix:    "sync.",
+		Tags:      []string{"env:test"},
+		DogStatsD: true,
+	})
+	defer s.Close()
+
+	counter := m.NewCounter("requests", "", "route")
+	gauge := m.NewGauge("open", "")
+	hist := m.NewHistogram("took", "", latencyBuckets, "op")
+
+	for i := 0; i < 3; i++ {
+		counter.Inc("/1.5/{uid}/storage")
+	}
+	counter.Inc("a,b|c")
+	gauge.Add(5)
+	gauge.Add(-2)
+	hist.Observe(0.25, "purge")
+
+	s.flush()
+	lines := read()
+
+	assert.Contains(lines, "sync.requests:3|c|#env:test,route:/1.5/{uid}/storage")
+	assert.Contains(lines, "sync.requests:1|c|#env:test,route:a_b_c")
+	assert.Contains(lines, "sync.open:3|g|#env:test")
+	assert.Contains(lines, "sync.took:250.000|ms|#env:test,op:purge")
+	assert.Len(lines, 4)
+
+	// nothing new, nothing sent
+	s.flush()
+	assert.Len(read(), 0)
+}
+
+func TestStatsdPlain(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, read := statsdListener(t)
+	defer listener.Close()
+
+	m, s := testStatsd(t, listener.LocalAddr().String(), StatsdConfig{
+		Prefix: "sync",
+		Tags:   []string{"env:test"},
+	})
+
+	counter := m.NewCounter("requests", "", "route", "status")
+	counter.Inc("/1.5/{uid}", "200")
+
+	// Close sends what is left, the prefix gets its "."
+	s.Close()
+	assert.Equal([]string{"sync.requests._1_5__uid_.200:1|c"}, read())
+}
+
+func TestStatsdPackets(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, read := statsdListener(t)
+	defer listener.Close()
+
+	m, s := testStatsd(t, listener.LocalAddr().String(), StatsdConfig{DogStatsD: true})
+	defer s.Close()
+
+	// read() fails the test if a packet is larger than statsdPacketSize
+	counter := m.NewCounter("a_fairly_long_metric_name_to_fill_packets", "", "uid")
+	for i := 0; i < 200; i++ {
+		counter.Inc(strconv.Itoa(i))
+	}
+
+	s.flush()
+	assert.Len(read(), 200)
+}
+
+func TestStatsdSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, read := statsdListener(t)
+	defer listener.Close()
+
+	m, s := testStatsd(t, listener.LocalAddr().String(), StatsdConfig{
+		SampleRate: 0.5,
+	})
+	defer s.Close()
+
+	counter := m.NewCounter("count", "")
+	hist := m.NewHistogram("took", "", latencyBuckets)
+	for i := 0; i < 1000; i++ {
+		counter.Inc()
+		hist.Observe(0.001)
+	}
+
+	s.flush()
+	lines := read()
+
+	// counters are aggregated, not sampled
+	assert.Contains(lines, "count:1000|c")
+
+	timings := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "took:") {
+			assert.Equal("took:1.000|ms|@0.5", line)
+			timings++
+		}
+	}
+
+	assert.True(timings > 350 && timings < 650, "Expected about half the timings, got %d", timings)
+}
+
+func TestStatsdConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewStatsd(StatsdConfig{Addr: "127.0.0.1:8125", FlushInterval: time.Second, SampleRate: 0})
+	assert.Error(err)
+
+	_, err = NewStatsd(StatsdConfig{Addr: "127.0.0.1:8125", FlushInterval: time.Second, SampleRate: 1.5})
+	assert.Error(err)
+
+	_, err = NewStatsd(StatsdConfig{Addr: "127.0.0.1:8125", SampleRate: 1})
+	assert.Error(err)
+}
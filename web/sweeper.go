@@ -0,0 +1,503 @@
+package web
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+// how many DBs are swept between saves of the cursor
+const sweepCursorSaveEvery = 100
+
+var (
+	errSweepStopped = errors.New("Sweeper stopped")
+	sweepFileRegex  = regexp.MustCompile(`^[0-9]+\.db$`)
+)
+
+type SweeperConfig struct {
+	// DBs opened per second, the sweeper does nothing when it is 0
+	Rate float64
+
+	// KB of disk IO per second for vacuums, 0 is unlimited
+	IOBudgetKB int
+
+	// vacuum DBs with at least this much free, 0 never vacuums
+	VacuumKB int
+
+	// CursorFile, when set, is where the path of the last DB swept is
+	// saved so a restart continues where the sweeper left off
+	CursorFile string
+
+	// how long to wait after a full pass before starting over
+	PassInterval time.Duration
+
+	// remove users whose DB and data have not changed for this
+	// long, 0 keeps everyone
+	RetainFor time.Duration
+
+	// only log the users that would be removed
+	RetainDryRun bool
+
+	// ArchiveDir, when set, is where DBs are copied before their
+	// users are removed. It should not be in the Basepath
+	ArchiveDir string
+}
+
+// Sweeper walks every DB in the pool's Basepath and tidies up the ones
+// not in the pool. The pool only tidies users when they make requests so
+// users that never come back would keep their expired BSOs and batches
+// forever. It is meant to be slow, a pass over millions of DBs can take
+// days, and it stays out of the way of requests:
+//
+//   - users in the pool are skipped, the pool tidies them
+//   - users are only tidied when their NEXT_PURGE is due
+//   - it waits while the pool has maintenance queued
+//   - requests for a user being swept are retried like a conflict
+//
+// With RetainFor it also removes users that have stopped syncing so
+// disk usage follows the active users.
+type Sweeper struct {
+	pool   *SyncPoolHandler
+	config SweeperConfig
+	root   string
+
+	// relative path of the last DB visited, "" at the start of a pass
+	cursor string
+
+	// when the next DB can be opened
+	nextStart time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSweeper(pool *SyncPoolHandler, config SweeperConfig) (*Sweeper, error) {
+	if pool.config.Basepath == ":memory:" {
+		return nil, errors.New("Sweeper needs DBs on disk")
+	}
+
+	root, err := filepath.Abs(pool.config.Basepath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not determine absolute basepath")
+	}
+
+	s := &Sweeper{
+		pool:   pool,
+		config: config,
+		root:   root,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if config.CursorFile != "" {
+		cursor, err := ioutil.ReadFile(config.CursorFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "Could not read cursor")
+		}
+		s.cursor = strings.TrimSpace(string(cursor))
+	}
+
+	return s, nil
+}
+
+// Start sweeps in the background until Stop is called
+func (s *Sweeper) Start() {
+	if s.config.Rate <= 0 {
+		close(s.done)
+		return
+	}
+
+	go s.run()
+}
+
+// Stop waits for the DB being swept and saves the cursor
+func (s *Sweeper) Stop() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+
+	for {
+		err := s.pass()
+		if err == errSweepStopped {
+			s.saveCursor()
+			return
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err.Error(),
+				"cursor": s.cursor,
+			}).Error("Sweeper pass failed")
+		}
+
+		select {
+		case <-time.After(s.config.PassInterval):
+		case <-s.stop:
+			s.saveCursor()
+			return
+		}
+	}
+}
+
+// pass visits every DB after the cursor. The cursor is cleared when it
+// reaches the end
+func (s *Sweeper) pass() error {
+	start := time.Now()
+	counts := make(map[string]int)
+	sinceSave := 0
+
+	log.WithFields(log.Fields{
+		"cursor": s.cursor,
+	}).Info("Sweeper pass starting")
+
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-s.stop:
+			return errSweepStopped
+		default:
+		}
+
+		if err != nil {
+			// a directory removed while walking is not worth stopping for
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			// skip whole directories that come before the cursor
+			if rel != "." && sweepBefore(rel, s.cursor) && !strings.HasPrefix(s.cursor, rel+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !sweepFileRegex.MatchString(info.Name()) || !sweepBefore(s.cursor, rel) {
+			return nil
+		}
+
+		uid := strings.TrimSuffix(info.Name(), ".db")
+
+		// files that are not where the pool would look for them
+		dir, file := s.pool.pools[s.pool.poolIndex(uid)].PathAndFile(uid)
+		if filepath.Join(dir, file) != path {
+			return nil
+		}
+
+		if !s.wait() {
+			return errSweepStopped
+		}
+
+		result := s.sweep(uid)
+		counts[result]++
+		metricSweep.Inc(result)
+
+		s.cursor = rel
+		if sinceSave++; sinceSave >= sweepCursorSaveEvery {
+			s.saveCursor()
+			sinceSave = 0
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.cursor = ""
+	s.saveCursor()
+
+	log.WithFields(log.Fields{
+		"swept":    counts["swept"],
+		"not_due":  counts["not_due"],
+		"pooled":   counts["pooled"],
+		"inactive": counts["inactive"],
+		"deleted":  counts["deleted"],
+		"error":    counts["error"],
+		"t":        int64(time.Since(start) / time.Second),
+	}).Info("Sweeper pass done")
+
+	return nil
+}
+
+// sweep tidies uid's DB and paces the next one. It returns the result
+// for metrics
+func (s *Sweeper) sweep(uid string) string {
+	start := time.Now()
+	result, ioKB, err := s.pool.sweepUser(uid, s.config)
+
+	if s.nextStart.Before(start) {
+		s.nextStart = start
+	}
+	s.nextStart = s.nextStart.Add(time.Duration(float64(time.Second) / s.config.Rate))
+	if s.config.IOBudgetKB > 0 && ioKB > 0 {
+		s.nextStart = s.nextStart.Add(time.Duration(ioKB) * time.Second / time.Duration(s.config.IOBudgetKB))
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid": uid,
+			"err": err.Error(),
+		}).Error("Sweeper could not tidy up")
+		return "error"
+	}
+
+	return result
+}
+
+// wait blocks until the rate limit allows another DB and the pool has
+// no maintenance queued. It returns false if stopped while waiting
+func (s *Sweeper) wait() bool {
+	for {
+		delay := s.nextStart.Sub(time.Now())
+		if delay <= 0 {
+			if s.pool.maintenance.Len() == 0 {
+				return true
+			}
+			delay = time.Second
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return false
+		}
+	}
+}
+
+// saveCursor writes the cursor to a temporary file and moves it into
+// place so a crash never leaves a partial file
+func (s *Sweeper) saveCursor() {
+	if s.config.CursorFile == "" {
+		return
+	}
+
+	tmp := s.config.CursorFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(s.cursor+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.config.CursorFile)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		log.WithFields(log.Fields{
+			"file": s.config.CursorFile,
+			"err":  err.Error(),
+		}).Error("Sweeper could not save cursor")
+	}
+}
+
+// sweepBefore checks if slash separated path a comes before b in the
+// order filepath.Walk visits them. Everything comes after ""
+func sweepBefore(a, b string) bool {
+	if b == "" {
+		return false
+	}
+	if a == "" {
+		return true
+	}
+
+	aParts, bParts := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i]
+		}
+	}
+
+	return len(aParts) < len(bParts)
+}
+
+// sweepUser tidies up uid's DB when it is not in the pool, or removes
+// it when the user is inactive. The uid is reserved while its DB is
+// open so requests for it are retried like a conflict. Once a request
+// is waiting the vacuum and removal are skipped to hand the DB back
+func (s *SyncPoolHandler) sweepUser(uid string, config SweeperConfig) (result string, ioKB int, err error) {
+	pool := s.pools[s.poolIndex(uid)]
+	if !pool.reserve(uid) {
+		return "pooled", 0, nil
+	}
+	defer pool.release(uid)
+
+	dir, file := pool.PathAndFile(uid)
+	dbFile := filepath.Join(dir, file)
+
+	info, err := os.Stat(dbFile)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Could not stat DB")
+	}
+	mtime := info.ModTime()
+
+	db, err := pool.openStorage(dbFile, pool.dbConfig)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "Could not open DB")
+	}
+
+	// the sweeper is low priority, a returning user should not wait
+	// for a long vacuum
+	handler := NewSyncUserHandler(uid, db, pool.userHandlerConfig)
+	handler.yield = func() bool { return pool.wanted(uid) }
+	defer func() {
+		handler.StopHTTP()
+
+		// sweeping is not activity, keep the DB looking as old as it
+		// is so retention still finds it
+		if result != "deleted" {
+			os.Chtimes(dbFile, mtime, mtime)
+		}
+	}()
+
+	var inactive bool
+	var lastModified int
+	if config.RetainFor > 0 {
+		inactive, lastModified, err = isInactive(handler, mtime, config.RetainFor)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	// a request for them is waiting so they are back
+	if inactive && pool.wanted(uid) {
+		inactive = false
+	}
+
+	if inactive {
+		logFields := log.Fields{
+			"uid":           uid,
+			"last_modified": lastModified,
+			"mtime":         mtime.Format(time.RFC3339),
+			"size_kb":       info.Size() / 1024,
+		}
+
+		// in a dry run they are still tidied up like everyone else
+		if config.RetainDryRun {
+			log.WithFields(logFields).Info("Sweeper found inactive user")
+		} else {
+			ioKB, err := s.removeInactive(pool, handler, uid, dbFile, config.ArchiveDir)
+			if err != nil {
+				return "", ioKB, err
+			}
+
+			logFields["archive_dir"] = config.ArchiveDir
+			log.WithFields(logFields).Info("Sweeper deleted inactive user")
+			return "deleted", ioKB, nil
+		}
+	}
+
+	skipped, _, ioKB, err := handler.tidyUp(
+		time.Duration(s.config.PurgeMinHours)*time.Hour,
+		time.Duration(s.config.PurgeMaxHours)*time.Hour,
+		config.VacuumKB)
+	if err != nil {
+		return "", ioKB, err
+	}
+
+	switch {
+	case inactive:
+		return "inactive", ioKB, nil
+	case skipped:
+		return "not_due", ioKB, nil
+	default:
+		return "swept", ioKB, nil
+	}
+}
+
+// isInactive checks that neither the DB file nor the user's data has
+// changed for retainFor. The file's mtime is checked first so active
+// users do not need a query
+func isInactive(handler *SyncUserHandler, mtime time.Time, retainFor time.Duration) (inactive bool, lastModified int, err error) {
+	cutoff := time.Now().Add(-retainFor)
+	if mtime.After(cutoff) {
+		return false, 0, nil
+	}
+
+	// milliseconds, 0 when nothing was ever written
+	lastModified, err = handler.db.LastModified()
+	if err != nil {
+		return false, 0, errors.Wrap(err, "Could not get last modified")
+	}
+
+	return int64(lastModified) < cutoff.UnixNano()/int64(time.Millisecond), lastModified, nil
+}
+
+// removeInactive copies the user's DB to archiveDir, when it is set,
+// then deletes them like an admin delete. ioKB is how much was archived.
+// The caller has uid reserved
+func (s *SyncPoolHandler) removeInactive(pool *handlerPool, handler *SyncUserHandler, uid, dbFile, archiveDir string) (ioKB int, err error) {
+	if archiveDir != "" {
+		// the write-ahead log has to be in the DB file to copy it
+		if c, ok := handler.db.(syncstorage.Checkpointer); ok {
+			if err := c.Checkpoint(); err != nil {
+				return 0, errors.Wrap(err, "Could not checkpoint")
+			}
+		}
+
+		dest := filepath.Join(append(append([]string{archiveDir}, TwoLevelPath(uid)...), uid+".db")...)
+		copied, err := copyFile(dbFile, dest)
+		if err != nil {
+			return 0, errors.Wrap(err, "Could not archive DB")
+		}
+		ioKB = int(copied / 1024)
+	}
+
+	return ioKB, s.removeUser(pool, uid, handler)
+}
+
+// copyFile copies src to a temporary file next to dst and moves it into
+// place so dst is never a partial copy. It returns how many bytes
+// were copied
+func copyFile(src, dst string) (n int64, err error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return n, err
+}
@@ -0,0 +1,445 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSweepDB makes uid's DB where the pool looks for it with a BSO
+// that expires right away. NEXT_PURGE is set when nextPurge is not ""
+func testSweepDB(t *testing.T, pool *SyncPoolHandler, uid, nextPurge string) string {
+	dir, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, file)
+	db, err := syncstorage.NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutBSO(4, "expired", syncstorage.String("x"), nil, syncstorage.Int(1)); err != nil {
+		t.Fatal(err)
+	}
+	if nextPurge != "" {
+		if err := db.SetKey("NEXT_PURGE", nextPurge); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// testSweepBSOs counts the expired BSOs still in the DB at path. Reads
+// do not see expired BSOs so they are counted by purging them
+func testSweepBSOs(t *testing.T, path string) int {
+	db, err := syncstorage.NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	purged, err := db.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return purged
+}
+
+func TestSweepBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(sweepBefore("01/02/3.db", ""))
+	assert.True(sweepBefore("", "01/02/3.db"))
+	assert.True(sweepBefore("01", "01/02/3.db"))
+	assert.True(sweepBefore("01/02/3.db", "01/02/4.db"))
+	assert.True(sweepBefore("01/02/3.db", "01/03"))
+	assert.False(sweepBefore("01/03", "01/02/3.db"))
+	assert.False(sweepBefore("01/02/3.db", "01/02/3.db"))
+
+	// Walk visits "01/02" before "01-02", unlike comparing strings
+	assert.True(sweepBefore("01/02", "01-02"))
+}
+
+func TestSweeperPass(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	config.PurgeMinHours = 1
+	config.PurgeMaxHours = 2
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	due := testSweepDB(t, pool, "1234", past)
+	notDue := testSweepDB(t, pool, "5678", time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	pooled := testSweepDB(t, pool, "9012", past)
+	neverPurged := testSweepDB(t, pool, "3456", "")
+
+	// not user DBs
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "7890.db"), nil, 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "hawk_nonces.cache"), nil, 0644))
+
+	_, _, err = pool.pools[pool.poolIndex("9012")].getElement("9012")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// TTLs are in milliseconds
+	time.Sleep(100 * time.Millisecond)
+
+	cursorFile := filepath.Join(dir, "sweeper.cursor")
+	s, err := NewSweeper(pool, SweeperConfig{Rate: 1000, CursorFile: cursorFile})
+	if !assert.NoError(err) {
+		return
+	}
+
+	if !assert.NoError(s.pass()) {
+		return
+	}
+
+	assert.Equal(0, testSweepBSOs(t, due))
+	assert.Equal(1, testSweepBSOs(t, notDue))
+	assert.Equal(1, testSweepBSOs(t, neverPurged))
+
+	// pooled users are left to the pool
+	element := pool.pools[pool.poolIndex("9012")].peekElement("9012")
+	if assert.NotNil(element) {
+		assert.False(element.handler.IsStopped())
+	}
+	pool.EvictUser("9012")
+	assert.Equal(1, testSweepBSOs(t, pooled))
+
+	// NEXT_PURGE is set so the user is purged next time
+	db, err := syncstorage.NewDB(neverPurged, nil)
+	if assert.NoError(err) {
+		next, _ := db.GetKey("NEXT_PURGE")
+		assert.NotEqual("", next)
+		db.Close()
+	}
+
+	// a finished pass starts over
+	assert.Equal("", s.cursor)
+	cursor, err := ioutil.ReadFile(cursorFile)
+	assert.NoError(err)
+	assert.Equal("\n", string(cursor))
+}
+
+func TestSweeperResumes(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	before := testSweepDB(t, pool, "1200", past) // 00/21/1200.db
+	after := testSweepDB(t, pool, "1299", past)  // 99/21/1299.db
+	time.Sleep(100 * time.Millisecond)
+
+	// the cursor from a pass that was stopped
+	cursorFile := filepath.Join(dir, "sweeper.cursor")
+	assert.NoError(ioutil.WriteFile(cursorFile, []byte("00/21/1200.db\n"), 0644))
+
+	s, err := NewSweeper(pool, SweeperConfig{Rate: 1000, CursorFile: cursorFile})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("00/21/1200.db", s.cursor)
+
+	assert.NoError(s.pass())
+	assert.Equal(1, testSweepBSOs(t, before))
+	assert.Equal(0, testSweepBSOs(t, after))
+}
+
+func TestSweeperStop(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	testSweepDB(t, pool, "1234", "")
+	testSweepDB(t, pool, "5678", "")
+
+	// slow enough that it is stopped waiting for the second DB
+	cursorFile := filepath.Join(dir, "sweeper.cursor")
+	s, err := NewSweeper(pool, SweeperConfig{Rate: 0.1, CursorFile: cursorFile})
+	if !assert.NoError(err) {
+		return
+	}
+
+	s.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		assert.Fail("Timed out stopping the sweeper")
+		return
+	}
+
+	cursor, err := ioutil.ReadFile(cursorFile)
+	assert.NoError(err)
+	assert.Equal("43/21/1234.db\n", string(cursor))
+
+	memPool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	defer memPool.StopHTTP()
+	_, err = NewSweeper(memPool, SweeperConfig{})
+	assert.Error(err)
+}
+
+func TestSweeperReservesUser(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := newHandlerPool(":memory:", 10, nil, nil)
+	uid := uniqueUID()
+
+	assert.True(pool.reserve(uid))
+	assert.False(pool.reserve(uid))
+
+	_, _, err := pool.getElement(uid)
+	assert.Equal(errElementStopped, err)
+
+	pool.release(uid)
+	_, _, err = pool.getElement(uid)
+	assert.NoError(err)
+
+	// users in the pool can not be reserved
+	assert.False(pool.reserve(uid))
+}
+
+// testBlockingPurgeDB waits for proceed to be closed before its
+// first purge so requests can arrive during a sweep
+type testBlockingPurgeDB struct {
+	*syncstorage.DB
+	once    *sync.Once
+	purging chan struct{}
+	proceed chan struct{}
+}
+
+func (d *testBlockingPurgeDB) PurgeExpired() (int, error) {
+	d.once.Do(func() {
+		close(d.purging)
+		<-d.proceed
+	})
+	return d.DB.PurgeExpired()
+}
+
+func TestSweeperYieldsToRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	once := &sync.Once{}
+	purging := make(chan struct{})
+	proceed := make(chan struct{})
+
+	config := testSyncPoolConfig()
+	config.Basepath = dir
+	config.OpenStorage = func(path string, conf *syncstorage.Config) (syncstorage.Storage, error) {
+		db, err := syncstorage.NewDB(path, conf)
+		if err != nil {
+			return nil, err
+		}
+		return &testBlockingPurgeDB{DB: db, once: once, purging: purging, proceed: proceed}, nil
+	}
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	// enough expired data that the sweep wants to vacuum
+	uid := "1234"
+	path := testSweepDB(t, pool, uid, time.Now().Add(-time.Hour).Format(time.RFC3339Nano))
+	db, err := syncstorage.NewDB(path, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = db.PutBSO(4, "big", syncstorage.String(strings.Repeat("x", 256*1024)), nil, syncstorage.Int(1))
+	db.Close()
+	if !assert.NoError(err) {
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	type sweepResult struct {
+		result string
+		ioKB   int
+		err    error
+	}
+	swept := make(chan sweepResult)
+	go func() {
+		result, ioKB, err := pool.sweepUser(uid, SweeperConfig{VacuumKB: 1})
+		swept <- sweepResult{result, ioKB, err}
+	}()
+	<-purging
+
+	// the user comes back during the sweep
+	served := make(chan int)
+	go func() {
+		served <- request("GET", syncurl(uid, "info/collections"), nil, pool).Code
+	}()
+
+	p := pool.pools[pool.poolIndex(uid)]
+	for !p.wanted(uid) {
+		time.Sleep(time.Millisecond)
+	}
+	close(proceed)
+
+	r := <-swept
+	if assert.NoError(r.err) {
+		assert.Equal("swept", r.result)
+		assert.Equal(0, r.ioKB, "Expected the vacuum to be skipped")
+	}
+
+	assert.Equal(http.StatusOK, <-served)
+}
+
+type testUserCache struct {
+	cleared []string
+}
+
+func (c *testUserCache) ClearUser(uid string) { c.cleared = append(c.cleared, uid) }
+
+func TestSweeperRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "sweeper")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := testSyncPoolConfig()
+	config.Basepath = filepath.Join(dir, "data")
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	cache := &testUserCache{}
+	pool.Cache = cache
+
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	makeDB := func(uid string, write bool, mtime time.Time) string {
+		dir, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+		assert.NoError(os.MkdirAll(dir, 0755))
+
+		path := filepath.Join(dir, file)
+		db, err := syncstorage.NewDB(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if write {
+			_, err = db.PutBSO(4, "b0", syncstorage.String("hi"), nil, nil)
+			assert.NoError(err)
+		}
+		db.Close()
+
+		assert.NoError(os.Chtimes(path, mtime, mtime))
+		return path
+	}
+
+	inactive := makeDB("1234", false, old)
+	recentWrite := makeDB("5678", true, old)
+	recentFile := makeDB("9012", false, time.Now())
+
+	archiveDir := filepath.Join(dir, "archive")
+	sweeperConfig := SweeperConfig{
+		Rate:         1000,
+		RetainFor:    30 * 24 * time.Hour,
+		RetainDryRun: true,
+		ArchiveDir:   archiveDir,
+	}
+
+	s, err := NewSweeper(pool, sweeperConfig)
+	if !assert.NoError(err) || !assert.NoError(s.pass()) {
+		return
+	}
+
+	// a dry run only reports, and sweeping is not activity
+	info, err := os.Stat(inactive)
+	if assert.NoError(err) {
+		assert.True(info.ModTime().Before(time.Now().Add(-sweeperConfig.RetainFor)))
+	}
+	_, err = os.Stat(archiveDir)
+	assert.True(os.IsNotExist(err))
+
+	sweeperConfig.RetainDryRun = false
+	s, err = NewSweeper(pool, sweeperConfig)
+	if !assert.NoError(err) || !assert.NoError(s.pass()) {
+		return
+	}
+
+	_, err = os.Stat(inactive)
+	assert.True(os.IsNotExist(err), "Expected the inactive user's DB to be removed")
+	assert.Equal([]string{"1234"}, cache.cleared)
+	_, err = os.Stat(recentWrite)
+	assert.NoError(err)
+	_, err = os.Stat(recentFile)
+	assert.NoError(err)
+
+	// the archived copy has everything up to when it was removed
+	archived := filepath.Join(archiveDir, "43", "21", "1234.db")
+	db, err := syncstorage.NewDB(archived, nil)
+	if assert.NoError(err) {
+		next, _ := db.GetKey("NEXT_PURGE")
+		assert.NotEqual("", next, "Expected the archive to have the first pass' NEXT_PURGE")
+		db.Close()
+	}
+
+	// archiving counts against the IO budget
+	makeDB("3456", false, old)
+	result, ioKB, err := pool.sweepUser("3456", sweeperConfig)
+	if assert.NoError(err) {
+		assert.Equal("deleted", result)
+		assert.True(ioKB > 0)
+	}
+
+	// the user starts over on their next request
+	element, _, err := pool.pools[pool.poolIndex("1234")].getElement("1234")
+	if assert.NoError(err) {
+		counts, err := element.handler.db.InfoCollectionCounts()
+		assert.NoError(err)
+		assert.Len(counts, 0)
+	}
+}
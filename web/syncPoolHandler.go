@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,6 +19,10 @@ const (
 )
 
 type SyncPoolHandler struct {
+	// 64 bit atomic counters must come first for alignment on 32 bit
+	requests  uint64
+	conflicts uint64
+
 	StoppableHandler
 
 	config *SyncPoolConfig
@@ -26,20 +31,40 @@ type SyncPoolHandler struct {
 	// contention for parallel requests
 	pools []*handlerPool
 
+	// purges and vacuums user DBs in the background
+	maintenance *maintenanceScheduler
+
 	userHandlerConfig *SyncUserHandlerConfig
+
+	// Load is sent how long requests wait for the pool and
+	// how long the user handlers take. Optional
+	Load LoadObserver
+
+	// Cache is cleared for users deleted outside of requests, by the
+	// admin API or the Sweeper. Optional
+	Cache UserCache
 }
 
 type SyncPoolConfig struct {
 	Basepath    string
 	NumPools    int
-	TTL         time.Duration
+	TTL         time.Duration // close user DBs idle this long, 0 keeps them open
 	MaxPoolSize int
 
 	VacuumKB      int
 	PurgeMinHours int
 	PurgeMaxHours int
 
+	// background maintenance (purge and vacuum) of user DBs
+	MaintenanceWorkers    int // jobs that can run at the same time
+	MaintenanceQueueSize  int // users waiting, more are dropped
+	MaintenanceIOBudgetKB int // KB of disk IO per second, 0 is unlimited
+
 	DBConfig *syncstorage.Config
+
+	// OpenStorage replaces the default sqlite3 storage engine
+	// when it is not nil
+	OpenStorage StorageOpener
 }
 
 func NewDefaultSyncPoolConfig(basepath string) *SyncPoolConfig {
@@ -52,6 +77,10 @@ func NewDefaultSyncPoolConfig(basepath string) *SyncPoolConfig {
 		PurgeMinHours: 24 * 7,
 		PurgeMaxHours: 24 * 7 * 2,
 		DBConfig:      &syncstorage.Config{CacheSize: 0},
+
+		MaintenanceWorkers:    1,
+		MaintenanceQueueSize:  1000,
+		MaintenanceIOBudgetKB: 0,
 	}
 }
 
@@ -68,6 +97,14 @@ func NewSyncPoolHandler(config *SyncPoolConfig, userHandlerConfig *SyncUserHandl
 			config.MaxPoolSize,
 			config.DBConfig,
 			userHandlerConfig)
+
+		if config.OpenStorage != nil {
+			pools[i].openStorage = config.OpenStorage
+		}
+
+		if config.TTL > 0 {
+			pools[i].startReaper(config.TTL)
+		}
 	}
 
 	server := &SyncPoolHandler{
@@ -76,6 +113,12 @@ func NewSyncPoolHandler(config *SyncPoolConfig, userHandlerConfig *SyncUserHandl
 		userHandlerConfig: userHandlerConfig,
 	}
 
+	server.maintenance = newMaintenanceScheduler(
+		config.MaintenanceWorkers,
+		config.MaintenanceQueueSize,
+		config.MaintenanceIOBudgetKB,
+		server.tidyUp)
+
 	return server
 }
 
@@ -111,6 +154,9 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	poolId := s.poolIndex(uid)
+	atomic.AddUint64(&s.requests, 1)
+
+	start := time.Now()
 
 	// if a request comes in while an element is being
 	// cleaned up/closing, we retry a few times before failing
@@ -118,6 +164,7 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		element, newElement, err = s.pools[poolId].getElement(uid)
 		if err != nil {
 			if err == errElementStopped {
+				metricPoolConflicts.Inc()
 
 				log.WithFields(log.Fields{
 					"uid":     uid,
@@ -125,6 +172,10 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				}).Info("pool.getElement conflict")
 
 				if i == conflictAttempts {
+					atomic.AddUint64(&s.conflicts, 1)
+					if s.Load != nil {
+						s.Load.ObservePoolWait(time.Since(start))
+					}
 					w.Header().Add("Retry-After", strconv.Itoa(60))
 					sendRequestProblem(w, req, http.StatusConflict,
 						errors.New("DB pool too busy"))
@@ -141,15 +192,33 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// pass it on
+	if s.Load == nil {
+		element.handler.ServeHTTP(w, req)
+	} else {
+		s.Load.ObservePoolWait(time.Since(start))
+		s.Load.ObserveDB(element.handler.serveTimed(w, req))
+	}
+
+	// schedule maintenance after the request so it does
+	// not wait for purges or vacuums
 	if newElement {
-		element.handler.TidyUp(
-			time.Duration(s.config.PurgeMinHours)*time.Hour,
-			time.Duration(s.config.PurgeMaxHours)*time.Hour,
-			s.config.VacuumKB)
+		s.maintenance.Enqueue(uid)
 	}
+}
 
-	// pass it on
-	element.handler.ServeHTTP(w, req)
+// tidyUp is the maintenanceJob for the pool. Users that are no
+// longer in the pool are skipped as they are tidied when reopened
+func (s *SyncPoolHandler) tidyUp(uid string) (busy bool, ioKB int, err error) {
+	element := s.pools[s.poolIndex(uid)].peekElement(uid)
+	if element == nil {
+		return false, 0, nil
+	}
+
+	return element.handler.TidyUpIdle(
+		time.Duration(s.config.PurgeMinHours)*time.Hour,
+		time.Duration(s.config.PurgeMaxHours)*time.Hour,
+		s.config.VacuumKB)
 }
 
 // Stop immediately stops serving web requests and then it
@@ -160,7 +229,47 @@ func (s *SyncPoolHandler) StopHTTP() {
 	}
 
 	s.StoppableHandler.StopHTTP()
+	s.maintenance.Stop()
 	for _, p := range s.pools {
+		p.stopReaper()
 		p.stopHandlers()
 	}
 }
+
+// PoolStats are counters for monitoring the handler pools
+type PoolStats struct {
+	// user handlers with an open DB
+	Open int `json:"open"`
+
+	// closed after being idle longer than SyncPoolConfig.TTL
+	EvictedIdle uint64 `json:"evicted_idle"`
+
+	// closed to make room when a pool was full
+	EvictedLRU uint64 `json:"evicted_lru"`
+
+	// users waiting for background maintenance
+	MaintenanceQueued int `json:"maintenance_queued"`
+
+	// requests served and the ones that failed with a 409
+	// because their handler was stopping
+	Requests  uint64 `json:"requests"`
+	Conflicts uint64 `json:"conflicts"`
+}
+
+// Stats returns the totals for all pools
+func (s *SyncPoolHandler) Stats() PoolStats {
+	var stats PoolStats
+	for _, p := range s.pools {
+		p.Lock()
+		stats.Open += len(p.elements)
+		p.Unlock()
+
+		stats.EvictedIdle += atomic.LoadUint64(&p.evictedIdle)
+		stats.EvictedLRU += atomic.LoadUint64(&p.evictedLRU)
+	}
+
+	stats.MaintenanceQueued = s.maintenance.Len()
+	stats.Requests = atomic.LoadUint64(&s.requests)
+	stats.Conflicts = atomic.LoadUint64(&s.conflicts)
+	return stats
+}
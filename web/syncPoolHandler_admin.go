@@ -0,0 +1,242 @@
+package web
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUserNotFound = errors.New("User not found")
+	ErrUserBusy     = errors.New("User handler is busy, try again")
+	ErrPoolStopped  = errors.New("Pool is stopped")
+	ErrNotSupported = errors.New("Not supported by the storage engine")
+)
+
+// UserCache keeps data about users outside of their DB, like the
+// CacheHandler does
+type UserCache interface {
+	ClearUser(uid string)
+}
+
+// takeOut removes uid's element from the pool, when it is there, and
+// reserves uid in one go so a stopping handler is never handed out.
+// It returns false when uid is already reserved. Callers release uid
+// when they are done
+func (p *handlerPool) takeOut(uid string) (element *poolElement, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, reserved := p.reserved[uid]; reserved {
+		return nil, false
+	}
+
+	if element = p.elements[uid]; element != nil {
+		p.removeElement(element)
+	}
+
+	p.reserved[uid] = false
+	return element, true
+}
+
+// exists checks if uid has a DB open in the pool or on disk
+func (p *handlerPool) exists(uid string) bool {
+	if p.peekElement(uid) != nil {
+		return true
+	}
+
+	if p.inMemory() {
+		return false
+	}
+
+	dir, file := p.PathAndFile(uid)
+	_, err := os.Stat(filepath.Join(dir, file))
+	return err == nil
+}
+
+func (p *handlerPool) inMemory() bool {
+	return len(p.base) == 1 && p.base[0] == ":memory:"
+}
+
+// withUser runs fn with uid's handler, opening the DB if it is not in
+// the pool. Users without a DB get ErrUserNotFound, one is not created
+func (s *SyncPoolHandler) withUser(uid string, fn func(*SyncUserHandler) error) error {
+	if s.IsStopped() {
+		return ErrPoolStopped
+	}
+
+	pool := s.pools[s.poolIndex(uid)]
+	if !pool.exists(uid) {
+		return ErrUserNotFound
+	}
+
+	// like ServeHTTP, retry when the handler is being closed
+	for i := 1; ; i++ {
+		element, _, err := pool.getElement(uid)
+		if err == nil {
+			err = fn(element.handler)
+		}
+
+		if err != errElementStopped {
+			return err
+		}
+
+		if i == conflictAttempts {
+			return ErrUserBusy
+		}
+
+		time.Sleep(conflictSleep)
+	}
+}
+
+// UserInfo returns uid's collections, counts and usage
+func (s *SyncPoolHandler) UserInfo(uid string) (info *UserInfo, err error) {
+	err = s.withUser(uid, func(h *SyncUserHandler) (err error) {
+		info, err = h.Info()
+		return
+	})
+	return
+}
+
+// TidyUpUser purges uid's expired BSOs and batches now. The DB is
+// vacuumed when it has more than the pool's VacuumKB free
+func (s *SyncPoolHandler) TidyUpUser(uid string) (took time.Duration, err error) {
+	err = s.withUser(uid, func(h *SyncUserHandler) (err error) {
+		took, err = h.ForceTidyUp(
+			time.Duration(s.config.PurgeMinHours)*time.Hour,
+			time.Duration(s.config.PurgeMaxHours)*time.Hour,
+			s.config.VacuumKB)
+		return
+	})
+	return
+}
+
+// VacuumUser vacuums uid's DB no matter how much of it is free
+func (s *SyncPoolHandler) VacuumUser(uid string) (beforeKB, afterKB int, err error) {
+	err = s.withUser(uid, func(h *SyncUserHandler) (err error) {
+		beforeKB, afterKB, err = h.Vacuum()
+		return
+	})
+	return
+}
+
+// UserBatches lists uid's uncommitted batches
+func (s *SyncPoolHandler) UserBatches(uid string) (batches []syncstorage.BatchInfo, err error) {
+	err = s.withUser(uid, func(h *SyncUserHandler) (err error) {
+		batches, err = h.Batches()
+		return
+	})
+	return
+}
+
+// EvictUser closes uid's DB and takes it out of the pool. It is opened
+// again on the user's next request. It returns false if uid was not in
+// the pool
+func (s *SyncPoolHandler) EvictUser(uid string) bool {
+	pool := s.pools[s.poolIndex(uid)]
+
+	element, ok := pool.takeOut(uid)
+	if !ok {
+		return false
+	}
+	defer pool.release(uid)
+
+	if element == nil {
+		return false
+	}
+
+	element.handler.StopHTTP()
+	metricPoolEvictions.Inc("admin")
+	return true
+}
+
+// DeleteUser deletes all of uid's data, closes their DB and removes
+// its files. uid is reserved until the files are gone so a request can
+// not open the DB again in between. A request after this starts the
+// user with an empty DB
+func (s *SyncPoolHandler) DeleteUser(uid string) error {
+	if s.IsStopped() {
+		return ErrPoolStopped
+	}
+
+	pool := s.pools[s.poolIndex(uid)]
+	if !pool.exists(uid) {
+		return ErrUserNotFound
+	}
+
+	// retry while something else, like the Sweeper, has it reserved
+	var element *poolElement
+	for i := 1; ; i++ {
+		var ok bool
+		if element, ok = pool.takeOut(uid); ok {
+			break
+		}
+
+		if i == conflictAttempts {
+			return ErrUserBusy
+		}
+
+		time.Sleep(conflictSleep)
+	}
+	defer pool.release(uid)
+
+	var handler *SyncUserHandler
+	if element != nil {
+		handler = element.handler
+		metricPoolEvictions.Inc("admin")
+	} else if pool.inMemory() {
+		// it was closed since exists() and took its data with it
+		s.clearCache(uid)
+		return nil
+	} else {
+		dir, file := pool.PathAndFile(uid)
+		db, err := pool.openStorage(filepath.Join(dir, file), pool.dbConfig)
+		if err != nil {
+			return errors.Wrap(err, "Could not open DB")
+		}
+		handler = NewSyncUserHandler(uid, db, pool.userHandlerConfig)
+	}
+
+	return s.removeUser(pool, uid, handler)
+}
+
+// removeUser is how users are deleted outside of requests, by the admin
+// API and the Sweeper. It deletes their data, closes handler, clears the
+// Cache and removes the DB files. The caller has uid reserved
+func (s *SyncPoolHandler) removeUser(pool *handlerPool, uid string, handler *SyncUserHandler) error {
+	// waits for requests in flight
+	err := handler.DeleteEverything()
+	handler.StopHTTP()
+	if err != nil {
+		return errors.Wrap(err, "Could not delete user")
+	}
+
+	s.clearCache(uid)
+
+	if pool.inMemory() {
+		return nil
+	}
+
+	dir, file := pool.PathAndFile(uid)
+	return removeDBFiles(filepath.Join(dir, file))
+}
+
+func (s *SyncPoolHandler) clearCache(uid string) {
+	if s.Cache != nil {
+		s.Cache.ClearUser(uid)
+	}
+}
+
+// removeDBFiles removes a DB and its write-ahead log files
+func removeDBFiles(dbFile string) error {
+	for _, f := range []string{dbFile, dbFile + "-wal", dbFile + "-shm"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Could not remove DB file")
+		}
+	}
+
+	return nil
+}
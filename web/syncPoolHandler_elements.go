@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -22,12 +23,25 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+// StorageOpener opens the storage for a user. path is where the
+// user's data should be kept
+type StorageOpener func(path string, conf *syncstorage.Config) (syncstorage.Storage, error)
+
+// OpenDB is the default StorageOpener. Each user gets their own
+// sqlite3 database
+func OpenDB(path string, conf *syncstorage.Config) (syncstorage.Storage, error) {
+	return syncstorage.NewDB(path, conf)
+}
+
 type elementState uint8
 type poolElement struct {
 	sync.Mutex
 
 	uid     string
 	handler *SyncUserHandler
+
+	// when getElement last returned it, protected by the pool's lock
+	lastUsed time.Time
 }
 
 // handlerPool has a big job. It opens DBs on demand and
@@ -49,6 +63,23 @@ type handlerPool struct {
 	// Configurations
 	dbConfig          *syncstorage.Config
 	userHandlerConfig *SyncUserHandlerConfig
+
+	// opens the storage for a user
+	openStorage StorageOpener
+
+	// closes idle elements in the background
+	reaperStop chan struct{}
+	reaperDone chan struct{}
+
+	// eviction counters, use sync/atomic
+	evictedIdle uint64
+	evictedLRU  uint64
+
+	// uids whose DB is opened outside of the pool, by the Sweeper, or
+	// is being closed after it was taken out of the pool. They are
+	// treated like stopped elements until released. The value is true
+	// once a request has asked for the uid
+	reserved map[string]bool
 }
 
 func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Config, userHandlerConfig *SyncUserHandlerConfig) *handlerPool {
@@ -81,29 +112,129 @@ func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Conf
 		maxPoolSize:       maxPoolSize,
 		dbConfig:          dbConfig,
 		userHandlerConfig: userHandlerConfig,
+		openStorage:       OpenDB,
+		reserved:          make(map[string]bool),
 	}
 
 	return pool
 }
 
-func (p *handlerPool) cleanupHandlers(maxClean int) {
+// cleanupHandlers stops and removes up to maxClean of the least
+// recently used elements. It returns how many were removed
+func (p *handlerPool) cleanupHandlers(maxClean int) int {
 	numCleaned := 0
-	lruElement := p.lru.Back()
-	for lruElement != nil && numCleaned < maxClean {
+	for numCleaned < maxClean {
+		// like reapIdle, take it out of the pool before stopping it so
+		// getElement can not hand out a stopped handler
+		p.Lock()
+		lruElement := p.lru.Back()
+		if lruElement == nil {
+			p.Unlock()
+			break
+		}
+
 		element := lruElement.Value.(*poolElement)
+		p.removeElement(element)
+		p.reserved[element.uid] = false
+		p.Unlock()
 
 		element.handler.StopHTTP()
-		next := lruElement.Prev()
+		p.release(element.uid)
 
-		p.Lock()
-		p.lru.Remove(lruElement)
-		delete(p.lrumap, element.uid)
-		delete(p.elements, element.uid)
-		p.Unlock()
-
-		lruElement = next
 		numCleaned++
 	}
+
+	return numCleaned
+}
+
+// removeElement takes an element out of the pool. The caller must
+// hold the pool's lock
+func (p *handlerPool) removeElement(element *poolElement) {
+	if p.elements[element.uid] != element {
+		return
+	}
+
+	p.lru.Remove(p.lrumap[element.uid])
+	delete(p.lrumap, element.uid)
+	delete(p.elements, element.uid)
+	metricPoolOpen.Add(-1)
+}
+
+// reapIdle stops and removes elements that have not been used for
+// longer than ttl. It returns how many were removed
+func (p *handlerPool) reapIdle(ttl time.Duration) int {
+	cutoff := time.Now().Add(-ttl)
+
+	// the lru is ordered by lastUsed so stop at the first recent one.
+	// Idle elements are taken out of the pool and reserved before the
+	// lock is released so getElement can not hand them out while they
+	// are being stopped
+	var idle []*poolElement
+	p.Lock()
+	for e := p.lru.Back(); e != nil; {
+		element := e.Value.(*poolElement)
+		if element.lastUsed.After(cutoff) {
+			break
+		}
+		e = e.Prev()
+
+		p.removeElement(element)
+		p.reserved[element.uid] = false
+		idle = append(idle, element)
+	}
+	p.Unlock()
+
+	// stopping waits for in flight requests and closes the DB. Requests
+	// for a reserved uid are retried by SyncPoolHandler
+	for _, element := range idle {
+		element.handler.StopHTTP()
+		p.release(element.uid)
+	}
+
+	if len(idle) > 0 {
+		atomic.AddUint64(&p.evictedIdle, uint64(len(idle)))
+		metricPoolEvictions.Add(float64(len(idle)), "idle")
+
+		log.WithFields(log.Fields{
+			"num": len(idle),
+			"ttl": ttl.Seconds(),
+		}).Info("handlerPool reaped idle handlers")
+	}
+
+	return len(idle)
+}
+
+// startReaper runs reapIdle in the background until stopReaper is called
+func (p *handlerPool) startReaper(ttl time.Duration) {
+	p.reaperStop = make(chan struct{})
+	p.reaperDone = make(chan struct{})
+
+	go func() {
+		defer close(p.reaperDone)
+
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.reapIdle(ttl)
+			case <-p.reaperStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopReaper stops the background reaper and waits for it to exit
+func (p *handlerPool) stopReaper() {
+	if p.reaperStop == nil {
+		return
+	}
+
+	close(p.reaperStop)
+	<-p.reaperDone
+	p.reaperStop = nil
 }
 
 // stopHandlers stops all handlers from servicing HTTP requests
@@ -126,6 +257,11 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 	elementCreated := false
 
 	if element, ok = p.elements[uid]; !ok {
+		if _, reserved := p.reserved[uid]; reserved {
+			p.reserved[uid] = true
+			return nil, false, errElementStopped
+		}
+
 		if len(p.base) == 1 && p.base[0] == ":memory:" {
 			dbFile = ":memory:"
 		} else {
@@ -146,11 +282,13 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 			// nasty, kinda low level locking. Since p.cleanuphandlers also
 			// locks, unlock/lock here to avoid deadlocks
 			p.Unlock()
-			p.cleanupHandlers(1 + p.maxPoolSize/10) // clean up ~10%
+			cleaned := p.cleanupHandlers(1 + p.maxPoolSize/10) // clean up ~10%
+			atomic.AddUint64(&p.evictedLRU, uint64(cleaned))
+			metricPoolEvictions.Add(float64(cleaned), "lru")
 			p.Lock()
 		}
 
-		db, err := syncstorage.NewDB(dbFile, p.dbConfig)
+		db, err := p.openStorage(dbFile, p.dbConfig)
 		if err != nil {
 			return nil, false, errors.Wrap(err, "Could not create DB")
 		}
@@ -161,6 +299,7 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 		}
 
 		elementCreated = true
+		metricPoolOpen.Add(1)
 
 		p.elements[uid] = element
 
@@ -174,9 +313,50 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 		p.lru.MoveToFront(p.lrumap[uid])
 	}
 
+	element.lastUsed = time.Now()
 	return element, elementCreated, nil
 }
 
+// peekElement returns the element for uid if it is in the pool. Unlike
+// getElement it does not open a DB or count as using the element
+func (p *handlerPool) peekElement(uid string) *poolElement {
+	p.Lock()
+	defer p.Unlock()
+	return p.elements[uid]
+}
+
+// reserve keeps uid out of the pool while its DB is used elsewhere.
+// It returns false if uid is in the pool or already reserved
+func (p *handlerPool) reserve(uid string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.elements[uid]; ok {
+		return false
+	}
+
+	if _, ok := p.reserved[uid]; ok {
+		return false
+	}
+
+	p.reserved[uid] = false
+	return true
+}
+
+// wanted returns true when a request is waiting for the reserved uid
+func (p *handlerPool) wanted(uid string) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.reserved[uid]
+}
+
+// release lets uid be opened by the pool again
+func (p *handlerPool) release(uid string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.reserved, uid)
+}
+
 func (p *handlerPool) PathAndFile(uid string) (path string, file string) {
 	path = string(os.PathSeparator) +
 		filepath.Join(
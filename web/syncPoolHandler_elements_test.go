@@ -121,3 +121,131 @@ func TestHandlerPoolGetElementParallel(t *testing.T) {
 	}
 
 }
+
+func TestHandlerPoolReapIdle(t *testing.T) {
+	assert := assert.New(t)
+	pool := newHandlerPool(":memory:", 10, nil, nil)
+
+	idle, _, err := pool.getElement("idle")
+	if !assert.NoError(err) {
+		return
+	}
+	busy, _, err := pool.getElement("busy")
+	if !assert.NoError(err) {
+		return
+	}
+
+	pool.Lock()
+	idle.lastUsed = time.Now().Add(-time.Hour)
+	pool.Unlock()
+
+	assert.Equal(1, pool.reapIdle(time.Minute))
+	assert.True(idle.handler.IsStopped())
+	assert.False(busy.handler.IsStopped())
+
+	assert.Equal(1, pool.lru.Len())
+	assert.NotContains(pool.elements, "idle")
+	assert.Contains(pool.elements, "busy")
+	assert.Equal(uint64(1), pool.evictedIdle)
+
+	// a new request reopens it
+	el, created, err := pool.getElement("idle")
+	if assert.NoError(err) {
+		assert.True(created)
+		assert.False(el.handler.IsStopped())
+	}
+}
+
+func TestHandlerPoolReapIdleNotHandedOut(t *testing.T) {
+	assert := assert.New(t)
+	pool := newHandlerPool(":memory:", 10, nil, nil)
+
+	idle, _, err := pool.getElement("idle")
+	if !assert.NoError(err) {
+		return
+	}
+
+	pool.Lock()
+	idle.lastUsed = time.Now().Add(-time.Hour)
+	pool.Unlock()
+
+	// a request still in flight keeps StopHTTP waiting
+	idle.handler.requestLock.RLock()
+
+	reaped := make(chan int)
+	go func() { reaped <- pool.reapIdle(time.Minute) }()
+
+	// the element being stopped is never handed out
+	for i := 0; i < 100; i++ {
+		if pool.peekElement("idle") == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, _, err = pool.getElement("idle")
+	assert.Equal(errElementStopped, err)
+
+	idle.handler.requestLock.RUnlock()
+	assert.Equal(1, <-reaped)
+
+	el, created, err := pool.getElement("idle")
+	if assert.NoError(err) {
+		assert.True(created)
+		assert.NotEqual(idle, el)
+	}
+}
+
+func TestHandlerPoolCleanupNotHandedOut(t *testing.T) {
+	assert := assert.New(t)
+	pool := newHandlerPool(":memory:", 10, nil, nil)
+
+	oldest, _, err := pool.getElement("oldest")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// a request still in flight keeps StopHTTP waiting
+	oldest.handler.requestLock.RLock()
+
+	cleaned := make(chan int)
+	go func() { cleaned <- pool.cleanupHandlers(1) }()
+
+	// the element being stopped is never handed out
+	for i := 0; i < 100; i++ {
+		if pool.peekElement("oldest") == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, _, err = pool.getElement("oldest")
+	assert.Equal(errElementStopped, err)
+
+	oldest.handler.requestLock.RUnlock()
+	assert.Equal(1, <-cleaned)
+
+	_, created, err := pool.getElement("oldest")
+	if assert.NoError(err) {
+		assert.True(created)
+	}
+}
+
+func TestHandlerPoolReaper(t *testing.T) {
+	assert := assert.New(t)
+	pool := newHandlerPool(":memory:", 10, nil, nil)
+
+	el, _, err := pool.getElement("1")
+	if !assert.NoError(err) {
+		return
+	}
+
+	pool.startReaper(20 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	pool.stopReaper()
+
+	assert.True(el.handler.IsStopped())
+	assert.Equal(0, pool.lru.Len())
+	assert.Equal(uint64(1), pool.evictedIdle)
+
+	// stopping twice is safe
+	pool.stopReaper()
+}
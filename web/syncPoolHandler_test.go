@@ -1,9 +1,12 @@
 package web
 
 import (
+	"bytes"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,6 +45,10 @@ func TestSyncPoolHandlerStatusConflict(t *testing.T) {
 
 	retryAfter := resp.Header().Get("Retry-After")
 	assert.NotEqual("", retryAfter)
+
+	stats := handler.Stats()
+	assert.Equal(uint64(1), stats.Requests)
+	assert.Equal(uint64(1), stats.Conflicts)
 }
 
 func TestSyncPoolHandlerStop(t *testing.T) {
@@ -145,3 +152,59 @@ func TestSyncPoolPassesConfigToUserHandler(t *testing.T) {
 	assert.Equal(el.handler.config.MaxBatchTTL, 6)
 	assert.Equal(el.handler.config.MaxRecordPayloadBytes, 7)
 }
+
+func TestSyncPoolOpenStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	opened := 0
+	config := testSyncPoolConfig()
+	config.OpenStorage = func(path string, conf *syncstorage.Config) (syncstorage.Storage, error) {
+		opened++
+		return syncstorage.NewMemStore(conf), nil
+	}
+
+	handler := NewSyncPoolHandler(config, nil)
+	uid := uniqueUID()
+
+	body := bytes.NewBufferString(`{"payload":"hi"}`)
+	resp := jsonrequest("PUT", syncurl(uid, "storage/col/b0"), body, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/col/b0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Contains(resp.Body.String(), `"payload":"hi"`)
+	assert.Equal(1, opened)
+}
+
+func TestSyncPoolStats(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 1
+	config.TTL = 0
+	handler := NewSyncPoolHandler(config, nil)
+
+	for _, uid := range []string{"1", "2", "3"} {
+		resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	stats := handler.Stats()
+	assert.Equal(2, stats.Open)
+	assert.Equal(uint64(1), stats.EvictedLRU)
+	assert.Equal(uint64(0), stats.EvictedIdle)
+
+	pool := handler.pools[0]
+	pool.Lock()
+	for _, el := range pool.elements {
+		el.lastUsed = time.Now().Add(-time.Hour)
+	}
+	pool.Unlock()
+	pool.reapIdle(time.Minute)
+
+	stats = handler.Stats()
+	assert.Equal(0, stats.Open)
+	assert.Equal(uint64(2), stats.EvictedIdle)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -51,23 +53,25 @@ func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
 // to make it easy to wrap it in other http.Handler.
 type SyncUserHandler struct {
 	StoppableHandler
-	requestLock sync.Mutex
+
+	// reads share the lock, changes and maintenance are exclusive
+	requestLock sync.RWMutex
+
+	// requests waiting for or holding requestLock, use sync/atomic
+	inFlight int32
 
 	router *mux.Router
 	uid    string
-	db     *syncstorage.DB
-
-	// Sync 1.5 tracks changes based on timestamps.
-	// The X-Last-Modified has an accuracy of 10's of milliseconds.
-	// Changes (POST, PUT, DELETE) require a unique timestamp so the handler
-	// must sleep for a bit to ensure all timestamps are unique. Also all changes
-	// need to be synchronized
-	lastChange time.Time
+	db     syncstorage.Storage
 
 	config *SyncUserHandlerConfig
+
+	// yield, when set, is asked before vacuuming. It returns true when
+	// a request is waiting for the DB so the vacuum is left for later
+	yield func() bool
 }
 
-func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerConfig) *SyncUserHandler {
+func NewSyncUserHandler(uid string, db syncstorage.Storage, config *SyncUserHandlerConfig) *SyncUserHandler {
 
 	// https://docs.services.mozilla.com/storage/apis-1.5.html
 	r := mux.NewRouter()
@@ -114,6 +118,36 @@ func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerC
 // potentially be a long operation as the database vacuumed needs to rewrite
 // the entire database file
 func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int) (skipped bool, took time.Duration, err error) {
+	skipped, took, _, err = s.tidyUp(minPurge, maxPurge, vacuumKB)
+	return
+}
+
+// TidyUpIdle runs TidyUp only when the handler is not serving any requests.
+// Requests that arrive while it is running wait for it to finish. busy is
+// true when it was skipped. ioKB is roughly how much disk IO it used
+func (s *SyncUserHandler) TidyUpIdle(minPurge, maxPurge time.Duration, vacuumKB int) (busy bool, ioKB int, err error) {
+	if s.InFlight() > 0 {
+		return true, 0, nil
+	}
+
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	// the DB is closed when stopped
+	if s.IsStopped() {
+		return false, 0, nil
+	}
+
+	_, _, ioKB, err = s.tidyUp(minPurge, maxPurge, vacuumKB)
+	return false, ioKB, err
+}
+
+// InFlight returns the number of requests being handled
+func (s *SyncUserHandler) InFlight() int {
+	return int(atomic.LoadInt32(&s.inFlight))
+}
+
+func (s *SyncUserHandler) tidyUp(minPurge, maxPurge time.Duration, vacuumKB int) (skipped bool, took time.Duration, ioKB int, err error) {
 	// Purge Expired BSOs
 	start := time.Now()
 
@@ -123,7 +157,7 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 			"uid": s.uid,
 			"err": err.Error(),
 		}).Error("SyncUserHandler - Error Fetching next purge time")
-		return true, time.Since(start), err
+		return true, time.Since(start), 0, err
 	}
 
 	if nextStr != "" {
@@ -136,27 +170,33 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 
 			// try to fix it for next time
 			s.db.SetKey("NEXT_PURGE", time.Now().Format(time.RFC3339Nano))
-			return true, time.Since(start), nil
+			return true, time.Since(start), 0, nil
 		}
 
 		if time.Now().Before(nextPurge) {
-			return true, took, nil
+			return true, took, 0, nil
 		}
 	} else {
 		// never been purged, skip it and set it to the maxpurge time in the future
 		nextPurge := time.Now().Add(maxPurge)
 		err = s.db.SetKey("NEXT_PURGE", nextPurge.Format(time.RFC3339Nano))
-		return true, time.Since(start), err
+		return true, time.Since(start), 0, err
 	}
 
 	logFields := log.Fields{
 		"uid": s.uid,
-		"db":  path.Base(s.db.Path),
+	}
+
+	if db, ok := s.db.(*syncstorage.DB); ok {
+		logFields["db"] = path.Base(db.Path)
 	}
 
 	var freeKB int
 	var usage *syncstorage.DBPageStats
 
+	// not all storage engines need vacuuming
+	vacuumer, canVacuum := s.db.(syncstorage.Vacuumer)
+
 	{ // purge bsos and batches
 		purgeStart := time.Now()
 		numBSOPurged, err := s.db.PurgeExpired()
@@ -165,7 +205,7 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 				"uid": s.uid,
 				"err": err.Error(),
 			}).Error("SyncUserHandler - Error purging expired BSOs")
-			return true, time.Since(start), err
+			return true, time.Since(start), 0, err
 		}
 
 		numBatchesPurged, err := s.db.BatchPurge(s.config.MaxBatchTTL)
@@ -174,43 +214,51 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 				"uid": s.uid,
 				"err": err.Error(),
 			}).Error("SyncUserHandler - Error purging expired Batches")
-			return true, time.Since(start), err
-		}
-
-		usage, err = s.db.Usage()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"uid": s.uid,
-				"err": err.Error(),
-			}).Error("SyncUserHandler - Error retrieving usage")
-			return true, time.Since(start), err
+			return true, time.Since(start), 0, err
 		}
 
 		logFields["purge_bso"] = numBSOPurged
 		logFields["purge_batch"] = numBatchesPurged
 		logFields["purge_t"] = time.Since(purgeStart).Nanoseconds() / 1000 / 1000
-		freeKB = (usage.Free * usage.Size / 1024)
-		logFields["free_pages_kb"] = freeKB
+		metricMaintenanceDuration.Since(purgeStart, "purge")
+		metricPurged.Add(float64(numBSOPurged), "bso")
+		metricPurged.Add(float64(numBatchesPurged), "batch")
+
+		if canVacuum {
+			usage, err = vacuumer.Usage()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"uid": s.uid,
+					"err": err.Error(),
+				}).Error("SyncUserHandler - Error retrieving usage")
+				return true, time.Since(start), 0, err
+			}
+
+			freeKB = (usage.Free * usage.Size / 1024)
+			logFields["free_pages_kb"] = freeKB
+		}
 	}
 
 	{ // vacuum the db if there are too many free blocks
 		vacStart := time.Now()
-		if vacuumKB > 0 && freeKB >= vacuumKB {
-			if err = s.db.Vacuum(); err != nil {
+		if canVacuum && vacuumKB > 0 && freeKB >= vacuumKB && s.yield != nil && s.yield() {
+			logFields["vac"] = "yielded"
+		} else if canVacuum && vacuumKB > 0 && freeKB >= vacuumKB {
+			if err = vacuumer.Vacuum(); err != nil {
 				log.WithFields(log.Fields{
 					"uid": s.uid,
 					"err": err.Error(),
 				}).Error("SyncUserHandler - Error Vacuuming DB")
-				return true, time.Since(start), err
+				return true, time.Since(start), 0, err
 			}
 
-			after, err := s.db.Usage()
+			after, err := vacuumer.Usage()
 			if err != nil {
 				log.WithFields(log.Fields{
 					"uid": s.uid,
 					"err": err.Error(),
 				}).Error("SyncUserHandler - Error retrieving usage after vacuum")
-				return true, time.Since(start), err
+				return true, time.Since(start), 0, err
 			}
 
 			vacBeforeKB := usage.Total * usage.Size / 1024
@@ -221,6 +269,13 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 			logFields["vac_after_kb"] = vacAfterKB
 			logFields["vac_delta_kb"] = vacBeforeKB - vacAfterKB
 			logFields["vac_t"] = time.Since(vacStart).Nanoseconds() / 1000 / 1000
+			metricMaintenanceDuration.Since(vacStart, "vacuum")
+			if vacBeforeKB > vacAfterKB {
+				metricVacuumFreed.Add(float64(vacBeforeKB - vacAfterKB))
+			}
+
+			// vacuum reads the whole database and writes a new copy
+			ioKB = vacBeforeKB + vacAfterKB
 		}
 	}
 
@@ -242,7 +297,7 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 				"uid": s.uid,
 				"err": err.Error(),
 			}).Error("SyncUserHandler - Error Setting Next Purge Key")
-			return true, time.Since(start), err
+			return true, time.Since(start), 0, err
 		}
 	}
 
@@ -253,44 +308,64 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 }
 
 func (s *SyncUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.requestLock.Lock()
-	defer s.requestLock.Unlock()
+	s.serveTimed(w, req)
+}
+
+// serveTimed serves req and returns how long it took once the user's
+// lock was held and the request body was read. Waiting for other
+// requests and slow clients are left out so it is mostly DB time
+func (s *SyncUserHandler) serveTimed(w http.ResponseWriter, req *http.Request) time.Duration {
+	atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	switch req.Method {
+	case "GET", "HEAD":
+		s.requestLock.RLock()
+		defer s.requestLock.RUnlock()
+	default:
+		s.requestLock.Lock()
+		defer s.requestLock.Unlock()
+	}
 
 	if s.IsStopped() {
 		s.StoppableHandler.ServeHTTP(w, req)
-		return
+		return 0
 	}
 
-	switch req.Method {
-	case "POST", "PUT", "DELETE":
-		// make sure all X-Last-Modified values are unique we sleep for a bit
-		var toSleep time.Duration
-
-		if s.lastChange.IsZero() {
-			// edge case race where db is closed by cleanup and
-			// reopened (new request) < 10ms later results in the same
-			// modified timestmap. Sleep just to be safe for all new changes
-			toSleep = 10 * time.Millisecond
-		} else {
-			toSleep = 11*time.Millisecond - time.Now().Sub(s.lastChange)
-		}
+	if req.Body != nil && (req.Method == "POST" || req.Method == "PUT") {
+		req.Body = readBody(req.Body)
+	}
 
-		if toSleep > 0 {
-			if log.GetLevel() == log.DebugLevel {
-				log.WithFields(log.Fields{
-					"t_ms":   toSleep,
-					"uid":    s.uid,
-					"method": req.Method,
-					"p":      req.RequestURI,
-				}).Debug("write-delay")
-			}
-			time.Sleep(toSleep)
-		}
-		s.router.ServeHTTP(w, req)
-		s.lastChange = time.Now()
-	default:
-		s.router.ServeHTTP(w, req)
+	// Sync 1.5 tracks changes based on timestamps. The storage
+	// makes sure every change gets a unique X-Last-Modified
+	start := time.Now()
+	s.router.ServeHTTP(w, req)
+	return time.Since(start)
+}
+
+// bufferedBody is a request body that has already been read. The
+// error that stopped the read, like ErrRequestTooLarge, is returned
+// after the data so handlers see the same thing as reading it directly
+type bufferedBody struct {
+	*bytes.Reader
+	err error
+}
+
+func (b *bufferedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && b.err != nil {
+		err = b.err
 	}
+	return n, err
+}
+
+func (b *bufferedBody) Close() error { return nil }
+
+// readBody reads all of body and closes it
+func readBody(body io.ReadCloser) io.ReadCloser {
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	return &bufferedBody{Reader: bytes.NewReader(data), err: err}
 }
 
 // Stop immediately prevents handling web requests then purges
@@ -304,6 +379,16 @@ func (s *SyncUserHandler) StopHTTP() {
 	}
 
 	s.StoppableHandler.StopHTTP()
+
+	if c, ok := s.db.(syncstorage.Checkpointer); ok {
+		if err := c.Checkpoint(); err != nil {
+			log.WithFields(log.Fields{
+				"uid": s.uid,
+				"err": err.Error(),
+			}).Error("SyncUserHandler - Error checkpointing WAL")
+		}
+	}
+
 	s.db.Close()
 
 	if log.GetLevel() == log.DebugLevel {
@@ -336,11 +421,26 @@ func (s *SyncUserHandler) getcid(r *http.Request, automake bool) (cId int, err e
 	return
 }
 
-// hInfoQuota calculates the total disk space used by the user by calculating
-// it based on the number of DB pages used * size of each page.
-// TODO actually implement quotas in the system.
+// setQuotaRemaining adds the X-Weave-Quota-Remaining header, in KB, to
+// responses for writes. It is not sent when the user has no quota
+func (s *SyncUserHandler) setQuotaRemaining(w http.ResponseWriter) {
+	used, quota, err := s.db.InfoQuota()
+	if err != nil || quota <= 0 {
+		return
+	}
+
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	w.Header().Set("X-Weave-Quota-Remaining", fmt.Sprintf("%0.2f", float64(remaining)/1024))
+}
+
+// hInfoQuota returns the total payload bytes used by the user and their
+// quota, both in KB. The quota is null when the user has no limit
 func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
-	results, err := s.db.InfoCollectionUsage()
+	used, quota, err := s.db.InfoQuota()
 	if err != nil {
 		InternalError(w, r, err)
 		return
@@ -356,17 +456,16 @@ func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	used := 0
-	for _, bytes := range results {
-		used += bytes
-	}
-
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("X-Last-Modified", m)
 	w.Header().Set("Content-Type", "application/json")
 
 	// 8 decimals of precision cause python's test_quota functional test
-	w.Write([]byte(fmt.Sprintf("[%0.8f,null]", float64(used)/1024)))
+	if quota > 0 {
+		w.Write([]byte(fmt.Sprintf("[%0.8f,%0.8f]", float64(used)/1024, float64(quota)/1024)))
+	} else {
+		w.Write([]byte(fmt.Sprintf("[%0.8f,null]", float64(used)/1024)))
+	}
 }
 
 func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Request) {
@@ -695,7 +794,11 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 
 	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		if requestTooLarge(err) {
+			WeaveRequestTooLarge(w, r, errors.Wrap(err, "Failed reading POST body"))
+		} else {
+			WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		}
 		return
 	}
 
@@ -710,12 +813,17 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 	postResults, err := s.db.PostBSOs(collectionId, bsoToBeProcessed)
 
 	if err != nil {
-		InternalError(w, r, err)
+		if err == syncstorage.ErrOverQuota {
+			WeaveOverQuota(w, r, errors.Wrap(err, "POST rejected"))
+		} else {
+			InternalError(w, r, err)
+		}
 	} else {
 		for bsoId, failMessage := range postResults.Failed {
 			results.Failed[bsoId] = failMessage
 		}
 
+		s.setQuotaRemaining(w)
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(postResults.Modified))
 		JsonNewline(w, r, &PostResults{
 			Modified: postResults.Modified,
@@ -772,7 +880,11 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	// EXTRACT actual data to check
 	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		if requestTooLarge(err) {
+			WeaveRequestTooLarge(w, r, errors.Wrap(err, "Failed reading POST body"))
+		} else {
+			WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+		}
 		return
 	}
 
@@ -880,6 +992,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 		}
 
 		dbBatchId = newBatchId
+		metricBatches.Inc("create")
 	} else {
 		id, err := batchIdInt(batchId)
 		if err != nil {
@@ -892,7 +1005,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 				InternalError(w, r, errors.Wrap(err, fmt.Sprintf("Failed append to batch id:%d", dbBatchId)))
 				return
 			}
-
+			metricBatches.Inc("append")
 		}
 
 		dbBatchId = id
@@ -956,7 +1069,13 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 
 		postResults, err := s.db.PostBSOs(collectionId, postData)
 		if err != nil {
-			InternalError(w, r, err)
+			if err == syncstorage.ErrOverQuota {
+				// keep the batch so the client can commit it after freeing
+				// up space, BatchPurge expires it otherwise
+				WeaveOverQuota(w, r, errors.Wrapf(err, "Batch(%d) commit rejected", dbBatchId))
+			} else {
+				InternalError(w, r, err)
+			}
 			return
 		}
 
@@ -971,7 +1090,9 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 
 		// DELETE the batch from the DB
 		s.db.BatchRemove(dbBatchId)
+		metricBatches.Inc("commit")
 
+		s.setQuotaRemaining(w)
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(postResults.Modified))
 
 		JsonNewline(w, r, &PostResults{
@@ -1137,6 +1258,10 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		if requestTooLarge(err) {
+			WeaveRequestTooLarge(w, r, errors.Wrap(err, "PUT could not read JSON body"))
+			return
+		}
 		InternalError(w, r, errors.New("PUT could not read JSON body"))
 		return
 	}
@@ -1164,9 +1289,15 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 	modified, err = s.db.PutBSO(cId, bId, bso.Payload, bso.SortIndex, bso.TTL)
 
 	if err != nil {
-		sendRequestProblem(w, r, http.StatusBadRequest, err)
+		if err == syncstorage.ErrOverQuota {
+			WeaveOverQuota(w, r, errors.Wrap(err, "PUT rejected"))
+		} else {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+		}
 		return
 	}
+
+	s.setQuotaRemaining(w)
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Last-Modified", m)
@@ -1221,11 +1352,17 @@ func (s *SyncUserHandler) hBsoDELETE(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *SyncUserHandler) hDeleteEverything(w http.ResponseWriter, r *http.Request) {
-	err := s.db.DeleteEverything()
+	modified, err := s.db.DeleteEverything()
+
+	// the user keeps their DB so give the space back
+	if vacuumer, ok := s.db.(syncstorage.Vacuumer); ok && err == nil {
+		err = errors.Wrap(vacuumer.Vacuum(), "Could not vacuum")
+	}
+
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
-		m := syncstorage.ModifiedToString(syncstorage.Now())
+		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-Last-Modified", m)
 		w.Write([]byte(m))
@@ -0,0 +1,153 @@
+package web
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+// UserInfo is what operators see of a user's storage
+type UserInfo struct {
+	Collections map[string]int `json:"collections"` // last modified
+	Counts      map[string]int `json:"counts"`
+	Usage       map[string]int `json:"usage"` // bytes
+	QuotaUsed   int            `json:"quota_used"`
+	Quota       int            `json:"quota"`
+
+	// size of the DB file and its free pages, for storage
+	// engines that can be vacuumed
+	SizeKB int `json:"size_kb,omitempty"`
+	FreeKB int `json:"free_kb,omitempty"`
+}
+
+// adminDo runs fn holding the request lock, exclusively when write
+// is true. It returns errElementStopped when the DB has been closed
+func (s *SyncUserHandler) adminDo(write bool, fn func() error) error {
+	atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	if write {
+		s.requestLock.Lock()
+		defer s.requestLock.Unlock()
+	} else {
+		s.requestLock.RLock()
+		defer s.requestLock.RUnlock()
+	}
+
+	if s.IsStopped() {
+		return errElementStopped
+	}
+
+	return fn()
+}
+
+// Info returns the user's collections with their counts and usage
+func (s *SyncUserHandler) Info() (info *UserInfo, err error) {
+	err = s.adminDo(false, func() (err error) {
+		info = &UserInfo{}
+		if info.Collections, err = s.db.InfoCollections(); err != nil {
+			return errors.Wrap(err, "Could not get collections")
+		}
+		if info.Counts, err = s.db.InfoCollectionCounts(); err != nil {
+			return errors.Wrap(err, "Could not get collection counts")
+		}
+		if info.Usage, err = s.db.InfoCollectionUsage(); err != nil {
+			return errors.Wrap(err, "Could not get collection usage")
+		}
+		if info.QuotaUsed, info.Quota, err = s.db.InfoQuota(); err != nil {
+			return errors.Wrap(err, "Could not get quota")
+		}
+
+		if vacuumer, ok := s.db.(syncstorage.Vacuumer); ok {
+			usage, err := vacuumer.Usage()
+			if err != nil {
+				return errors.Wrap(err, "Could not get DB usage")
+			}
+			info.SizeKB = usage.Total * usage.Size / 1024
+			info.FreeKB = usage.Free * usage.Size / 1024
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// ForceTidyUp runs TidyUp now even when the next purge is not due
+func (s *SyncUserHandler) ForceTidyUp(minPurge, maxPurge time.Duration, vacuumKB int) (took time.Duration, err error) {
+	err = s.adminDo(true, func() error {
+		if err := s.db.SetKey("NEXT_PURGE", time.Now().Format(time.RFC3339Nano)); err != nil {
+			return errors.Wrap(err, "Could not reset NEXT_PURGE")
+		}
+
+		_, took, _, err = s.tidyUp(minPurge, maxPurge, vacuumKB)
+		return err
+	})
+
+	return
+}
+
+// Vacuum rewrites the DB to give its free pages back to the filesystem.
+// It returns the DB size before and after
+func (s *SyncUserHandler) Vacuum() (beforeKB, afterKB int, err error) {
+	vacuumer, ok := s.db.(syncstorage.Vacuumer)
+	if !ok {
+		return 0, 0, ErrNotSupported
+	}
+
+	err = s.adminDo(true, func() error {
+		start := time.Now()
+
+		before, err := vacuumer.Usage()
+		if err != nil {
+			return errors.Wrap(err, "Could not get usage before vacuum")
+		}
+
+		if err := vacuumer.Vacuum(); err != nil {
+			return errors.Wrap(err, "Could not vacuum")
+		}
+
+		after, err := vacuumer.Usage()
+		if err != nil {
+			return errors.Wrap(err, "Could not get usage after vacuum")
+		}
+
+		beforeKB = before.Total * before.Size / 1024
+		afterKB = after.Total * after.Size / 1024
+
+		metricMaintenanceDuration.Since(start, "vacuum")
+		if beforeKB > afterKB {
+			metricVacuumFreed.Add(float64(beforeKB - afterKB))
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Batches lists the user's uncommitted batches
+func (s *SyncUserHandler) Batches() (batches []syncstorage.BatchInfo, err error) {
+	lister, ok := s.db.(syncstorage.BatchLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	err = s.adminDo(false, func() error {
+		batches, err = lister.BatchList()
+		return err
+	})
+
+	return
+}
+
+// DeleteEverything removes all of the user's data. Unlike a client's
+// DELETE the DB is not vacuumed, it is for callers that remove its files
+func (s *SyncUserHandler) DeleteEverything() error {
+	return s.adminDo(true, func() error {
+		_, err := s.db.DeleteEverything()
+		return err
+	})
+}
@@ -36,7 +36,11 @@ func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
 			return nil, nil, errors.Wrap(err, "Could not unmarshal Request body")
 		}
 	} else { // deal with application/newlines
-		raw = ReadNewlineJSON(r.Body)
+		var err error
+		raw, err = readNewlineJSON(r.Body)
+		if err != nil && requestTooLarge(err) {
+			return nil, nil, errors.Wrap(err, "Could not read Request body")
+		}
 	}
 
 	for _, rawJSON := range raw {
@@ -86,6 +90,13 @@ var scannerPool = sync.Pool{
 // ReadNewlineDelimitedJSON takes newline separate JSON and produces
 // produces an array of json.RawMessage
 func ReadNewlineJSON(data io.Reader) []json.RawMessage {
+	raw, _ := readNewlineJSON(data)
+	return raw
+}
+
+// readNewlineJSON is ReadNewlineJSON but also returns any error from
+// reading data
+func readNewlineJSON(data io.Reader) ([]json.RawMessage, error) {
 
 	raw := []json.RawMessage{}
 
@@ -108,7 +119,7 @@ func ReadNewlineJSON(data io.Reader) []json.RawMessage {
 	}
 
 	scannerPool.Put(buf)
-	return raw
+	return raw, scanner.Err()
 }
 
 func GetBatchIdAndCommit(r *http.Request) (batchFound bool, batchId string, batchCommit bool) {
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -176,6 +180,78 @@ func TestSyncUserHandlerInfoQuota(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", &syncstorage.Config{QuotaBytes: 2048})
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	{ // PUT within quota
+		body := bytes.NewBufferString(fmt.Sprintf(`{"payload":"%s"}`, strings.Repeat("-", 1024)))
+		resp := requestheaders("PUT", syncurl(uid, "storage/test/b0"), body, header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+		assert.Equal("1.00", resp.Header().Get("X-Weave-Quota-Remaining"))
+	}
+
+	{ // info/quota has the quota
+		resp := request("GET", syncurl(uid, "info/quota"), nil, handler)
+		assert.Equal("[1.00000000,2.00000000]", resp.Body.String())
+	}
+
+	{ // PUT over quota
+		body := bytes.NewBufferString(fmt.Sprintf(`{"payload":"%s"}`, strings.Repeat("-", 1025)))
+		resp := requestheaders("PUT", syncurl(uid, "storage/test/b1"), body, header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	}
+
+	{ // POST over quota
+		body := bytes.NewBufferString(fmt.Sprintf(`[{"id":"b1","payload":"%s"}]`, strings.Repeat("-", 1025)))
+		resp := requestheaders("POST", syncurl(uid, "storage/test"), body, header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	}
+
+	{ // batch commit over quota
+		body := bytes.NewBufferString(fmt.Sprintf(`[{"id":"b1","payload":"%s"}]`, strings.Repeat("-", 1000)))
+		resp := requestheaders("POST", syncurl(uid, "storage/test?batch=true"), body, header, handler)
+		if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var results PostResults
+		if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
+			return
+		}
+
+		body = bytes.NewBufferString(fmt.Sprintf(`[{"id":"b2","payload":"%s"}]`, strings.Repeat("-", 1000)))
+		resp = requestheaders("POST", syncurl(uid, "storage/test?commit=1&batch="+results.Batch), body, header, handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+
+		{ // nothing over quota was written
+			resp := request("GET", syncurl(uid, "info/quota"), nil, handler)
+			assert.Equal("[1.00000000,2.00000000]", resp.Body.String())
+		}
+
+		// the batch is kept and can be committed once there is space
+		resp = request("DELETE", syncurl(uid, "storage/test/b0"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		resp = requestheaders("POST", syncurl(uid, "storage/test?commit=1&batch="+results.Batch), bytes.NewBufferString("[]"), header, handler)
+		if assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			resp = request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
+			assert.Equal(`{"test":2}`, resp.Body.String())
+		}
+	}
+}
+
 func TestSyncUserHandlerInfoConfiguration(t *testing.T) {
 
 	assert := assert.New(t)
@@ -650,6 +726,28 @@ func TestSyncUserHandlerBatchLimits(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerUniqueLastModified(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	url := syncurl(uid, "storage/bookmarks/bso0")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		body := bytes.NewBufferString(`{"payload": "1234"}`)
+		resp := jsonrequest("PUT", url, body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+
+		modified := resp.Header().Get("X-Last-Modified")
+		assert.False(seen[modified], "Duplicate X-Last-Modified: %s", modified)
+		seen[modified] = true
+	}
+}
+
 func TestSyncUserHandlerPUT(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -1112,6 +1210,12 @@ func TestSyncUserHandlerDeleteEverything(t *testing.T) {
 	respDelete := request("DELETE", syncurl(uid, "storage"), nil, handler)
 	assert.Equal(http.StatusOK, respDelete.Code)
 
+	// the delete is the newest change, and what info/collections reports
+	before := resp.Header().Get("X-Last-Modified")
+	assert.True(respDelete.Header().Get("X-Last-Modified") > before)
+	respInfo := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(respDelete.Header().Get("X-Last-Modified"), respInfo.Header().Get("X-Last-Modified"))
+
 	respCheck := request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
 	assert.Equal(http.StatusOK, respCheck.Code)
 	assert.Equal(`{}`, respCheck.Body.String())
@@ -1121,3 +1225,120 @@ func TestSyncUserHandlerDeleteEverything(t *testing.T) {
 		assert.Equal(http.StatusNotFound, resp.Code)
 	}
 }
+
+func TestSyncUserHandlerConcurrentReads(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	// pretend another GET is being handled
+	handler.requestLock.RLock()
+
+	get := make(chan int)
+	go func() {
+		get <- request("GET", syncurl(uid, "info/collections"), nil, handler).Code
+	}()
+
+	select {
+	case code := <-get:
+		assert.Equal(http.StatusOK, code)
+	case <-time.After(time.Second):
+		assert.Fail("GET was blocked by another reader")
+	}
+
+	put := make(chan int)
+	go func() {
+		body := bytes.NewBufferString(`{"payload": "1234"}`)
+		put <- jsonrequest("PUT", syncurl(uid, "storage/col/b0"), body, handler).Code
+	}()
+
+	select {
+	case <-put:
+		assert.Fail("PUT should wait for readers to finish")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	handler.requestLock.RUnlock()
+	assert.Equal(http.StatusOK, <-put)
+}
+
+func TestSyncUserHandlerConcurrentLastModified(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "concurrent")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := syncstorage.NewDB(filepath.Join(dir, "test.db"), nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	uid := uniqueUID()
+	handler := NewSyncUserHandler(uid, db, nil)
+	defer handler.StopHTTP()
+
+	url := syncurl(uid, "storage/col/b0")
+	resp := jsonrequest("PUT", url, bytes.NewBufferString(`{"payload":"0"}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	const numWrites = 50
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// readers always see a complete BSO and time never goes backwards
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last float64
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resp := jsonrequest("GET", url, nil, handler)
+				if !assert.Equal(http.StatusOK, resp.Code) {
+					return
+				}
+
+				var b jsonBSO
+				if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &b)) {
+					return
+				}
+
+				header := resp.Header().Get("X-Last-Modified")
+				assert.Equal(syncstorage.ModifiedToString(int(b.Modified*1000+0.5)), header)
+				assert.True(b.Modified >= last, "X-Last-Modified went backwards")
+				last = b.Modified
+			}
+		}()
+	}
+
+	var lastModified string
+	for i := 1; i <= numWrites; i++ {
+		body := bytes.NewBufferString(`{"payload":"` + strconv.Itoa(i) + `"}`)
+		resp := jsonrequest("PUT", url, body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			break
+		}
+
+		modified := resp.Header().Get("X-Last-Modified")
+		assert.True(modified > lastModified, "Expected X-Last-Modified to increase")
+		lastModified = modified
+	}
+
+	close(stop)
+	wg.Wait()
+
+	resp = jsonrequest("GET", url, nil, handler)
+	assert.Equal(lastModified, resp.Header().Get("X-Last-Modified"))
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/mozilla-services/go-syncstorage/token"
+)
+
+const defaultTokenCacheSize = 10000
+
+// TokenCache holds recently verified tokens so the HMAC check and the HKDF
+// derivations in token.ParseToken are not repeated on every request. It
+// is keyed by the complete token string, the same bytes that were verified.
+type TokenCache struct {
+	sync.Mutex
+
+	maxSize int
+
+	// lru keeps the recently used tokens in Front and the oldest in the
+	// back
+	lru    *list.List
+	lrumap map[string]*list.Element // to find *list.Element by token string
+}
+
+type tokenCacheEntry struct {
+	token  token.Token
+	secret int // index of the secret that verified it
+}
+
+func NewTokenCache(maxSize int) *TokenCache {
+	if maxSize <= 0 {
+		maxSize = defaultTokenCacheSize
+	}
+
+	return &TokenCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		lrumap:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached token and the index of the secret that verified
+// it. Expired tokens are removed and parsed again so the caller can decide
+// if they are still in the grace period
+func (c *TokenCache) Get(tokenString string) (token.Token, int, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.lrumap[tokenString]
+	if !ok {
+		metricTokenCache.Inc("miss")
+		return token.Token{}, 0, false
+	}
+
+	entry := el.Value.(tokenCacheEntry)
+	if entry.token.Expired() {
+		c.lru.Remove(el)
+		delete(c.lrumap, tokenString)
+		metricTokenCache.Inc("expired")
+		return token.Token{}, 0, false
+	}
+
+	c.lru.MoveToFront(el)
+	metricTokenCache.Inc("hit")
+	return entry.token, entry.secret, true
+}
+
+// Add caches a token verified by the secret at index, pushing out the
+// least recently used one when full. Expired tokens are not cached
+func (c *TokenCache) Add(tok token.Token, secret int) {
+	if tok.Expired() {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry := tokenCacheEntry{token: tok, secret: secret}
+	if el, ok := c.lrumap[tok.Token]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.lrumap[tok.Token] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.lrumap, oldest.Value.(tokenCacheEntry).token.Token)
+	}
+}
+
+// Purge removes every token. Used when the secrets change since tokens
+// signed with a removed secret must not be accepted anymore
+func (c *TokenCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lru.Init()
+	c.lrumap = make(map[string]*list.Element)
+}
+
+// Len is the number of cached tokens
+func (c *TokenCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTokenCache(2)
+	tok1 := testtoken("sekret", 1)
+	tok2 := testtoken("sekret", 2)
+	tok3 := testtoken("sekret", 3)
+
+	_, _, ok := c.Get(tok1.Token)
+	assert.False(ok)
+
+	c.Add(tok1, 0)
+	c.Add(tok2, 1)
+	cached, secret, ok := c.Get(tok1.Token)
+	assert.True(ok)
+	assert.Equal(tok1, cached)
+	assert.Equal(0, secret)
+
+	// tok2 is the least recently used
+	c.Add(tok3, 0)
+	assert.Equal(2, c.Len())
+	_, _, ok = c.Get(tok2.Token)
+	assert.False(ok)
+	_, _, ok = c.Get(tok1.Token)
+	assert.True(ok)
+
+	c.Purge()
+	assert.Equal(0, c.Len())
+
+	// expired tokens are not cached
+	c.Add(expiredtoken("sekret", 4, time.Minute), 0)
+	assert.Equal(0, c.Len())
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewTokenCache(10)
+	tok := testtoken("sekret", 1)
+	c.Add(tok, 0)
+
+	// make it expire while cached
+	el := c.lrumap[tok.Token]
+	tok.Payload.Expires = float64(time.Now().Add(-time.Second).Unix())
+	el.Value = tokenCacheEntry{token: tok}
+
+	_, _, ok := c.Get(tok.Token)
+	assert.False(ok)
+	assert.Equal(0, c.Len())
+}
+
+func TestHawkTokenCacheSecretsChange(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	hawkH := NewHawkHandler(EchoHandler, []string{"old", "new"})
+	tok := testtoken("old", uid)
+
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
+	assert.Equal(1, hawkH.Tokens.Len())
+
+	// tokens signed with a removed secret stop working right away
+	hawkH.SetSecrets(NewSecrets([]string{"new"}))
+	assert.Equal(0, hawkH.Tokens.Len())
+
+	req, _ = hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	assert.Equal(http.StatusUnauthorized, sendrequest(req, hawkH).Code)
+}
+
+func benchmarkHawkParseToken(b *testing.B, cache *TokenCache) {
+	hawkH := NewHawkHandler(EchoHandler, []string{"old", "sekret"})
+	hawkH.Tokens = cache
+
+	// signed with the second secret, the worst case without the cache
+	tok := testtoken("sekret", 12345)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := hawkH.parseToken(tok.Token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHawkParseTokenUncached(b *testing.B) { benchmarkHawkParseToken(b, nil) }
+func BenchmarkHawkParseTokenCached(b *testing.B) {
+	benchmarkHawkParseToken(b, NewTokenCache(defaultTokenCacheSize))
+}
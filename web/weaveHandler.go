@@ -41,6 +41,39 @@ func WeaveSizeLimitExceeded(w http.ResponseWriter, r *http.Request, reason error
 	w.Write([]byte(WEAVE_SIZE_LIMIT_EXCEEDED))
 }
 
+// WeaveOverQuota sends a 403 when a write would put the user over their quota
+func WeaveOverQuota(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(WEAVE_OVER_QUOTA))
+}
+
+// WeaveInsufficientStorage sends a 507 when the server is too low on disk
+// space to accept writes. The over quota body lets clients know it's
+// not a problem with their data
+func WeaveInsufficientStorage(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	w.Write([]byte(WEAVE_OVER_QUOTA))
+}
+
+// WeaveRequestTooLarge is like WeaveSizeLimitExceeded but sends a 413 since
+// the request body itself was too big to accept
+func WeaveRequestTooLarge(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(WEAVE_SIZE_LIMIT_EXCEEDED))
+}
+
 // WeaveHandler is a convenient and messy place to capture
 // sync 1.5, and legacy weave specific functionality.
 // TODO will have to implement http.Hijack()